@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pocc/hubcap/dl"
+)
+
+const cacheUsage = `Usage: hubcap cache <command> [options]
+
+Commands:
+  verify    Re-hash cached files and report missing, corrupt or orphaned files
+  gc        Delete cached files that captures.json does not reference
+`
+
+// cacheCmd runs `hubcap cache` subcommands and returns the exit code
+func cacheCmd(args []string) int {
+	if len(args) == 0 {
+		fmt.Print(cacheUsage)
+		return 2
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		fmt.Println("Could not read current directory", err)
+		return 1
+	}
+	switch args[0] {
+	case "verify":
+		flags := flag.NewFlagSet("cache verify", flag.ExitOnError)
+		flags.Parse(args[1:])
+		return cacheVerify(root)
+	case "gc":
+		flags := flag.NewFlagSet("cache gc", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "Report what would be deleted without deleting it")
+		flags.Parse(args[1:])
+		return cacheGC(root, *dryRun)
+	default:
+		fmt.Print(cacheUsage)
+		return 2
+	}
+}
+
+func cacheVerify(root string) int {
+	index, err := readCaptures(".cache/captures.json")
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 1
+	}
+	report, err := dl.VerifyCache(root, index)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, f := range report.Missing {
+		fmt.Printf("MISSING  %s %s\n", f.Hash, f.Filename)
+	}
+	for _, f := range report.Corrupt {
+		fmt.Printf("CORRUPT  %s %s (sha256 on disk is %s)\n", f.Hash, f.Filename, f.Actual)
+	}
+	for _, f := range report.Orphaned {
+		fmt.Printf("ORPHAN   %s (%s)\n", f.Filename, formatBytes(f.Size))
+	}
+	fmt.Printf("\033[92mINFO\033[0m Checked %d files: %d missing, %d corrupt, %d orphaned\n",
+		report.Checked, len(report.Missing), len(report.Corrupt), len(report.Orphaned))
+	if len(report.Missing)+len(report.Corrupt) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func cacheGC(root string, dryRun bool) int {
+	index, err := readCaptures(".cache/captures.json")
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 1
+	}
+	removed, reclaimed, err := dl.CollectGarbage(root, index, dryRun)
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	for _, f := range removed {
+		fmt.Printf("%s %s (%s)\n", verb, f.Filename, formatBytes(f.Size))
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("\033[92mINFO\033[0m %s %d orphaned files, reclaiming %s\n", verb, len(removed), formatBytes(reclaimed))
+	return 0
+}
+
+// formatBytes returns a size in B/KB/MB/GB, etc
+func formatBytes(size int64) string {
+	unit := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	power := 0
+	for value > 1024 && power < len(unit)-1 {
+		value /= 1024
+		power++
+	}
+	return fmt.Sprintf("%.1f %s", value, unit[power])
+}
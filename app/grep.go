@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+const grepUsage = `Usage: hubcap grep [-f <capture filter>] [-Y <display filter>] [options]
+
+Lists the cached captures that have packets matching a Wireshark display filter,
+like 'sip.Method == "REFER"' or 'tcp.analysis.zero_window', or a capture filter,
+like 'tcp[13] & 2 != 0 and port 5060'. Capture filters are run without tshark,
+so with both, only captures that match -f are read by tshark for -Y.
+
+Options:
+`
+
+const grepCacheDir = ".cache/grep"
+
+// bpfVersion stands in for the tshark version of capture filter results, which don't use tshark.
+// It changes when results would, like when len became the captured length on x/net/bpf's VM.
+const bpfVersion = "bpf-2"
+
+// grepCache has the results of one filter with one version of tshark, by capture hash
+type grepCache struct {
+	Filter        string
+	TsharkVersion string
+	Results       map[string]pcap.GrepResult
+}
+
+// grepMatch is a capture that matched, for printing
+type grepMatch struct {
+	Hash     string
+	Filename string
+	pcap.GrepResult
+}
+
+// grepFunc filters one capture
+type grepFunc func(ctx context.Context, filename string) (pcap.GrepResult, error)
+
+// grepCachePath is where results of a filter are cached, so that they're only reused with the same tshark
+func grepCachePath(filter string, tsharkVersion string) string {
+	key := sha256.Sum256([]byte(tsharkVersion + "\n" + filter))
+	return fmt.Sprintf("%s/%x.json", grepCacheDir, key)
+}
+
+// grepCmd runs `hubcap grep` and returns the exit code, which like grep's is 1 if nothing matched
+func grepCmd(args []string) int {
+	flags := flag.NewFlagSet("hubcap grep", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Print(grepUsage)
+		flags.PrintDefaults()
+	}
+	filter := flags.String("Y", "", "Display filter that packets have to match")
+	bpfExpr := flags.String("f", "", "Capture filter that packets have to match, run without tshark")
+	jobs := flags.Int("j", runtime.NumCPU(), "How many captures to read at once")
+	protocols := flags.String("protocols", "", "Only read captures that captures.json says have all of these comma separated protocols, like sip,rtp")
+	fetch := flags.Bool("fetch", false, "Download captures that were discarded, and discard them again afterwards")
+	asJSON := flags.Bool("json", false, "Print matches as JSON")
+	tsharkPath := flags.String("tshark", "tshark", "Path of the tshark to filter captures with")
+	flags.Parse(args)
+	if (*filter == "" && *bpfExpr == "") || *jobs < 1 {
+		flags.Usage()
+		return 2
+	}
+	pcap.SetTools(pcap.Tools{Tshark: *tsharkPath})
+	ctx := cancelOnSignal()
+	var bpf *pcap.BPFFilter
+	var tsharkVersion string
+	var err error
+	if *bpfExpr != "" {
+		bpf, err = pcap.CompileBPF(*bpfExpr)
+	}
+	if err == nil && *filter != "" {
+		if tsharkVersion, err = pcap.DetectTsharkVersion(ctx); err == nil {
+			err = pcap.ValidateFilter(ctx, *filter)
+		}
+	}
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 2
+	}
+	index, err := readCaptures(".cache/captures.json")
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 2
+	}
+	candidates := grepCandidates(index, strings.Split(*protocols, ","))
+	total := len(candidates)
+	var results map[string]pcap.GrepResult
+	var missing int
+	description := *filter
+	if bpf != nil {
+		results, missing = grepStage(ctx, index, candidates, *bpfExpr, bpfVersion, *jobs, *fetch,
+			func(ctx context.Context, filename string) (pcap.GrepResult, error) {
+				return pcap.GrepBPF(ctx, filename, bpf)
+			})
+		description = *bpfExpr
+	}
+	if *filter != "" {
+		if bpf != nil {
+			// Captures that weren't read or couldn't be fully filtered might match too
+			mightMatch := make([]string, 0, len(candidates))
+			for _, hash := range candidates {
+				if result, ok := results[hash]; !ok || result.Matches > 0 || result.Error != "" {
+					mightMatch = append(mightMatch, hash)
+				}
+			}
+			candidates = mightMatch
+			description = fmt.Sprintf("%s` and `%s", *bpfExpr, *filter)
+		}
+		results, missing = grepStage(ctx, index, candidates, *filter, tsharkVersion, *jobs, *fetch,
+			func(ctx context.Context, filename string) (pcap.GrepResult, error) {
+				return pcap.Grep(ctx, filename, *filter)
+			})
+	}
+	matches := make([]grepMatch, 0)
+	for _, hash := range candidates {
+		if result, ok := results[hash]; ok && result.Matches > 0 {
+			matches = append(matches, grepMatch{Hash: hash, Filename: index[hash].Filename, GrepResult: result})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Filename < matches[j].Filename })
+	printGrepMatches(matches, *asJSON)
+	if missing > 0 {
+		fmt.Printf("\033[93mWARN\033[0m Skipped %d discarded captures. Use -fetch to download them.\n", missing)
+	}
+	fmt.Printf("\033[92mINFO\033[0m %d of %d captures match `%s`\n", len(matches), total, description)
+	if ctx.Err() != nil {
+		return 130
+	}
+	if len(matches) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// grepStage filters the captures that aren't cached yet with one filter, and returns the results
+// by hash and how many captures were skipped because they were discarded
+func grepStage(ctx context.Context, index map[string]ds.PcapInfo, candidates []string, filter string, version string,
+	jobs int, fetch bool, grep grepFunc) (map[string]pcap.GrepResult, int) {
+	cachePath := grepCachePath(filter, version)
+	cache := loadGrepCache(cachePath, filter, version)
+	todo := make([]string, 0, len(candidates))
+	for _, hash := range candidates {
+		if _, ok := cache.Results[hash]; !ok {
+			todo = append(todo, hash)
+		}
+	}
+	fmt.Printf("\033[92mINFO\033[0m Filtering %d captures with `%s` (%d cached)\n", len(todo), filter, len(candidates)-len(todo))
+	missing := grepCaptures(ctx, index, todo, jobs, fetch, cache, grep)
+	if err := saveGrepCache(cachePath, cache); err != nil {
+		fmt.Println("\033[93mWARN\033[0m Problem saving", cachePath, err)
+	}
+	return cache.Results, missing
+}
+
+// grepCandidates returns the hashes of captures that have every protocol in protocols, sorted
+func grepCandidates(index map[string]ds.PcapInfo, protocols []string) []string {
+	candidates := make([]string, 0, len(index))
+	for hash, pi := range index {
+		if strings.HasPrefix(hash, "->") || !hasProtocols(pi, protocols) {
+			continue
+		}
+		candidates = append(candidates, hash)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// hasProtocols returns whether a capture has every protocol. Sampled captures might have
+// protocols their sample doesn't, so they always do.
+func hasProtocols(pi ds.PcapInfo, protocols []string) bool {
+	if pi.Sample != nil {
+		return true
+	}
+	has := make(map[string]bool, len(pi.Protocols))
+	for _, protocol := range pi.Protocols {
+		has[protocol] = true
+	}
+	for _, protocol := range protocols {
+		protocol = strings.TrimSpace(protocol)
+		if protocol != "" && !has[protocol] {
+			return false
+		}
+	}
+	return true
+}
+
+// grepCaptures filters captures jobs at a time, adding their results to cache,
+// and returns how many were skipped because they were discarded
+func grepCaptures(ctx context.Context, index map[string]ds.PcapInfo, hashes []string, jobs int, fetch bool, cache *grepCache, grep grepFunc) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	missing := 0
+	limiter := make(chan struct{}, jobs)
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			break
+		}
+		limiter <- struct{}{}
+		wg.Add(1)
+		go func(hash string, pi ds.PcapInfo) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+			filename, cleanup := pi.Filename, ""
+			if _, err := os.Stat(filename); err != nil {
+				if !fetch {
+					mutex.Lock()
+					missing++
+					mutex.Unlock()
+					return
+				}
+				if filename, cleanup, err = fetchCapture(ctx, hash, pi); err != nil {
+					fmt.Println(twoLines(err))
+					return
+				}
+			}
+			result, err := grep(ctx, filename)
+			if cleanup != "" {
+				discard(cleanup)
+			}
+			// Interrupted and killed reads are tried again next time
+			if ctx.Err() != nil || pcap.FailureCategory(err) != "" {
+				if err != nil && ctx.Err() == nil {
+					fmt.Println("\033[93mWARN\033[0m", err)
+				}
+				return
+			}
+			mutex.Lock()
+			cache.Results[hash] = result
+			mutex.Unlock()
+		}(hash, index[hash])
+	}
+	wg.Wait()
+	return missing
+}
+
+func loadGrepCache(path string, filter string, tsharkVersion string) *grepCache {
+	cache := &grepCache{Filter: filter, TsharkVersion: tsharkVersion, Results: make(map[string]pcap.GrepResult)}
+	cacheText, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	var cached grepCache
+	if err := json.Unmarshal(cacheText, &cached); err != nil || cached.Filter != filter || cached.TsharkVersion != tsharkVersion {
+		fmt.Println("\033[93mWARN\033[0m Ignoring unusable grep cache", path)
+		return cache
+	}
+	if cached.Results != nil {
+		cache.Results = cached.Results
+	}
+	return cache
+}
+
+func saveGrepCache(path string, cache *grepCache) error {
+	if err := os.MkdirAll(grepCacheDir, 0755); err != nil {
+		return err
+	}
+	cacheText, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, cacheText, 0644)
+}
+
+func printGrepMatches(matches []grepMatch, asJSON bool) {
+	if asJSON {
+		matchText, _ := json.MarshalIndent(matches, "", "  ")
+		fmt.Println(string(matchText))
+		return
+	}
+	for _, match := range matches {
+		frames := make([]string, len(match.FirstFrames))
+		for i, frame := range match.FirstFrames {
+			frames[i] = fmt.Sprint(frame)
+		}
+		fmt.Printf("%s\t%d matches\tframes %s\n", match.Filename, match.Matches, strings.Join(frames, ","))
+	}
+}
@@ -9,14 +9,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//flags "github.com/jessevdk/go-flags"
@@ -46,12 +51,132 @@ var opts struct {
 
 var goroutineLimit = 1000
 
+// crawlOpts are the options for a crawl, which is what hubcap does without a subcommand
+var crawlOpts struct {
+	metadataOnly bool
+	reanalyze    bool
+	checkpoint   time.Duration
+	repair       string
+	allowMixed   bool
+	versions     pcap.ToolVersions
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cache":
+			os.Exit(cacheCmd(os.Args[2:]))
+		case "grep":
+			os.Exit(grepCmd(os.Args[2:]))
+		case "query":
+			os.Exit(queryCmd(os.Args[2:]))
+		case "serve":
+			os.Exit(serveCmd(os.Args[2:]))
+		}
+	}
+	flags := flag.NewFlagSet("hubcap", flag.ExitOnError)
+	flags.BoolVar(&crawlOpts.metadataOnly, "metadata-only", false, "Delete each capture once it is analyzed and keep only its metadata")
+	flags.BoolVar(&crawlOpts.reanalyze, "reanalyze", false, "Analyze cached captures again, downloading any that were discarded")
+	flags.DurationVar(&crawlOpts.checkpoint, "checkpoint", 5*time.Minute, "How often to save progress during a crawl (0 to disable)")
+	flags.StringVar(&crawlOpts.repair, "repair", "off", "Write repaired copies of damaged captures and index the \"original\" or the \"repaired\" one (or \"off\")")
+	archiveDepth := flags.Int("archive-depth", dl.DefaultExtractLimits().MaxDepth, "How many layers of archives inside archives to extract")
+	archiveMaxSize := flags.String("archive-max-size", "10GB", "Most bytes to extract from one download, counting nested archives")
+	archiveMaxFiles := flags.Int("archive-max-files", dl.DefaultExtractLimits().MaxFiles, "Most files to extract from one download")
+	archiveMaxRatio := flags.Float64("archive-max-ratio", dl.DefaultExtractLimits().MaxRatio, "Most bytes extracted per downloaded byte before an archive is treated as a bomb")
+	passwordsPath := flags.String("passwords", defaultPasswordsPath, "JSON file of passwords to try on encrypted archives, globally and per source")
+	tagsPath := flags.String("tags", defaultTagsPath, "JSON file of rules that tag captures by topic, like voip or ics-scada")
+	toolTimeout := flags.Duration("tool-timeout", pcap.DefaultToolLimits().Timeout, "Longest that one tshark or capinfos call may run (0 for no limit)")
+	toolMaxMemory := flags.String("tool-max-memory", "8GB", "Most memory one tshark or capinfos call may use on Linux (0 for no limit)")
+	toolMaxCPU := flags.Duration("tool-max-cpu", pcap.DefaultToolLimits().MaxCPU, "Most CPU time one tshark or capinfos call may use on Linux (0 for no limit)")
+	tsharkPath := flags.String("tshark", "tshark", "Path of the tshark to analyze captures with")
+	capinfosPath := flags.String("capinfos", "capinfos", "Path of the capinfos to analyze captures with")
+	flags.BoolVar(&crawlOpts.allowMixed, "allow-mixed-versions", false, "Add to a captures.json made with a different major version of Wireshark")
+	sampleMaxSize := flags.String("sample-max-size", "0", "Sample captures larger than this, like 2GB (0 to never sample by size)")
+	sampleMaxPackets := flags.Int("sample-max-packets", 0, "Sample captures with more packets than this (0 to never sample by packets)")
+	sampleMode := flags.String("sample-mode", pcap.SampleHead, "How to sample: the first packets (\"head\"), or packets spread by number (\"packets\") or by time (\"time\")")
+	samplePackets := flags.Int("sample-packets", pcap.DefaultSampling().Packets, "How many packets a sample has")
+	quotaStr := flags.String("quota", "", "Most disk space downloads may use at once, like 500MB or 20GB (requires -metadata-only)")
+	flags.Parse(os.Args[1:])
+	switch crawlOpts.repair {
+	case "off", ds.ServeOriginal, ds.ServeRepaired:
+	default:
+		fmt.Println("\033[91mERROR\033[0m -repair must be off, original or repaired, not", crawlOpts.repair)
+		os.Exit(2)
+	}
+	limits := dl.DefaultExtractLimits()
+	limits.MaxDepth = *archiveDepth
+	limits.MaxFiles = *archiveMaxFiles
+	limits.MaxRatio = *archiveMaxRatio
+	maxSize, err := parseSize(*archiveMaxSize)
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	limits.MaxTotalSize = maxSize
+	dl.SetExtractLimits(limits)
+	toolMemory, err := parseLimit(*toolMaxMemory)
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	pcap.SetToolLimits(pcap.ToolLimits{Timeout: *toolTimeout, MaxMemory: toolMemory, MaxCPU: *toolMaxCPU})
+	switch *sampleMode {
+	case pcap.SampleHead, pcap.SamplePackets, pcap.SampleTime:
+	default:
+		fmt.Println("\033[91mERROR\033[0m -sample-mode must be head, packets or time, not", *sampleMode)
+		os.Exit(2)
+	}
+	sampleSize, err := parseLimit(*sampleMaxSize)
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	pcap.SetSampling(pcap.Sampling{MaxSize: sampleSize, MaxPackets: *sampleMaxPackets, Mode: *sampleMode, Packets: *samplePackets})
+	pcap.SetTools(pcap.Tools{Tshark: *tsharkPath, Capinfos: *capinfosPath})
+	crawlOpts.versions, err = pcap.DetectVersions(context.Background())
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	fmt.Printf("\033[92mINFO\033[0m Using tshark %s and capinfos %s\n", crawlOpts.versions.Tshark, crawlOpts.versions.Capinfos)
+	if err = loadPasswords(*passwordsPath); err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	if err = loadTagRules(*tagsPath); err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		os.Exit(2)
+	}
+	if *quotaStr != "" {
+		quota, err := parseSize(*quotaStr)
+		if err != nil {
+			fmt.Println("\033[91mERROR\033[0m", err)
+			os.Exit(2)
+		}
+		// Without discarding, files are never freed and downloads would wait forever for space
+		if !crawlOpts.metadataOnly {
+			fmt.Println("\033[91mERROR\033[0m -quota requires -metadata-only")
+			os.Exit(2)
+		}
+		dl.SetDiskQuota(quota)
+	}
+	crawl()
+}
+
+// crawl gathers links from every source, then downloads and analyzes anything not already in the cache
+func crawl() {
 	var wg sync.WaitGroup
+	ctx := cancelOnSignal()
 	links := make(map[string]string)
 	cacheLinks := make([]string, 0)
-	resultJSON := ds.NewDS()
-	cacheJSON := ds.NewDS()
+	resultJSON := ds.NewPcapStore()
+	cacheJSON := ds.NewPcapStore()
+	reanalyzing := ds.NewPcapStore() // Cached captures whose reanalysis hasn't finished
+	completed := &linkSet{links: make(map[string]bool)}
+	state := loadCrawlState()
+	for link, desc := range state.Pending {
+		links[link] = desc
+	}
 
 	// Each fn adds gathered links to existing map
 	// These calls are cheap, so always check if there are new PL/WS pcaps
@@ -64,181 +189,563 @@ func main() {
 	_, err := os.Stat(".cache/captures.json")
 	if !os.IsNotExist(err) {
 		loadCache(links, cacheJSON)
-		for k, v := range cacheJSON.Cache {
-			resultJSON.Set(k, &v)
-			cacheLinks = append(cacheLinks, v.Sources...)
+		// Reanalysis finds every capture's endpoints again
+		if !crawlOpts.reanalyze {
+			loadIndex(cacheJSON.Snapshot())
+		}
+		// Reanalysis replaces every old result, so only adding to the cache can mix versions
+		if !crawlOpts.reanalyze && !crawlOpts.allowMixed {
+			if err := checkToolVersions(cacheJSON.Snapshot(), crawlOpts.versions); err != nil {
+				fmt.Println("\033[91mERROR\033[0m", err)
+				os.Exit(2)
+			}
 		}
+		cacheJSON.Range(func(k string, v ds.PcapInfo) bool {
+			cacheLinks = append(cacheLinks, v.Sources...)
+			if crawlOpts.reanalyze && k[0] != '-' {
+				for runtime.NumGoroutine() > goroutineLimit {
+					time.Sleep(time.Duration(10) * time.Millisecond)
+				}
+				wg.Add(1)
+				reanalyzing.Merge(k, v)
+				go reanalyzePcap(ctx, k, v, resultJSON, reanalyzing, &wg)
+				return true
+			}
+			resultJSON.Merge(k, v)
+			return true
+		})
 	}
-	html.GetWsBugzillaLinks(cacheLinks, links)
+	writeRunInfo(crawlOpts.versions)
+	state.Cursors["wireshark_bugs"] = html.GetWsBugzillaLinks(ctx, state.Cursors["wireshark_bugs"], cacheLinks, links)
+	state.save(links, completed)
 
+	checkpointCtx, stopCheckpoints := context.WithCancel(ctx)
+	checkpointsDone := make(chan struct{})
+	go func() {
+		defer close(checkpointsDone)
+		checkpoint(checkpointCtx, crawlOpts.checkpoint, resultJSON, reanalyzing, state, links, completed)
+	}()
 	for link, desc := range links {
+		if ctx.Err() != nil {
+			break
+		}
 		for runtime.NumGoroutine() > goroutineLimit {
 			time.Sleep(time.Duration(10) * time.Millisecond)
 		}
 		wg.Add(1)
-		go getPcapJSON(link, desc, resultJSON, &wg)
+		go func(link string, desc string) {
+			defer wg.Done()
+			// Links that aren't done stay pending, so the next run tries them again
+			if getPcapJSON(ctx, link, desc, resultJSON) && ctx.Err() == nil {
+				completed.add(link)
+			}
+		}(link, desc)
 	}
 	fmt.Printf("Waiting for %d goroutines to finish...\n", runtime.NumGoroutine())
 	wg.Wait() // All goroutines MUST complete before writing results
+	stopCheckpoints()
+	// A checkpoint that is still writing would race the final writes for the same .tmp files
+	<-checkpointsDone
+	state.save(links, completed)
 
-	resultAndCacheDiffer := false
-	for k, v := range resultJSON.Cache {
-		if !reflect.DeepEqual(cacheJSON.Cache[k], v) {
-			resultAndCacheDiffer = true
-			break
-		}
-	}
-	if resultAndCacheDiffer {
-		addedPcapCount := len(resultJSON.Cache) - len(cacheJSON.Cache)
-		addedLinkCount := getLinkCount(resultJSON) - getLinkCount(cacheJSON)
+	results := resultJSON.Snapshot()
+	tagCaptures(results)
+	cached := cacheJSON.Snapshot()
+	if !reflect.DeepEqual(results, cached) {
+		addedPcapCount := len(results) - len(cached)
+		addedLinkCount := getLinkCount(results) - getLinkCount(cached)
 		fmt.Printf("\n\033[92mINFO\033[0m Writing information about %d/%d new links & %d/%d new files to .cache/captures.json\n",
-			addedLinkCount, getLinkCount(resultJSON), addedPcapCount, len(resultJSON.Cache))
-		writeJSON(resultJSON.Cache)
+			addedLinkCount, getLinkCount(results), addedPcapCount, len(results))
+		writeJSON(results)
+		writeIndex(results)
 	} else {
 		fmt.Println("\n\033[92mINFO\033[0m Skipping write: There are no new pcaps to add to captures.json")
 	}
 }
 
-func getLinkCount(cache *ds.DataStore) int {
+func getLinkCount(cache map[string]ds.PcapInfo) int {
 	count := 0
-	for _, v := range cache.Cache {
+	for _, v := range cache {
 		count += len(v.Sources)
 	}
 	return count
 }
 
 // Use the cache to skip analyzing pcaps that we have data on
-func loadCache(allLinks map[string]string, cacheJSON *ds.DataStore) {
+func loadCache(allLinks map[string]string, cacheJSON *ds.PcapStore) {
 	initalCount := len(allLinks)
 	fmt.Println("\033[92mINFO\033[0m Using cached data from .cache/captures.json")
-	capturesFD, err := os.Open(".cache/captures.json")
+	captureStruct, err := readCaptures(".cache/captures.json")
 	if err != nil {
-		fmt.Println("Problem opening captures.json. Not using data cache will take longer.")
-		return
-	}
-
-	var captureStruct map[string]ds.PcapInfo
-	captureText, ioErr := ioutil.ReadAll(capturesFD)
-	if ioErr != nil {
-		fmt.Println("Problem reading captures cache. Error:", ioErr)
+		fmt.Println(err)
+		if os.IsNotExist(errors.Unwrap(err)) {
+			fmt.Println("Problem opening captures.json. Not using data cache will take longer.")
+			return
+		}
 		os.Exit(1)
 	}
-	json.Unmarshal(captureText, &captureStruct)
 	for filehash, capture := range captureStruct {
-		cacheJSON.Set(filehash, &capture)
+		// Older caches only kept one description, which can only be attributed if there was one source
+		if filehash[0] != '-' && len(capture.Descriptions) == 0 && len(capture.Sources) == 1 {
+			capture.Descriptions = []ds.SourceInfo{sourceInfo(capture.Sources[0], capture.Description)}
+		}
+		cacheJSON.Merge(filehash, capture)
 		for _, link := range capture.Sources {
 			delete(allLinks, link)
 		}
 	}
-	fmt.Printf("\033[92mINFO\033[0m Loading %d links and %d unique files from cache\n", initalCount-len(allLinks), len(cacheJSON.Cache))
+	fmt.Printf("\033[92mINFO\033[0m Loading %d links and %d unique files from cache\n", initalCount-len(allLinks), cacheJSON.Len())
+}
+
+// sourceInfo describes what the page at link says about a capture
+func sourceInfo(link string, desc string) ds.SourceInfo {
+	return ds.SourceInfo{Source: html.SourceName(link), Link: link, Title: html.LinkTitle(link), Description: desc}
+}
+
+// readCaptures reads a captures.json written by writeJSON
+func readCaptures(jsonPath string) (map[string]ds.PcapInfo, error) {
+	captureText, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading captures cache %s: %w", jsonPath, err)
+	}
+	var captureStruct map[string]ds.PcapInfo
+	if err = json.Unmarshal(captureText, &captureStruct); err != nil {
+		return nil, fmt.Errorf("Problem parsing captures cache %s: %w", jsonPath, err)
+	}
+	return captureStruct, nil
 }
 
-func getPcapJSON(link string, desc string, result *ds.DataStore, wg *sync.WaitGroup) {
+// getPcapJSON downloads and analyzes the file at link. It returns whether the link is done with, which it
+// is once its captures or its failure are in result. Links that failed to download can be tried again.
+func getPcapJSON(ctx context.Context, link string, desc string, result *ds.PcapStore) bool {
 	if desc == "Authorization Required" {
 		newPi := ds.PcapInfo{Sources: []string{link}, Description: "Bugzilla does not permit access for this file."}
-		result.Set("->Error:AuthorizationRequired", &newPi)
-		wg.Done()
-		return
+		result.Merge("->Error:AuthorizationRequired", newPi)
+		return true
 	}
 
-	pi := ds.PcapInfo{Sources: []string{link}, Description: desc}
+	pi := ds.PcapInfo{Sources: []string{link}, Description: desc, Descriptions: []ds.SourceInfo{sourceInfo(link, desc)}}
 	var dlErr error
-	pi.Filename, dlErr = dl.FetchFile(link)
+	pi.Filename, dlErr = dl.FetchFile(ctx, link)
 	if dlErr == nil {
 		archiveFolder := dl.StripArchiveExt(pi.Filename)
 		isArchive := archiveFolder != pi.Filename
 		if isArchive {
-			getArchiveInfo(archiveFolder, &pi, result)
+			getArchiveInfo(ctx, archiveFolder, &pi, result)
 		} else {
-			getPcapInfo(&pi, result) // No reason to be concurrent here
-		}
-	} else {
-		fmt.Println(twoLines(dlErr))
-		switch {
-		case strings.Contains(dlErr.Error(), "non-pcap"):
-			newPi := ds.PcapInfo{Sources: []string{link}, Description: "Files whose URL have a non-pcap file extension."}
-			result.Set("->Error:NotAPcap", &newPi)
-		case strings.Contains(dlErr.Error(), "Invalid Attachment ID"):
-			newPi := ds.PcapInfo{Sources: []string{link}, Description: "This link is to a non-existant attachment in the wireshark bug database."}
-			result.Set("->Error:InvalidAttachment", &newPi)
+			getPcapInfo(ctx, &pi, result) // No reason to be concurrent here
 		}
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	fmt.Println(twoLines(dlErr))
+	switch {
+	case strings.Contains(dlErr.Error(), "non-pcap"):
+		newPi := ds.PcapInfo{Sources: []string{link}, Description: "Files whose URL have a non-pcap file extension."}
+		result.Merge("->Error:NotAPcap", newPi)
+		return true
+	case strings.Contains(dlErr.Error(), "Invalid Attachment ID"):
+		newPi := ds.PcapInfo{Sources: []string{link}, Description: "This link is to a non-existant attachment in the wireshark bug database."}
+		result.Merge("->Error:InvalidAttachment", newPi)
+		return true
 	}
-	wg.Done()
+	// Network errors, server errors and a full quota may not happen next time
+	return false
 }
 
-func getArchiveInfo(archiveFolder string, pi *ds.PcapInfo, result *ds.DataStore) {
+func getArchiveInfo(ctx context.Context, archiveFolder string, pi *ds.PcapInfo, result *ds.PcapStore) {
 	var files []string
+	var manifest *ds.ArchiveManifest
 	var err error
 	var wg sync.WaitGroup
-	archiveHasPcaps := false
+	var pcapCount int32
 	_, fileErr := os.Stat(archiveFolder)
 	isArchiveExtracted := !os.IsNotExist(fileErr)
 	if isArchiveExtracted {
-		files, err = dl.WalkArchive(archiveFolder)
+		files, err = dl.WalkArchive(ctx, archiveFolder)
 	} else {
-		files, err = dl.UnarchivePcaps(pi.Filename)
+		files, manifest, err = dl.UnarchivePcaps(ctx, pi.Filename, pi.Sources, passwords.forLinks(pi.Sources))
+	}
+	if ctx.Err() != nil {
+		return // Leave the archive for the next run to analyze
+	}
+	var locked *dl.LockedError
+	if errors.As(err, &locked) {
+		fmt.Println("\033[93mWARN\033[0m", locked)
+		discard(pi.Filename)
+		lockedPi := ds.PcapInfo{Sources: pi.Sources, Description: "This archive is encrypted and no known password opens it."}
+		for _, link := range pi.Sources {
+			lockedPi.Failures = append(lockedPi.Failures, ds.Failure{Link: link, Category: "PasswordRequired", Detail: locked.Error()})
+		}
+		result.Merge("->Error:ArchiveLocked", lockedPi)
+		return
+	}
+	var refused *dl.ExtractError
+	if errors.As(err, &refused) {
+		fmt.Println("\033[93mWARN\033[0m", refused)
+		discard(pi.Filename)
+		refusedPi := ds.PcapInfo{Sources: pi.Sources, Description: "Hubcap refused to extract this archive."}
+		for _, link := range pi.Sources {
+			refusedPi.Failures = append(refusedPi.Failures, ds.Failure{Link: link, Category: refused.Reason, Detail: refused.Error()})
+		}
+		result.Merge("->Error:ArchiveRefused", refusedPi)
+		return
 	}
 	if err != nil {
 		pi.ErrorStr = twoLines(err).Error()
 		fmt.Println(twoLines(err))
 	} else {
 		for _, extractedName := range files {
-			pi.Filename = extractedName
 			// Each pcap should have separate PcapInfo
-			newPi := pi
+			newPi := ds.ClonePcapInfo(*pi)
+			newPi.Filename = extractedName
+			newPi.ArchivePath = dl.ArchiveChain(pi.Filename, extractedName)
+			if manifest != nil {
+				member, _ := manifest.Member(newPi.ArchivePath)
+				newPi.ArchivePassword = member.Password
+				newPi.Archive = manifest.SHA256
+				newPi.Siblings = manifest.Siblings(newPi.ArchivePath)
+			}
 			for runtime.NumGoroutine() > goroutineLimit {
 				time.Sleep(time.Duration(10) * time.Millisecond)
 			}
 			wg.Add(1)
-			go func(pi *ds.PcapInfo, result *ds.DataStore) {
-				getPcapInfo(pi, result)
-				fd, _ := os.Stat(pi.Filename)
-				if fd != nil { // If it still exists, it will have been a pcap
-					archiveHasPcaps = true
+			go func(pi *ds.PcapInfo, result *ds.PcapStore) {
+				if getPcapInfo(ctx, pi, result) {
+					atomic.AddInt32(&pcapCount, 1)
 				}
 				wg.Done()
-			}(newPi, result)
+			}(&newPi, result)
 		}
 	}
 	wg.Wait()
+	archiveHasPcaps := pcapCount > 0
+	if ctx.Err() != nil {
+		return
+	}
+	if archiveHasPcaps && crawlOpts.metadataOnly {
+		discard(archiveFolder)
+	}
+	// The manifest still says what the archive had, so the archive itself can go with its captures
+	if manifest != nil && crawlOpts.metadataOnly {
+		discard(dl.StoredArchive(pi.Filename, manifest))
+	}
 	if !archiveHasPcaps {
 		fmt.Println("\033[92mINFO\033[0m Deleting archive folder without pcaps:", archiveFolder)
-		delErr := os.RemoveAll(archiveFolder)
-		if delErr != nil {
-			fmt.Println("Problem with deleting archive without pcaps:", delErr)
-		}
+		discard(archiveFolder)
 		newPi := ds.PcapInfo{Sources: pi.Sources, Description: "Captype reports this file as having a filetype of \"unknown\"."}
-		result.Set("->Error:CaptypeUnknown", &newPi)
+		result.Merge("->Error:CaptypeUnknown", newPi)
 	}
 }
 
-func getPcapInfo(pi *ds.PcapInfo, result *ds.DataStore) {
+// getPcapInfo analyzes a file and returns whether it was a pcap
+func getPcapInfo(ctx context.Context, pi *ds.PcapInfo, result *ds.PcapStore) bool {
 	relFileName := ".cache/" + strings.SplitN(pi.Filename, ".cache/", 2)[1]
+	localFileName := pi.Filename
 	var err error
-	err = pcap.IsPcap(pi.Filename)
+	err = pcap.IsPcap(ctx, pi.Filename)
+	if ctx.Err() != nil {
+		return true // An interrupted analysis says nothing about the file, so keep it
+	}
+	if recordToolKill(err, pi, result) {
+		return true
+	}
 	if err == nil {
-		// TODO fix should be a command line option and available as an option
-		pi.Capinfos, err = pcap.GetCapinfos(pi.Filename, false)
-		pi.Protocols, pi.Ports, err = pcap.GetTsharkJSON(pi.Filename)
+		pi.Repair = repairPcap(localFileName)
+		if pi.Repair != nil && pi.Repair.Served == ds.ServeRepaired {
+			localFileName = pcap.RepairedName(localFileName)
+			relFileName = pi.Repair.Repaired
+		}
+		pi.TsharkVersion, pi.CapinfosVersion = crawlOpts.versions.Tshark, crawlOpts.versions.Capinfos
+		if format, ok := pcap.DetectFileFormat(localFileName); ok {
+			pi.Format, pi.Endianness, pi.Precision = format.Name, format.Endianness, format.Precision
+		}
+		var analysis *pcap.CaptureAnalysis
+		analysis, err = pcap.AnalyzeCapture(ctx, localFileName, nil)
+		if ctx.Err() != nil {
+			return true
+		}
+		if recordToolKill(err, pi, result) {
+			return true
+		}
+		if analysis != nil {
+			pi.Capinfos, pi.Protocols, pi.Ports = analysis.Capinfos, analysis.Protocols, analysis.Ports
+			pi.ProtocolFrames, pi.Conversations = analysis.ProtocolFrames, analysis.Conversations
+			pi.Sample = sampleInfo(analysis.Sample)
+			if analysis.Quality != nil {
+				quality := ds.Quality(*analysis.Quality)
+				pi.Quality = &quality
+			}
+			pi.Pcapng = pcapngInfo(analysis.Pcapng)
+		}
 		if err != nil {
 			fmt.Println(err.Error())
 			pi.ErrorStr = err.Error()
 		}
 		// Remove folder heirarchy
 		pi.Filename = relFileName
+		pi.Discarded = crawlOpts.metadataOnly
 		// Capinfos filename is redundant so remove it
+		delete(pi.Capinfos, "FileName")
 		// Primary key of JSON should be SHA256 of pcap if possible
 		fileHash := fmt.Sprintf("%s", pi.Capinfos["SHA256"])
-		result.Set(fileHash, pi)
-		result.DeleteFilename(fileHash, pi)
-	} else {
+		decryptPcap(ctx, localFileName, fileHash, pi)
+		if ctx.Err() != nil {
+			return true
+		}
+		if analysis != nil && analysis.Capinfos != nil {
+			captureEndpoints.Merge(fileHash, ds.CaptureEndpoints(analysis.Endpoints))
+		}
+		result.Merge(fileHash, *pi)
+		if crawlOpts.metadataOnly {
+			discard(localFileName)
+			if pi.Repair != nil {
+				discard(pi.Repair.Original)
+				discard(pi.Repair.Repaired)
+			}
+		}
+		return true
+	}
+	fmt.Println(twoLines(err))
+	fmt.Println("\033[92mINFO\033[0m Deleting unused", pi.Filename)
+	// If file is not a pcap, make a note of the link and delete it
+	discard(pi.Filename)
+	newPi := ds.PcapInfo{Sources: pi.Sources, Description: "Captype reports this file as having a filetype of \"unknown\"."}
+	result.Merge("->Error:CaptypeUnknown", newPi)
+	return false
+}
+
+// recordToolKill records a capture whose analysis was killed for running too long or using too much,
+// and returns whether it was. The capture is kept unless captures are being discarded.
+func recordToolKill(err error, pi *ds.PcapInfo, result *ds.PcapStore) bool {
+	category := pcap.FailureCategory(err)
+	if category == "" {
+		return false
+	}
+	fmt.Println("\033[93mWARN\033[0m", err)
+	killedPi := ds.PcapInfo{Sources: pi.Sources, Description: "Analyzing this capture went past hubcap's tool limits."}
+	for _, link := range pi.Sources {
+		killedPi.Failures = append(killedPi.Failures, ds.Failure{Link: link, Category: category, Detail: err.Error()})
+	}
+	result.Merge("->Error:ToolKilled", killedPi)
+	if crawlOpts.metadataOnly {
+		discard(pi.Filename)
+		if pi.Repair != nil {
+			discard(pcap.RepairedName(pi.Filename))
+		}
+	}
+	return true
+}
+
+// repairPcap writes a repaired copy of a damaged capture next to it when -repair is on.
+// It returns nil if repair is off or there was nothing to repair.
+func repairPcap(localFileName string) *ds.Repair {
+	if crawlOpts.repair == "off" {
+		return nil
+	}
+	repairedName := pcap.RepairedName(localFileName)
+	report, err := pcap.Repair(localFileName, repairedName)
+	if err != nil {
+		fmt.Println("\033[93mWARN\033[0m Could not repair", localFileName, err)
+		return nil
+	}
+	if report == nil {
+		return nil
+	}
+	fmt.Printf("\033[92mINFO\033[0m Repaired %s (%s), recovering %d packets\n", localFileName, strings.Join(report.Fixes, ", "), report.Packets)
+	return &ds.Repair{
+		Original:       ".cache/" + strings.SplitN(localFileName, ".cache/", 2)[1],
+		OriginalSHA256: pcap.GetSHA256(localFileName),
+		Repaired:       ".cache/" + strings.SplitN(repairedName, ".cache/", 2)[1],
+		RepairedSHA256: pcap.GetSHA256(repairedName),
+		Served:         crawlOpts.repair,
+		Fixes:          report.Fixes,
+		Packets:        report.Packets,
+		Skipped:        report.Skipped,
+	}
+}
+
+// sampleInfo records how a capture was sampled, if it was
+func sampleInfo(report *pcap.SampleReport) *ds.Sample {
+	if report == nil {
+		return nil
+	}
+	return &ds.Sample{
+		Mode:       report.Mode,
+		Packets:    report.Packets,
+		MaxSize:    report.MaxSize,
+		MaxPackets: report.MaxPackets,
+		Analyzed:   report.Analyzed,
+		Total:      report.Total,
+	}
+}
+
+func pcapngInfo(meta *pcap.PcapngMetadata) *ds.PcapngInfo {
+	if meta == nil {
+		return nil
+	}
+	info := &ds.PcapngInfo{SectionComments: meta.SectionComments, DecryptionSecrets: meta.DecryptionSecrets}
+	for _, pc := range meta.PacketComments {
+		info.PacketComments = append(info.PacketComments, ds.PacketComment(pc))
+	}
+	for _, iface := range meta.Interfaces {
+		info.Interfaces = append(info.Interfaces, ds.InterfaceOptions(iface))
+	}
+	for _, record := range meta.NameResolution {
+		info.NameResolution = append(info.NameResolution, ds.NameRecord(record))
+	}
+	return info
+}
+
+// decryptPcap analyzes a capture again with the secrets that came with it. If that reveals
+// protocols, the capture is decryptable and its protocols and ports are those of the decrypted traffic.
+func decryptPcap(ctx context.Context, localFileName string, hash string, pi *ds.PcapInfo) {
+	root, err := os.Getwd()
+	if err != nil {
+		fmt.Println("\033[93mWARN\033[0m Could not read current directory", err)
+		return
+	}
+	// Reanalyzed captures already have their secrets stored, and their siblings may be gone
+	if len(pi.Secrets) == 0 && len(pi.Siblings) > 0 {
+		pi.Secrets, err = dl.StoreSecrets(root, hash, pi.Siblings)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	dec := dl.Decryption(root, pi.Secrets)
+	if dec.IsEmpty() {
+		return
+	}
+	fmt.Printf("\033[92mINFO\033[0m Decrypting %s with %d secrets\n", localFileName, len(pi.Secrets))
+	// Keys are exchanged at the start of a connection, so sampled captures decrypt their first packets
+	maxPackets := 0
+	if pi.Sample != nil {
+		maxPackets = pi.Sample.Packets
+	}
+	protocols, ports, err := pcap.GetDecryptedTsharkJSON(ctx, localFileName, dec, maxPackets)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
 		fmt.Println(twoLines(err))
-		fmt.Println("\033[92mINFO\033[0m Deleting unused", pi.Filename)
-		// If file is not a pcap, make a note of the link and delete it
-		os.Remove(pi.Filename)
-		newPi := ds.PcapInfo{Sources: pi.Sources, Description: "Captype reports this file as having a filetype of \"unknown\"."}
-		result.Set("->Error:CaptypeUnknown", &newPi)
 	}
+	pi.Decryptable = pcap.RevealsProtocols(pi.Protocols, protocols)
+	if pi.Decryptable {
+		pi.Protocols, pi.Ports = protocols, ports
+	}
+}
+
+// reanalyzePcap analyzes a cached capture again, downloading it from its sources if it was discarded.
+// The capture is removed from reanalyzing once its new analysis is in result.
+func reanalyzePcap(ctx context.Context, hash string, pi ds.PcapInfo, result *ds.PcapStore, reanalyzing *ds.PcapStore, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer reanalyzing.Delete(hash)
+	localFileName, cleanup, err := fetchCapture(ctx, hash, pi)
+	if err != nil {
+		fmt.Println(twoLines(err))
+		result.Merge(hash, pi) // Keep the old analysis rather than lose the capture
+		return
+	}
+	if ctx.Err() != nil {
+		result.Merge(hash, pi)
+		if crawlOpts.metadataOnly && cleanup != "" {
+			discard(cleanup)
+		}
+		return
+	}
+	original := pi
+	pi.Filename = localFileName
+	getPcapInfo(ctx, &pi, result)
+	if ctx.Err() != nil {
+		result.Merge(hash, original)
+	}
+	if crawlOpts.metadataOnly && cleanup != "" {
+		discard(cleanup)
+	}
+}
+
+// fetchCapture returns the path of a cached capture, downloading it again if it was discarded.
+// cleanup is what was downloaded or extracted to get it, or empty if the capture was already cached.
+func fetchCapture(ctx context.Context, hash string, pi ds.PcapInfo) (path string, cleanup string, err error) {
+	// Repaired captures are analyzed from the original so that the repair is made again
+	if pi.Repair != nil {
+		pi.Filename, hash = pi.Repair.Original, pi.Repair.OriginalSHA256
+	}
+	if _, statErr := os.Stat(pi.Filename); statErr == nil {
+		return pi.Filename, "", nil
+	}
+	for _, link := range pi.Sources {
+		fetched, fetchErr := dl.FetchFile(ctx, link)
+		if fetchErr != nil {
+			fmt.Println(twoLines(fetchErr))
+			continue
+		}
+		archiveFolder := dl.StripArchiveExt(fetched)
+		if archiveFolder == fetched {
+			if pcap.GetSHA256(fetched) == hash {
+				return fetched, fetched, nil
+			}
+			discard(fetched)
+			continue
+		}
+		var members []string
+		if _, statErr := os.Stat(archiveFolder); statErr == nil {
+			members, err = dl.WalkArchive(ctx, archiveFolder)
+		} else {
+			var manifest *ds.ArchiveManifest
+			members, manifest, err = dl.UnarchivePcaps(ctx, fetched, pi.Sources, passwords.forLinks(pi.Sources))
+			if manifest != nil && crawlOpts.metadataOnly {
+				discard(dl.StoredArchive(fetched, manifest))
+			}
+		}
+		for _, member := range members {
+			if pcap.GetSHA256(member) == hash {
+				return member, archiveFolder, nil
+			}
+		}
+		discard(archiveFolder)
+	}
+	return "", "", fmt.Errorf("\033[93mWARN\033[0m Could not download %s with hash %s from any of %s", pi.Filename, hash, pi.Sources)
+}
+
+// discard deletes a downloaded file or extracted folder and frees its disk quota
+func discard(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		fmt.Println("\033[93mWARN\033[0m Problem deleting", path, err)
+	}
+	dl.ReleaseQuota(path)
+}
+
+// parseSize converts sizes like 500MB or 20GB to bytes
+func parseSize(sizeStr string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(sizeStr))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(upper, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid size `%s`. Use a number with an optional unit like 500MB or 20GB", sizeStr)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// parseLimit is parseSize for limits that can be 0 for no limit
+func parseLimit(sizeStr string) (int64, error) {
+	if strings.TrimSpace(sizeStr) == "0" {
+		return 0, nil
+	}
+	return parseSize(sizeStr)
 }
 
 // Gets the first 1000 chars or two lines of error
@@ -279,7 +786,7 @@ func writeJSON(resultJSON map[string]ds.PcapInfo) {
 		os.Exit(1)
 	}
 	jsonPath := dir + "/.cache/captures.json"
-	err = ioutil.WriteFile(jsonPath, jsonBuf.Bytes(), 0644)
+	err = writeFileAtomic(jsonPath, jsonBuf.Bytes())
 	if err != nil {
 		fmt.Println("Error in writing JSON to file:", err)
 		fmt.Println("Filepath:", jsonPath)
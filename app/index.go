@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+const indexPath = ".cache/index.json"
+
+const queryUsage = `Usage: hubcap query [options] <endpoint>...
+
+Lists the captures that have every endpoint, with the most packets first
+or, with -sort quality, the cleanest first.
+Endpoints are IPs, MACs, ports and domains, like 8.8.8.8, 00:11:22:33:44:55,
+47808 or example.com. *.example.com matches every subdomain. Prefix one with
+ip:, mac:, port: or domain: to say which it is.
+
+Options:
+`
+
+// captureEndpoints has the endpoints of each capture analyzed in this run and of those in index.json
+var captureEndpoints = ds.NewEndpointStore()
+
+// readIndex reads an index.json written by writeIndex
+func readIndex(path string) (ds.Index, error) {
+	indexText, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := make(ds.Index)
+	if err := json.Unmarshal(indexText, &index); err != nil {
+		return nil, fmt.Errorf("Problem reading %s: %s", path, err)
+	}
+	return index, nil
+}
+
+// loadIndex adds the endpoints of captures that are in results from index.json to captureEndpoints
+func loadIndex(results map[string]ds.PcapInfo) {
+	index, err := readIndex(indexPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		fmt.Println("\033[93mWARN\033[0m", err, "so it will only have captures analyzed from now on")
+		return
+	}
+	for hash, endpoints := range index.Captures(func(hash string) bool { _, ok := results[hash]; return ok }) {
+		captureEndpoints.Merge(hash, endpoints)
+	}
+}
+
+// writeIndex writes the inverted index of the endpoints of captures in results to index.json
+func writeIndex(results map[string]ds.PcapInfo) {
+	endpoints := captureEndpoints.Snapshot()
+	for hash := range endpoints {
+		if _, ok := results[hash]; !ok {
+			delete(endpoints, hash)
+		}
+	}
+	indexBuf := new(bytes.Buffer)
+	enc := json.NewEncoder(indexBuf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ds.NewIndex(endpoints)); err != nil {
+		fmt.Println("Error in converting index to JSON:", err)
+		return
+	}
+	if err := writeFileAtomic(indexPath, indexBuf.Bytes()); err != nil {
+		fmt.Println("Error in writing index to file:", err)
+	}
+}
+
+// parseIndexTerm reads an endpoint like 8.8.8.8, port:53 or *.example.com
+func parseIndexTerm(arg string) (ds.IndexTerm, error) {
+	for _, kind := range []string{pcap.EndpointIP, pcap.EndpointMAC, pcap.EndpointDomain, pcap.EndpointPort} {
+		if strings.HasPrefix(arg, kind+":") {
+			return normalizeIndexTerm(ds.IndexTerm{Kind: kind, Value: strings.TrimPrefix(arg, kind+":")})
+		}
+	}
+	term := ds.IndexTerm{Kind: pcap.EndpointDomain, Value: arg}
+	if net.ParseIP(arg) != nil {
+		term.Kind = pcap.EndpointIP
+	} else if _, err := net.ParseMAC(arg); err == nil {
+		term.Kind = pcap.EndpointMAC
+	} else if arg != "" && strings.Trim(arg, "0123456789") == "" {
+		term.Kind = pcap.EndpointPort
+	}
+	return normalizeIndexTerm(term)
+}
+
+// normalizeIndexTerm writes an endpoint the way tshark does
+func normalizeIndexTerm(term ds.IndexTerm) (ds.IndexTerm, error) {
+	switch term.Kind {
+	case pcap.EndpointIP:
+		ip := net.ParseIP(term.Value)
+		if ip == nil {
+			return term, fmt.Errorf("`%s` isn't an IP address", term.Value)
+		}
+		term.Value = ip.String()
+	case pcap.EndpointMAC:
+		mac, err := net.ParseMAC(term.Value)
+		if err != nil {
+			return term, fmt.Errorf("`%s` isn't a MAC address", term.Value)
+		}
+		term.Value = mac.String()
+	case pcap.EndpointPort:
+		if term.Value == "" || strings.Trim(term.Value, "0123456789") != "" {
+			return term, fmt.Errorf("`%s` isn't a port", term.Value)
+		}
+		term.Value = strings.TrimLeft(term.Value, "0")
+		if term.Value == "" {
+			term.Value = "0"
+		}
+	case pcap.EndpointDomain:
+		term.Value = strings.ToLower(strings.TrimSuffix(term.Value, "."))
+		if term.Value == "" {
+			return term, fmt.Errorf("Empty domain")
+		}
+	}
+	return term, nil
+}
+
+// parseIndexTerms reads endpoints, leaving out repeats
+func parseIndexTerms(args []string) ([]ds.IndexTerm, error) {
+	terms := make([]ds.IndexTerm, 0, len(args))
+	seen := make(map[ds.IndexTerm]bool, len(args))
+	for _, arg := range args {
+		term, err := parseIndexTerm(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms, nil
+}
+
+// queryIndex returns the captures with every term, with their filenames from captures
+func queryIndex(index ds.Index, captures map[string]ds.PcapInfo, terms []ds.IndexTerm) []ds.IndexMatch {
+	matches := index.Query(terms)
+	for i := range matches {
+		matches[i].Filename = captures[matches[i].Hash].Filename
+	}
+	return matches
+}
+
+// queryCmd runs `hubcap query` and returns the exit code, which like grep's is 1 if nothing matched
+func queryCmd(args []string) int {
+	flags := flag.NewFlagSet("hubcap query", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Print(queryUsage)
+		flags.PrintDefaults()
+	}
+	asJSON := flags.Bool("json", false, "Print matches as JSON")
+	limit := flags.Int("n", 0, "Most captures to list (0 for all)")
+	sortBy := flags.String("sort", sortPackets, "List the captures with the most \"packets\" or the best \"quality\" first")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *sortBy != sortPackets && *sortBy != sortQuality {
+		fmt.Println("\033[91mERROR\033[0m -sort must be packets or quality, not", *sortBy)
+		return 2
+	}
+	terms, err := parseIndexTerms(flags.Args())
+	if err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 2
+	}
+	index, err := readIndex(indexPath)
+	if err == nil {
+		var captures map[string]ds.PcapInfo
+		if captures, err = readCaptures(".cache/captures.json"); err == nil {
+			matches := queryIndex(index, captures, terms)
+			if *sortBy == sortQuality {
+				sortByQuality(matches, captures, func(i int) string { return matches[i].Hash })
+			}
+			return printIndexMatches(matches, terms, *limit, *asJSON)
+		}
+	}
+	fmt.Println("\033[91mERROR\033[0m", err)
+	return 2
+}
+
+func printIndexMatches(matches []ds.IndexMatch, terms []ds.IndexTerm, limit int, asJSON bool) int {
+	total := len(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	if asJSON {
+		matchText, _ := json.MarshalIndent(matches, "", "  ")
+		fmt.Println(string(matchText))
+	} else {
+		for _, match := range matches {
+			counts := make([]string, 0, len(match.Counts))
+			for term, count := range match.Counts {
+				counts = append(counts, fmt.Sprintf("%s=%d", term, count))
+			}
+			sort.Strings(counts)
+			fmt.Printf("%s\t%d packets\t%s\n", match.Filename, match.Packets, strings.Join(counts, ","))
+		}
+	}
+	termNames := make([]string, len(terms))
+	for i, term := range terms {
+		termNames[i] = term.String()
+	}
+	fmt.Printf("\033[92mINFO\033[0m %d captures have %s\n", total, strings.Join(termNames, " and "))
+	if total == 0 {
+		return 1
+	}
+	return 0
+}
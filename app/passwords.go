@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pocc/hubcap/html"
+)
+
+const defaultPasswordsPath = "assets/passwords.json"
+
+// archivePasswords are tried on encrypted archives. A source's own passwords are tried before the global ones.
+type archivePasswords struct {
+	Global []string
+	// Sources is keyed by source name, like wireshark_bugs or packetlife
+	Sources map[string][]string
+}
+
+var passwords archivePasswords
+
+// loadPasswords reads the password lists. Only a missing default file is not an error.
+func loadPasswords(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && path == defaultPasswordsPath {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &passwords); err != nil {
+		return fmt.Errorf("Problem parsing password file %s: %s", path, err)
+	}
+	return nil
+}
+
+// forLinks returns the passwords to try for a download found at links, without duplicates
+func (p archivePasswords) forLinks(links []string) []string {
+	seen := make(map[string]bool)
+	candidates := make([]string, 0)
+	addAll := func(list []string) {
+		for _, password := range list {
+			if !seen[password] {
+				seen[password] = true
+				candidates = append(candidates, password)
+			}
+		}
+	}
+	for _, link := range links {
+		addAll(p.Sources[html.SourceName(link)])
+	}
+	addAll(p.Global)
+	return candidates
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sort"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+// Orders that query and search results can be sorted in
+const (
+	sortPackets   = "packets"   // Most packets with the endpoints first, which query does by default
+	sortRelevance = "relevance" // Best match first, which search does by default
+	sortQuality   = "quality"   // Cleanest capture first
+)
+
+// qualityScore returns a capture's quality score, or -1 if it was analyzed before captures were scored
+func qualityScore(pi ds.PcapInfo) float64 {
+	if pi.Quality == nil {
+		return -1
+	}
+	return pi.Quality.Score
+}
+
+// sortByQuality stably sorts the slice results by the quality of captures, cleanest first,
+// where hash returns the SHA256 of the capture of results[i]
+func sortByQuality(results interface{}, captures map[string]ds.PcapInfo, hash func(i int) string) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return qualityScore(captures[hash(i)]) > qualityScore(captures[hash(j)])
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+const serveUsage = `Usage: hubcap serve [options]
+
+Answers questions about the captures in .cache/ over HTTP, as JSON:
+
+  GET /query?q=<endpoint>[&q=...][&n=<limit>][&sort=packets|quality]
+      Captures with every endpoint, like hubcap query
+  GET /search?q=<query>[&n=<limit>][&sort=relevance|quality]
+      Captures whose descriptions, source page titles, pcapng comments,
+      filenames or protocols match, best first, with snippets of where. Terms
+      can name a field (desc, title, comment, file, proto, source or tag),
+      quotes make a phrase and a leading - leaves captures out, like:
+      proto:sip desc:"call transfer" -rtp
+      sort=quality lists the cleanest captures first
+  GET /captures/<sha256>
+      What captures.json has about a capture
+
+captures.json and index.json are read again when a crawl writes them.
+
+Options:
+`
+
+// serveData is what the server answers from
+type serveData struct {
+	mutex    sync.Mutex
+	captures map[string]ds.PcapInfo
+	index    ds.Index
+	text     *ds.TextIndex
+	modTimes [2]time.Time // Of captures.json and index.json when they were read
+}
+
+// queryResponse is the answer to /query
+type queryResponse struct {
+	Terms   []string
+	Total   int // Captures that matched, which can be more than Matches has
+	Matches []ds.IndexMatch
+}
+
+// searchResponse is the answer to /search
+type searchResponse struct {
+	Query   string
+	Total   int
+	Results []ds.SearchResult
+}
+
+// refresh reads captures.json and index.json again if a crawl wrote them since they were read
+func (d *serveData) refresh() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var modTimes [2]time.Time
+	for i, path := range []string{".cache/captures.json", indexPath} {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	if d.captures != nil && modTimes == d.modTimes {
+		return nil
+	}
+	captures, err := readCaptures(".cache/captures.json")
+	if err != nil {
+		return err
+	}
+	index, err := readIndex(indexPath)
+	if os.IsNotExist(err) {
+		fmt.Println("\033[93mWARN\033[0m There's no", indexPath, "yet, so no endpoints will be found")
+		index, err = make(ds.Index), nil
+	}
+	if err != nil {
+		return err
+	}
+	d.captures, d.index, d.text, d.modTimes = captures, index, ds.NewTextIndex(captures), modTimes
+	return nil
+}
+
+// get returns the current captures and indexes, which callers must not change.
+// If they can't be read again, what was read before is still served.
+func (d *serveData) get() (map[string]ds.PcapInfo, ds.Index, *ds.TextIndex) {
+	if err := d.refresh(); err != nil {
+		fmt.Println("\033[93mWARN\033[0m", err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.captures, d.index, d.text
+}
+
+// serveCmd runs `hubcap serve` until it's interrupted and returns the exit code
+func serveCmd(args []string) int {
+	flags := flag.NewFlagSet("hubcap serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Print(serveUsage)
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", "localhost:8080", "Address to listen on")
+	flags.Parse(args)
+	data := &serveData{}
+	if err := data.refresh(); err != nil {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 2
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", data.handleQuery)
+	mux.HandleFunc("/search", data.handleSearch)
+	mux.HandleFunc("/captures/", data.handleCapture)
+	server := &http.Server{Addr: *addr, Handler: mux}
+	ctx := cancelOnSignal()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	fmt.Printf("\033[92mINFO\033[0m Serving %d captures on http://%s\n", len(data.captures), *addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Println("\033[91mERROR\033[0m", err)
+		return 1
+	}
+	return 0
+}
+
+func (d *serveData) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "Only GET is allowed")
+		return
+	}
+	params := r.URL.Query()
+	if len(params["q"]) == 0 {
+		writeHTTPError(w, http.StatusBadRequest, "Give endpoints to look for with q, like /query?q=8.8.8.8&q=port:53")
+		return
+	}
+	terms, err := parseIndexTerms(params["q"])
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, ok := parseLimitParam(w, params)
+	if !ok {
+		return
+	}
+	sortBy, ok := parseSortParam(w, params, sortPackets)
+	if !ok {
+		return
+	}
+	captures, index, _ := d.get()
+	response := queryResponse{Terms: make([]string, len(terms)), Matches: queryIndex(index, captures, terms)}
+	if sortBy == sortQuality {
+		sortByQuality(response.Matches, captures, func(i int) string { return response.Matches[i].Hash })
+	}
+	for i, term := range terms {
+		response.Terms[i] = term.String()
+	}
+	response.Total = len(response.Matches)
+	if limit > 0 && len(response.Matches) > limit {
+		response.Matches = response.Matches[:limit]
+	}
+	writeHTTPJSON(w, http.StatusOK, response)
+}
+
+func (d *serveData) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "Only GET is allowed")
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, "/captures/")
+	captures, _, _ := d.get()
+	pi, ok := captures[hash]
+	if !ok || strings.HasPrefix(hash, "->") {
+		writeHTTPError(w, http.StatusNotFound, "No capture has the SHA256 "+hash)
+		return
+	}
+	writeHTTPJSON(w, http.StatusOK, pi)
+}
+
+func (d *serveData) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "Only GET is allowed")
+		return
+	}
+	params := r.URL.Query()
+	limit, ok := parseLimitParam(w, params)
+	if !ok {
+		return
+	}
+	sortBy, ok := parseSortParam(w, params, sortRelevance)
+	if !ok {
+		return
+	}
+	captures, _, text := d.get()
+	results, err := text.Search(params.Get("q"))
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sortBy == sortQuality {
+		sortByQuality(results, captures, func(i int) string { return results[i].Hash })
+	}
+	response := searchResponse{Query: params.Get("q"), Total: len(results), Results: results}
+	if limit > 0 && len(results) > limit {
+		response.Results = results[:limit]
+	}
+	writeHTTPJSON(w, http.StatusOK, response)
+}
+
+// parseLimitParam reads the n parameter, answering with an error if it isn't a number
+func parseLimitParam(w http.ResponseWriter, params url.Values) (int, bool) {
+	n := params.Get("n")
+	if n == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(n)
+	if err != nil || limit < 0 {
+		writeHTTPError(w, http.StatusBadRequest, "n has to be a number of captures")
+		return 0, false
+	}
+	return limit, true
+}
+
+// parseSortParam reads the sort parameter, which is defaultSort or quality
+func parseSortParam(w http.ResponseWriter, params url.Values, defaultSort string) (string, bool) {
+	sortBy := params.Get("sort")
+	switch sortBy {
+	case "":
+		return defaultSort, true
+	case defaultSort, sortQuality:
+		return sortBy, true
+	}
+	writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("sort has to be %s or %s", defaultSort, sortQuality))
+	return "", false
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	writeHTTPJSON(w, status, map[string]string{"Error": message})
+}
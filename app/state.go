@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+const crawlStatePath = ".cache/crawl_state.json"
+
+// crawlState lets an interrupted crawl resume where it left off
+type crawlState struct {
+	// Cursors is where each source should resume scanning, like the next bugzilla attachment ID
+	Cursors map[string]int
+	// Pending are links that were found but not analyzed yet, mapped to their descriptions
+	Pending     map[string]string
+	LastUpdated time.Time
+}
+
+// linkSet is a concurrent safe set of links
+type linkSet struct {
+	sync.Mutex
+	links map[string]bool
+}
+
+func (ls *linkSet) add(link string) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.links[link] = true
+}
+
+func (ls *linkSet) has(link string) bool {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.links[link]
+}
+
+// loadCrawlState reads the crawl state of the previous run, if there is one
+func loadCrawlState() *crawlState {
+	state := &crawlState{Cursors: make(map[string]int), Pending: make(map[string]string)}
+	stateText, err := ioutil.ReadFile(crawlStatePath)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err == nil {
+		err = json.Unmarshal(stateText, state)
+	}
+	if err != nil {
+		fmt.Println("\033[93mWARN\033[0m Ignoring unreadable", crawlStatePath, err)
+		return &crawlState{Cursors: make(map[string]int), Pending: make(map[string]string)}
+	}
+	if state.Cursors == nil {
+		state.Cursors = make(map[string]int)
+	}
+	if state.Pending == nil {
+		state.Pending = make(map[string]string)
+	}
+	fmt.Printf("\033[92mINFO\033[0m Resuming crawl from %s with %d pending links\n", crawlStatePath, len(state.Pending))
+	return state
+}
+
+// save writes crawl state, noting which of links have not been analyzed yet
+func (state *crawlState) save(links map[string]string, completed *linkSet) {
+	state.Pending = make(map[string]string)
+	for link, desc := range links {
+		if !completed.has(link) {
+			state.Pending[link] = desc
+		}
+	}
+	state.LastUpdated = time.Now()
+	stateText, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		fmt.Println("Error in converting crawl state to JSON:", err)
+		return
+	}
+	if err = writeFileAtomic(crawlStatePath, stateText); err != nil {
+		fmt.Println("Error in writing crawl state:", err)
+	}
+}
+
+// cancelOnSignal cancels the returned context on SIGINT/SIGTERM so that finished work can still be written.
+// A second signal exits immediately.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("\n\033[93mWARN\033[0m Received %s. Stopping in-flight work and saving results (repeat to quit now)...\n", sig)
+		cancel()
+		<-signals
+		fmt.Println("\033[91mERROR\033[0m Quitting without saving")
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// checkpoint periodically writes results and crawl state until ctx is done. Captures that are
+// still in reanalyzing are written with their old analysis so that a checkpoint never drops them.
+func checkpoint(ctx context.Context, interval time.Duration, result *ds.PcapStore, reanalyzing *ds.PcapStore, state *crawlState,
+	links map[string]string, completed *linkSet) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			snapshot := result.Snapshot()
+			for hash, pi := range reanalyzing.Snapshot() {
+				if _, ok := snapshot[hash]; !ok {
+					snapshot[hash] = pi
+				}
+			}
+			tagCaptures(snapshot)
+			fmt.Printf("\033[92mINFO\033[0m Checkpointing %d files to .cache/captures.json\n", len(snapshot))
+			writeJSON(snapshot)
+			writeIndex(snapshot)
+			state.save(links, completed)
+		}
+	}
+}
+
+// writeFileAtomic replaces a file so that readers and interrupted writes never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+const defaultTagsPath = "assets/tags.json"
+
+var tagRules ds.TagRules
+
+// loadTagRules reads the rules that tag captures by topic. Only a missing default file is not an error.
+func loadTagRules(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && path == defaultTagsPath {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rules ds.TagRules
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("Problem parsing tag rules %s: %s", path, err)
+	}
+	for i, rule := range rules.Rules {
+		if rule.Tag == "" {
+			return fmt.Errorf("Rule %d of %s has no Tag", i+1, path)
+		}
+		if len(rule.Protocols)+len(rule.Encapsulations)+len(rule.Keywords) == 0 {
+			return fmt.Errorf("Rule for %s in %s has nothing to match", rule.Tag, path)
+		}
+	}
+	tagRules = rules
+	return nil
+}
+
+// tagCaptures tags every capture in results with the current rules, so that edited rules apply to cached captures too
+func tagCaptures(results map[string]ds.PcapInfo) {
+	for hash, pi := range results {
+		if hash[0] != '-' {
+			pi.Tags = tagRules.Tag(pi)
+			results[hash] = pi
+		}
+	}
+}
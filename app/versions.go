@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+const runInfoPath = ".cache/run.json"
+
+// runInfo records what the latest crawl analyzed captures with
+type runInfo struct {
+	Started  time.Time
+	Args     []string
+	Tools    pcap.Tools
+	Versions pcap.ToolVersions
+}
+
+// writeRunInfo saves the tools and versions of this crawl to .cache/run.json
+func writeRunInfo(versions pcap.ToolVersions) {
+	info := runInfo{Started: time.Now(), Args: os.Args[1:], Tools: pcap.CurrentTools(), Versions: versions}
+	infoText, err := json.MarshalIndent(info, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(runInfoPath, infoText, 0644)
+	}
+	if err != nil {
+		fmt.Println("\033[93mWARN\033[0m Problem writing", runInfoPath, err)
+	}
+}
+
+// checkToolVersions returns an error if captures in index were analyzed by a different major version of tshark.
+// Captures from before versions were recorded are assumed to be compatible.
+func checkToolVersions(index map[string]ds.PcapInfo, versions pcap.ToolVersions) error {
+	major := pcap.MajorVersion(versions.Tshark)
+	mixed := make(map[string]int)
+	count := 0
+	for hash, pi := range index {
+		if hash[0] == '-' || pi.TsharkVersion == "" || pcap.MajorVersion(pi.TsharkVersion) == major {
+			continue
+		}
+		mixed[pi.TsharkVersion]++
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	others := make([]string, 0, len(mixed))
+	for version := range mixed {
+		others = append(others, version)
+	}
+	sort.Strings(others)
+	return fmt.Errorf("%d captures in .cache/captures.json were analyzed with tshark %s, but this is tshark %s. "+
+		"Use -reanalyze to analyze them again or -allow-mixed-versions to add to them anyway",
+		count, strings.Join(others, ", "), versions.Tshark)
+}
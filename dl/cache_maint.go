@@ -0,0 +1,227 @@
+package dl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+// CacheFile is a file in .cache/ that verification flagged
+type CacheFile struct {
+	Hash     string // Index key, empty for orphans
+	Filename string // Path relative to the project root
+	Size     int64
+	Actual   string // SHA256 found on disk, only set for corrupt files
+}
+
+// CacheReport is the result of checking .cache/ against captures.json
+type CacheReport struct {
+	Checked   int
+	Discarded int // Entries analyzed in metadata-only mode have no file to check
+	Missing   []CacheFile
+	Corrupt   []CacheFile
+	Orphaned  []CacheFile
+}
+
+// hubcap's own bookkeeping files are never orphans
+var cacheMetaFiles = map[string]bool{
+	"captures.json":        true,
+	"crawl_state.json":     true,
+	"crawl_state.json.tmp": true,
+	"captures.json.tmp":    true,
+	"run.json":             true,
+	"index.json":           true,
+	"index.json.tmp":       true,
+}
+
+// Folders of .cache/ that hubcap keeps its own results in, like grep results
+var cacheMetaDirs = map[string]bool{
+	"grep": true,
+}
+
+// isIndexKey returns whether the key of captures.json is a file hash and not an error bucket
+func isIndexKey(hash string) bool {
+	return hash != "" && hash[0] != '-'
+}
+
+// VerifyCache re-hashes every file referenced by index and reports missing, corrupt and orphaned files.
+// root is the folder that contains .cache/ because index filenames are relative to it.
+func VerifyCache(root string, index map[string]ds.PcapInfo) (*CacheReport, error) {
+	report := &CacheReport{}
+	referenced := make(map[string]bool)
+	for hash, pi := range index {
+		if !isIndexKey(hash) || pi.Filename == "" {
+			continue
+		}
+		if pi.Discarded {
+			report.Discarded++
+			continue
+		}
+		report.Checked++
+		fullPath := filepath.Join(root, pi.Filename)
+		referenced[fullPath] = true
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			report.Missing = append(report.Missing, CacheFile{Hash: hash, Filename: pi.Filename})
+			continue
+		}
+		actual := pcap.GetSHA256(fullPath)
+		if actual != hash {
+			report.Corrupt = append(report.Corrupt, CacheFile{hash, pi.Filename, info.Size(), actual})
+		}
+	}
+	stored, err := referenceArchives(root, index, referenced)
+	if err != nil {
+		return report, err
+	}
+	// Stored archives are named by their hash, so they can be verified like captures
+	for hash, fullPath := range stored {
+		report.Checked++
+		if actual := pcap.GetSHA256(fullPath); actual != hash {
+			relPath, _ := filepath.Rel(root, fullPath)
+			report.Corrupt = append(report.Corrupt, CacheFile{hash, relPath, fileSize(fullPath), actual})
+		}
+	}
+	orphans, err := findOrphans(root, referenced)
+	if err != nil {
+		return report, err
+	}
+	report.Orphaned = orphans
+	sortCacheFiles(report.Missing)
+	sortCacheFiles(report.Corrupt)
+	return report, nil
+}
+
+// CollectGarbage removes every file in .cache/ that no index entry references and returns the bytes reclaimed.
+// With dryRun, nothing is deleted but the same report is returned.
+func CollectGarbage(root string, index map[string]ds.PcapInfo, dryRun bool) ([]CacheFile, int64, error) {
+	referenced := make(map[string]bool)
+	for hash, pi := range index {
+		if isIndexKey(hash) && pi.Filename != "" && !pi.Discarded {
+			referenced[filepath.Join(root, pi.Filename)] = true
+		}
+	}
+	if _, err := referenceArchives(root, index, referenced); err != nil {
+		return nil, 0, err
+	}
+	orphans, err := findOrphans(root, referenced)
+	if err != nil {
+		return nil, 0, err
+	}
+	var reclaimed int64
+	for _, orphan := range orphans {
+		if !dryRun {
+			if delErr := os.Remove(filepath.Join(root, orphan.Filename)); delErr != nil {
+				return orphans, reclaimed, fmt.Errorf("\033[91mERROR\033[0m Problem deleting orphan %s: %s", orphan.Filename, delErr)
+			}
+		}
+		reclaimed += orphan.Size
+	}
+	if !dryRun {
+		pruneEmptyDirs(filepath.Join(root, ".cache"))
+	}
+	return orphans, reclaimed, nil
+}
+
+// referenceArchives marks the stored archives and manifests of links in index, the files that shipped
+// with indexed captures, both copies of repaired captures and their stored secrets as referenced. It returns the stored archives that exist by hash.
+func referenceArchives(root string, index map[string]ds.PcapInfo, referenced map[string]bool) (map[string]string, error) {
+	links := make(map[string]bool)
+	for hash, pi := range index {
+		for _, link := range pi.Sources {
+			links[link] = true
+		}
+		if isIndexKey(hash) && !pi.Discarded {
+			for _, sibling := range pi.Siblings {
+				referenced[filepath.Join(root, sibling.Filename)] = true
+			}
+			if pi.Repair != nil {
+				referenced[filepath.Join(root, pi.Repair.Original)] = true
+				referenced[filepath.Join(root, pi.Repair.Repaired)] = true
+			}
+		}
+		// Secrets are kept for discarded captures too so that a reanalysis can decrypt them
+		for _, secret := range pi.Secrets {
+			referenced[filepath.Join(root, secret.Filename)] = true
+		}
+	}
+	manifests, err := ReadManifests(root)
+	if err != nil {
+		return nil, fmt.Errorf("\033[91mERROR\033[0m %s", err)
+	}
+	stored := make(map[string]string)
+	storeDir := filepath.Join(root, ".cache", archiveStoreDir)
+	for _, manifest := range manifests {
+		isLinked := false
+		for _, link := range manifest.Sources {
+			isLinked = isLinked || links[link]
+		}
+		if !isLinked {
+			continue
+		}
+		referenced[filepath.Join(storeDir, manifest.SHA256+".json")] = true
+		// Archives of metadata-only crawls were discarded, so only the manifest is left
+		archivePath := filepath.Join(storeDir, manifest.SHA256+archiveExt(manifest.Filename))
+		if _, statErr := os.Stat(archivePath); statErr == nil {
+			referenced[archivePath] = true
+			stored[manifest.SHA256] = archivePath
+		}
+	}
+	return stored, nil
+}
+
+// findOrphans walks .cache/ for regular files not in referenced
+func findOrphans(root string, referenced map[string]bool) ([]CacheFile, error) {
+	orphans := make([]CacheFile, 0)
+	cacheDir := filepath.Join(root, ".cache")
+	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filepath.Dir(path) == cacheDir && cacheMetaDirs[info.Name()] {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || referenced[path] {
+			return nil
+		}
+		if filepath.Dir(path) == cacheDir && cacheMetaFiles[info.Name()] {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		orphans = append(orphans, CacheFile{Filename: relPath, Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return orphans, fmt.Errorf("\033[91mERROR\033[0m Problem walking %s: %s", cacheDir, err)
+	}
+	sortCacheFiles(orphans)
+	return orphans, nil
+}
+
+// pruneEmptyDirs removes folders left empty by gc, like extracted archives, but keeps per-source folders
+func pruneEmptyDirs(cacheDir string) {
+	dirs := make([]string, 0)
+	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && filepath.Dir(path) != cacheDir && path != cacheDir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Deepest folders first so that parents can become empty
+	sort.Slice(dirs, func(i, j int) bool { return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/") })
+	for _, dir := range dirs {
+		os.Remove(dir) // Fails harmlessly if the folder isn't empty
+	}
+}
+
+func sortCacheFiles(files []CacheFile) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+}
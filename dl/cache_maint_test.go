@@ -0,0 +1,108 @@
+package dl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+// sha256 of "abc"
+var abcHash = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+func makeTestCache(t *testing.T) (string, map[string]ds.PcapInfo) {
+	root, err := ioutil.TempDir("", "hubcap")
+	if err != nil {
+		t.Fatal("Cannot create temp dir:", err)
+	}
+	files := map[string]string{
+		".cache/captures.json":            "{}",
+		".cache/packetlife/good.pcap":     "abc",
+		".cache/packetlife/bad.pcap":      "abd",
+		".cache/wireshark_bugs/x/orphan":  "orphaned bytes",
+		".cache/wireshark_wiki/notes.txt": "hi",
+		".cache/grep/results.json":        "{}",
+	}
+	for name, contents := range files {
+		fullPath := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(fullPath), 0744)
+		if err := ioutil.WriteFile(fullPath, []byte(contents), 0644); err != nil {
+			t.Fatal("Cannot write test file:", err)
+		}
+	}
+	index := map[string]ds.PcapInfo{
+		abcHash:                     {Filename: ".cache/packetlife/good.pcap"},
+		"badhash":                   {Filename: ".cache/packetlife/bad.pcap"},
+		"gonehash":                  {Filename: ".cache/packetlife/gone.pcap"},
+		"->Error:CaptypeUnknown":    {Sources: []string{"http://example.com/a"}},
+		"->Error:InvalidAttachment": {},
+	}
+	return root, index
+}
+
+func TestVerifyCache(t *testing.T) {
+	root, index := makeTestCache(t)
+	defer os.RemoveAll(root)
+	report, err := VerifyCache(root, index)
+	if err != nil {
+		t.Fatal("VerifyCache() error =", err)
+	}
+	tests := []struct {
+		name  string
+		files []CacheFile
+		want  []string
+	}{
+		{"Missing", report.Missing, []string{".cache/packetlife/gone.pcap"}},
+		{"Corrupt", report.Corrupt, []string{".cache/packetlife/bad.pcap"}},
+		{"Orphaned", report.Orphaned, []string{".cache/wireshark_bugs/x/orphan", ".cache/wireshark_wiki/notes.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.files) != len(tt.want) {
+				t.Fatalf("VerifyCache() %s = %v, want %v", tt.name, tt.files, tt.want)
+			}
+			for i, f := range tt.files {
+				if f.Filename != tt.want[i] {
+					t.Errorf("VerifyCache() %s = %v, want %v", tt.name, f.Filename, tt.want[i])
+				}
+			}
+		})
+	}
+	if report.Checked != 3 {
+		t.Errorf("VerifyCache() checked %d files, want 3", report.Checked)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	root, index := makeTestCache(t)
+	defer os.RemoveAll(root)
+	tests := []struct {
+		name          string
+		dryRun        bool
+		wantReclaimed int64
+		wantExists    bool
+	}{
+		{"Dry run keeps files", true, 16, true},
+		{"GC deletes orphans", false, 16, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, reclaimed, err := CollectGarbage(root, index, tt.dryRun)
+			if err != nil {
+				t.Fatal("CollectGarbage() error =", err)
+			}
+			if reclaimed != tt.wantReclaimed {
+				t.Errorf("CollectGarbage() reclaimed = %d, want %d", reclaimed, tt.wantReclaimed)
+			}
+			_, statErr := os.Stat(filepath.Join(root, ".cache/wireshark_bugs/x"))
+			if exists := statErr == nil; exists != tt.wantExists {
+				t.Errorf("CollectGarbage() orphan folder exists = %v, want %v", exists, tt.wantExists)
+			}
+			if _, err := os.Stat(filepath.Join(root, ".cache/packetlife/good.pcap")); err != nil {
+				t.Error("CollectGarbage() deleted a referenced file")
+			}
+		})
+	}
+}
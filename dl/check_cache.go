@@ -2,6 +2,7 @@
 package dl
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,24 +12,35 @@ import (
 )
 
 // FetchFile will get the filename from cache or download it.
-func FetchFile(urlStr string) (string, error) {
+func FetchFile(ctx context.Context, urlStr string) (string, error) {
 	fPath, err := getFilepathFromURL(urlStr)
 	if err != nil {
 		return "", fmt.Errorf("Invalid url %s passed in", urlStr)
 	}
-	// Using a blacklist because users are sloppy with how they name valid pcaps
-	notPcapRe := regexp.MustCompile(`\.(?:c|diff|doc|ext|gif|log|jpg|jpeg|json|mib|mp3|p10|patch|pdf|png|pppd|pem|pfx|trc|xls|xlsx|xml)$`)
-	if notPcapRe.FindString(fPath) != "" {
-		return fPath, fmt.Errorf("\033[92mINFO\033[0m Skipping download of non-pcap file %s from %s", fPath, urlStr)
-	}
 	// If file path does not exist
 	_, fileErr := os.Stat(fPath)
 	if os.IsNotExist(fileErr) {
+		// Going by content because users are sloppy with how they name valid pcaps
+		head, sniffErr := sniffURL(ctx, urlStr)
+		if ctx.Err() != nil {
+			return fPath, ctx.Err()
+		}
+		if sniffErr == nil {
+			if format := Sniff(head, fPath); !isWorthDownloading(format) {
+				return fPath, fmt.Errorf("\033[92mINFO\033[0m Skipping download of non-pcap file %s (%s) from %s", fPath, format, urlStr)
+			}
+		}
 		fmt.Println("\033[92mINFO\033[0m", fPath, "not found in cache. Downloading", urlStr)
-		fetchErr := downloadFile(urlStr, fPath, 0)
+		fetchErr := downloadFile(ctx, urlStr, fPath, 0)
 		if fetchErr != nil {
 			return fPath, fetchErr
 		}
+		// Check again in case the range request failed or the server sent something else the second time
+		if format := SniffFile(fPath); !isWorthDownloading(format) {
+			os.Remove(fPath)
+			diskQuota.Release(fPath)
+			return fPath, fmt.Errorf("\033[92mINFO\033[0m Deleted downloaded non-pcap file %s (%s) from %s", fPath, format, urlStr)
+		}
 	}
 	return fPath, nil
 }
@@ -2,6 +2,7 @@
 package dl
 
 import (
+	"context"
 	"os"
 	"testing"
 )
@@ -29,7 +30,7 @@ func TestFetchFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := FetchFile(tt.args.url)
+			got, err := FetchFile(context.Background(), tt.args.url)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("FetchFile() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -2,6 +2,7 @@
 package dl
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -11,13 +12,21 @@ import (
 	"time"
 )
 
-func downloadFile(url string, filepath string, retryMillisec int) error {
+func downloadFile(ctx context.Context, url string, filepath string, retryMillisec int) error {
 	// Create the file
-	time.Sleep(time.Duration(retryMillisec) * time.Millisecond)
+	select {
+	case <-time.After(time.Duration(retryMillisec) * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	var contextStr string
 
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -38,20 +47,35 @@ func downloadFile(url string, filepath string, retryMillisec int) error {
 			time.Sleep(time.Duration(retryMillisec) * time.Millisecond)
 			fmt.Println("\033[93mWARN\033[0m Download from", url, "failed with code", resp.StatusCode,
 				"\nRetrying after", retryMillisec, "milliseconds...")
-			return downloadFile(url, filepath, retryMillisec)
+			return downloadFile(ctx, url, filepath, retryMillisec)
 		}
 		contextStr = "Backoff timer is at " + strconv.Itoa(retryMillisec) + " milliseconds and will not retry."
 	case 200:
+		// Files of known size wait for room under the disk quota, others are charged as they are written
+		var dst io.Writer
+		if resp.ContentLength >= 0 {
+			if err := diskQuota.Reserve(filepath, resp.ContentLength); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
 		// Write the body to file
 		fmt.Println("\033[92mINFO\033[0m Saving to", filepath)
 		out, err := os.Create(filepath)
 		if err != nil {
+			diskQuota.Release(filepath)
 			return err
 		}
 		defer out.Close()
+		dst = out
+		if resp.ContentLength < 0 {
+			dst = &quotaWriter{out, filepath}
+		}
 
-		_, err = io.Copy(out, resp.Body)
+		_, err = io.Copy(dst, resp.Body)
 		if err != nil {
+			os.Remove(filepath)
+			diskQuota.Release(filepath)
 			return err
 		}
 		resp.Body.Close()
@@ -64,3 +88,16 @@ func downloadFile(url string, filepath string, retryMillisec int) error {
 		"Download of %s failed with code %d: %s. Skipping...",
 		url, resp.StatusCode, contextStr)
 }
+
+// quotaWriter charges bytes against the disk quota as they are written for downloads of unknown size
+type quotaWriter struct {
+	w    io.Writer
+	path string
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if !diskQuota.TryReserve(qw.path, int64(len(p))) {
+		return 0, fmt.Errorf("\033[93mWARN\033[0m Download to %s stopped because it would exceed the disk quota", qw.path)
+	}
+	return qw.w.Write(p)
+}
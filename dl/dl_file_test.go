@@ -2,6 +2,7 @@
 package dl
 
 import (
+	"context"
 	"os"
 	"testing"
 )
@@ -28,7 +29,7 @@ func Test_downloadFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := downloadFile(tt.args.url, tt.args.filepath, tt.args.retrySec); (err != nil) != tt.wantErr {
+			if err := downloadFile(context.Background(), tt.args.url, tt.args.filepath, tt.args.retrySec); (err != nil) != tt.wantErr {
 				t.Errorf("downloadFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -0,0 +1,207 @@
+package dl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+// Downloaded archives are kept in .cache/archives as <sha256><ext> next to their <sha256>.json manifest
+const archiveStoreDir = "archives"
+
+// archiveStorePath returns the folder that archives under archived's .cache/ are kept in,
+// or an empty string if archived isn't in a cache
+func archiveStorePath(archived string) string {
+	sep := string(os.PathSeparator) + ".cache" + string(os.PathSeparator)
+	parts := strings.SplitN(archived, sep, 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return filepath.Join(parts[0], ".cache", archiveStoreDir)
+}
+
+// cacheRelPath returns fPath relative to the project root, like .cache/packetlife/a.pcap
+func cacheRelPath(fPath string) string {
+	sep := string(os.PathSeparator) + ".cache" + string(os.PathSeparator)
+	parts := strings.SplitN(fPath, sep, 2)
+	if len(parts) != 2 {
+		return fPath
+	}
+	return filepath.Join(".cache", parts[1])
+}
+
+// archiveExt returns the whole archive extension, like .tar.gz, so the stored archive can be opened again
+func archiveExt(archived string) string {
+	return strings.TrimPrefix(filepath.Base(archived), filepath.Base(StripArchiveExt(archived)))
+}
+
+// record keeps the download in the archive store and writes a manifest of everything extracted to folder
+func (ex *extraction) record(archived string, folder string, sources []string, pcaps []string) (*ds.ArchiveManifest, error) {
+	isPcap := make(map[string]bool, len(pcaps))
+	for _, p := range pcaps {
+		isPcap[p] = true
+	}
+	manifest := &ds.ArchiveManifest{
+		SHA256:   pcap.GetSHA256(archived),
+		Filename: filepath.Base(archived),
+		Size:     fileSize(archived),
+		Sources:  append([]string(nil), sources...),
+		Members:  append([]ds.ArchiveMember(nil), ex.nested...),
+	}
+	filepath.Walk(folder, func(fPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		manifest.Members = append(manifest.Members, ds.ArchiveMember{
+			Path:     ArchiveChain(archived, fPath),
+			Filename: cacheRelPath(fPath),
+			SHA256:   pcap.GetSHA256(fPath),
+			Size:     info.Size(),
+			Type:     memberType(fPath, isPcap[fPath]),
+			Password: ex.passwordFor(fPath),
+		})
+		return nil
+	})
+	sort.Slice(manifest.Members, func(i, j int) bool { return manifest.Members[i].Path < manifest.Members[j].Path })
+	store := archiveStorePath(archived)
+	if store == "" {
+		return manifest, nil
+	}
+	if err := os.MkdirAll(store, 0744); err != nil {
+		return manifest, err
+	}
+	stored := filepath.Join(store, manifest.SHA256+archiveExt(archived))
+	if err := os.Rename(archived, stored); err != nil {
+		return manifest, fmt.Errorf("\033[91mERROR\033[0m Problem moving archive %s to %s: %s", archived, stored, err)
+	}
+	diskQuota.Release(archived)
+	diskQuota.Track(stored, manifest.Size)
+	return manifest, writeManifest(store, manifest)
+}
+
+// writeManifest saves manifest, keeping the sources of any earlier download of the same archive
+func writeManifest(store string, manifest *ds.ArchiveManifest) error {
+	manifestPath := filepath.Join(store, manifest.SHA256+".json")
+	if data, err := ioutil.ReadFile(manifestPath); err == nil {
+		var earlier ds.ArchiveManifest
+		if json.Unmarshal(data, &earlier) == nil {
+			manifest.Sources = append(manifest.Sources, earlier.Sources...)
+		}
+	}
+	sort.Strings(manifest.Sources)
+	sources := manifest.Sources[:0]
+	for i, source := range manifest.Sources {
+		if i == 0 || source != manifest.Sources[i-1] {
+			sources = append(sources, source)
+		}
+	}
+	manifest.Sources = sources
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, data, 0644)
+}
+
+// StoredArchive returns where the archive that was downloaded to download is kept
+func StoredArchive(download string, manifest *ds.ArchiveManifest) string {
+	return filepath.Join(archiveStorePath(download), manifest.SHA256+archiveExt(manifest.Filename))
+}
+
+// ReadManifests returns every archive manifest in root's .cache/
+func ReadManifests(root string) ([]*ds.ArchiveManifest, error) {
+	paths, err := filepath.Glob(filepath.Join(root, ".cache", archiveStoreDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]*ds.ArchiveManifest, 0, len(paths))
+	for _, manifestPath := range paths {
+		data, readErr := ioutil.ReadFile(manifestPath)
+		if readErr != nil {
+			return manifests, readErr
+		}
+		manifest := &ds.ArchiveManifest{}
+		if jsonErr := json.Unmarshal(data, manifest); jsonErr != nil {
+			return manifests, fmt.Errorf("Problem parsing manifest %s: %s", manifestPath, jsonErr)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// Lines that start TLS keylog files (NSS key log format) and premaster secret files
+var keylogPrefixes = []string{
+	"CLIENT_RANDOM ", "CLIENT_HANDSHAKE_TRAFFIC_SECRET ", "SERVER_HANDSHAKE_TRAFFIC_SECRET ",
+	"CLIENT_TRAFFIC_SECRET_0 ", "SERVER_TRAFFIC_SECRET_0 ", "EXPORTER_SECRET ", "CLIENT_EARLY_TRAFFIC_SECRET ",
+	"RSA Session-ID:", "PMS_CLIENT_RANDOM ",
+}
+
+// espSARe matches a record of Wireshark's esp_sa file, which starts with the quoted IP version
+var espSARe = regexp.MustCompile(`^"(?:IPv4|IPv6|Any IPv4|Any IPv6|\*)","`)
+
+// pemKeyRe matches the start of a PEM private key that tshark can use to decrypt RSA key exchanges
+var pemKeyRe = regexp.MustCompile(`^-----BEGIN (?:RSA )?PRIVATE KEY-----`)
+
+// rsaPremasterRe matches the `RSA <first 8 bytes of encrypted premaster> <premaster>` keylog line
+var rsaPremasterRe = regexp.MustCompile(`^RSA [0-9a-fA-F]{16} [0-9a-fA-F]{96}`)
+
+var textExts = map[string]bool{".txt": true, ".md": true, ".rst": true, ".log": true, ".cfg": true, ".conf": true, ".ini": true}
+
+// memberType guesses what an extracted file is from its name and first few KB
+func memberType(fPath string, isPcap bool) string {
+	if isPcap {
+		return ds.MemberPcap
+	}
+	if StripArchiveExt(fPath) != fPath {
+		return ds.MemberArchive
+	}
+	f, err := os.Open(fPath)
+	if err != nil {
+		return ds.MemberOther
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rsaPremasterRe.MatchString(line) {
+			return ds.MemberKeylog
+		}
+		if pemKeyRe.MatchString(line) {
+			return ds.MemberRSAKey
+		}
+		if espSARe.MatchString(line) {
+			return ds.MemberESPSA
+		}
+		for _, prefix := range keylogPrefixes {
+			if strings.HasPrefix(line, prefix) {
+				return ds.MemberKeylog
+			}
+		}
+		break // Secrets files start with secrets after any comments
+	}
+	if textExts[strings.ToLower(filepath.Ext(fPath))] || strings.HasPrefix(strings.ToUpper(filepath.Base(fPath)), "README") {
+		return ds.MemberText
+	}
+	if n > 0 && utf8.Valid(head) && !bytes.ContainsRune(head, 0) {
+		return ds.MemberText
+	}
+	return ds.MemberOther
+}
@@ -0,0 +1,110 @@
+package dl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Quota limits how many bytes downloads and extracted archives may hold on disk at once
+type Quota struct {
+	mu      sync.Mutex
+	freed   *sync.Cond
+	limit   int64
+	used    int64
+	charges map[string]int64
+}
+
+// diskQuota is shared by all downloads. nil means there is no limit.
+var diskQuota *Quota
+
+// NewQuota is the Quota constructor
+func NewQuota(limit int64) *Quota {
+	q := &Quota{limit: limit, charges: make(map[string]int64)}
+	q.freed = sync.NewCond(&q.mu)
+	return q
+}
+
+// SetDiskQuota limits the bytes that hubcap keeps in .cache/ at any one time
+func SetDiskQuota(limit int64) {
+	if limit <= 0 {
+		diskQuota = nil
+		return
+	}
+	diskQuota = NewQuota(limit)
+}
+
+// Reserve blocks until n bytes fit under the limit and charges them to path
+func (q *Quota) Reserve(path string, n int64) error {
+	if q == nil {
+		return nil
+	}
+	if n > q.limit {
+		return fmt.Errorf("\033[93mWARN\033[0m %s needs %d bytes, which is more than the disk quota of %d bytes", path, n, q.limit)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.used+n > q.limit {
+		q.freed.Wait()
+	}
+	q.used += n
+	q.charges[path] += n
+	return nil
+}
+
+// TryReserve charges n bytes to path if they fit without waiting
+func (q *Quota) TryReserve(path string, n int64) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used+n > q.limit {
+		return false
+	}
+	q.used += n
+	q.charges[path] += n
+	return true
+}
+
+// Track charges bytes that are already on disk, like extracted files, without waiting
+func (q *Quota) Track(path string, n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used += n
+	q.charges[path] += n
+}
+
+// Release frees the bytes charged to path and to anything inside it if it is a folder
+func (q *Quota) Release(path string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for charged, n := range q.charges {
+		if charged == path || strings.HasPrefix(charged, path+"/") {
+			q.used -= n
+			delete(q.charges, charged)
+		}
+	}
+	q.freed.Broadcast()
+}
+
+// Used returns the bytes currently charged
+func (q *Quota) Used() int64 {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used
+}
+
+// ReleaseQuota frees the disk quota held by a file or folder once it has been deleted
+func ReleaseQuota(path string) {
+	diskQuota.Release(path)
+}
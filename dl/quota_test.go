@@ -0,0 +1,36 @@
+package dl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	q := NewQuota(100)
+	if err := q.Reserve("/c/a", 60); err != nil {
+		t.Fatal("Reserve() error =", err)
+	}
+	if q.TryReserve("/c/b", 50) {
+		t.Error("TryReserve() = true past the limit, want false")
+	}
+	if err := q.Reserve("/c/huge", 101); err == nil {
+		t.Error("Reserve() larger than the limit should fail")
+	}
+	q.Track("/c/dir/x", 10)
+	reserved := make(chan bool)
+	go func() {
+		q.Reserve("/c/b", 50)
+		reserved <- true
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("Reserve() returned before there was room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Release("/c/a")
+	<-reserved
+	q.Release("/c/dir")
+	if used := q.Used(); used != 50 {
+		t.Errorf("Used() = %d, want 50", used)
+	}
+}
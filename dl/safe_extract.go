@@ -0,0 +1,321 @@
+package dl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
+	"github.com/nwaples/rardecode"
+	ds "github.com/pocc/hubcap/mutexmap"
+)
+
+// Reasons that an archive is refused. These are stored as failure categories in captures.json.
+const (
+	RefusedPathTraversal    = "PathTraversal"
+	RefusedSymlink          = "Symlink"
+	RefusedTooLarge         = "TooLarge"
+	RefusedTooManyFiles     = "TooManyFiles"
+	RefusedCompressionRatio = "CompressionRatio"
+)
+
+// Compression ratios are only checked past this many extracted bytes so that tiny, repetitive captures are fine
+const minRatioCheckBytes = 10 << 20
+
+// ExtractError says why hubcap refused to extract an archive
+type ExtractError struct {
+	Archive string
+	Entry   string // The member that broke a limit, if there was one
+	Reason  string // One of the Refused* constants
+	Detail  string
+}
+
+func (e *ExtractError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("Refusing to extract %s (%s): %s", e.Archive, e.Reason, e.Detail)
+	}
+	return fmt.Sprintf("Refusing to extract %s from %s (%s): %s", e.Entry, e.Archive, e.Reason, e.Detail)
+}
+
+// LockedError is returned when an archive is encrypted and none of the passwords open it
+type LockedError struct {
+	Archive string
+	Entry   string // The first encrypted member, if the archive lists members without a password
+	Tried   int    // How many passwords were tried
+}
+
+func (e *LockedError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("%s is encrypted and none of %d passwords open it", e.Archive, e.Tried)
+	}
+	return fmt.Sprintf("%s in %s is encrypted and none of %d passwords open it", e.Entry, e.Archive, e.Tried)
+}
+
+// extraction keeps count of everything extracted from one download, including nested archives,
+// so that limits apply to the whole tree and not one layer at a time
+type extraction struct {
+	download    string
+	archiveSize int64
+	limits      ExtractLimits
+	written     int64
+	files       int
+	passwords   []string           // Tried in order on encrypted archives
+	opened      map[string]string  // Folders extracted from encrypted archives to the password that worked
+	locked      *LockedError       // The first nested archive that no password opened
+	nested      []ds.ArchiveMember // Archives inside the download, which are deleted once extracted
+}
+
+func newExtraction(download string, limits ExtractLimits, passwords []string) *extraction {
+	ex := &extraction{download: download, limits: limits, passwords: passwords, opened: make(map[string]string)}
+	if info, err := os.Stat(download); err == nil {
+		ex.archiveSize = info.Size()
+	}
+	return ex
+}
+
+func (ex *extraction) refuse(archived string, entry string, reason string, format string, a ...interface{}) error {
+	return &ExtractError{Archive: filepath.Base(archived), Entry: entry, Reason: reason, Detail: fmt.Sprintf(format, a...)}
+}
+
+// unarchive extracts every member of archived into folder, checking each against the limits first
+func (ex *extraction) unarchive(archived string, folder string) error {
+	lowerArchived := strings.ToLower(archived)
+	if strings.HasSuffix(lowerArchived, ".zip") {
+		return ex.unzip(archived, folder)
+	}
+	if strings.HasSuffix(lowerArchived, ".rar") {
+		return ex.unrar(archived, folder)
+	}
+	// archiver flattens errors from walkFn into strings, so keep the original to return
+	var entryErr error
+	walkErr := archiver.Walk(archived, func(f archiver.File) error {
+		entryErr = ex.extractEntry(archived, folder, f)
+		return entryErr
+	})
+	if entryErr != nil {
+		return entryErr
+	}
+	return walkErr
+}
+
+// unrar is like unarchive, but tries each password if the rar is encrypted
+func (ex *extraction) unrar(archived string, folder string) error {
+	written, files := ex.written, ex.files
+	candidates := append([]string{""}, ex.passwords...)
+	for _, password := range candidates {
+		rar := archiver.NewRar()
+		rar.Password = password
+		var entryErr error
+		walkErr := rar.Walk(archived, func(f archiver.File) error {
+			entryErr = ex.extractEntry(archived, folder, f)
+			return entryErr
+		})
+		err := walkErr
+		if entryErr != nil {
+			err = entryErr
+		}
+		var refused *ExtractError
+		if err == nil || errors.As(err, &refused) || !isRarPasswordErr(err, password) {
+			if err == nil && password != "" {
+				ex.opened[folder] = password
+			}
+			return err
+		}
+		// Count what the next password extracts from scratch
+		ex.written, ex.files = written, files
+	}
+	return &LockedError{Archive: filepath.Base(archived), Tried: len(ex.passwords)}
+}
+
+// isRarPasswordErr guesses whether rardecode failed because of the password. RAR 3 archives don't
+// check passwords, so a wrong one shows up as a bad checksum.
+func isRarPasswordErr(err error, password string) bool {
+	msg := err.Error()
+	if strings.Contains(msg, "password") || strings.Contains(msg, "encrypted") {
+		return true
+	}
+	return password != "" && strings.Contains(msg, "checksum")
+}
+
+// extractEntry extracts one member that archiver found
+func (ex *extraction) extractEntry(archived string, folder string, f archiver.File) error {
+	var name string
+	switch header := f.Header.(type) {
+	case *tar.Header:
+		name = header.Name
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			return ex.refuse(archived, name, RefusedSymlink, "links to %s", header.Linkname)
+		case tar.TypeDir:
+			return ex.mkdir(archived, folder, name)
+		case tar.TypeReg, tar.TypeRegA:
+		default: // Devices, fifos and extended headers have nothing to analyze
+			return nil
+		}
+	case *rardecode.FileHeader:
+		name = header.Name
+		if header.IsDir {
+			return ex.mkdir(archived, folder, name)
+		}
+		if header.Mode()&os.ModeSymlink != 0 {
+			return ex.refuse(archived, name, RefusedSymlink, "is a symlink")
+		}
+	default:
+		return fmt.Errorf("unexpected header %T in %s", f.Header, archived)
+	}
+	return ex.writeEntry(archived, folder, name, f.Size(), f)
+}
+
+// unzip is like unarchive but reads zip headers directly so that sizes are checked before decompressing
+func (ex *extraction) unzip(archived string, folder string) error {
+	zipReader, err := zip.OpenReader(archived)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+	for _, zf := range zipReader.File {
+		if zf.Mode()&os.ModeSymlink != 0 {
+			return ex.refuse(archived, zf.Name, RefusedSymlink, "is a symlink")
+		}
+		if zf.FileInfo().IsDir() {
+			if err := ex.mkdir(archived, folder, zf.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		// Headers can lie about sizes, so this is only an early warning. writeEntry counts actual bytes.
+		if zf.CompressedSize64 > 0 && float64(zf.UncompressedSize64) > float64(zf.CompressedSize64)*ex.limits.MaxRatio &&
+			zf.UncompressedSize64 > minRatioCheckBytes {
+			return ex.refuse(archived, zf.Name, RefusedCompressionRatio, "expands from %d to %d bytes",
+				zf.CompressedSize64, zf.UncompressedSize64)
+		}
+		if isEncryptedZip(zf) {
+			if err := ex.writeEncrypted(archived, folder, zf); err != nil {
+				return err
+			}
+			continue
+		}
+		reader, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = ex.writeEntry(archived, folder, zf.Name, int64(zf.UncompressedSize64), reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEncrypted extracts an encrypted zip member with the first password that decrypts it
+func (ex *extraction) writeEncrypted(archived string, folder string, zf *zip.File) error {
+	written, files := ex.written, ex.files
+	candidates := ex.passwords
+	// Members of one zip almost always share a password, so try the one that worked last first
+	if last, ok := ex.opened[folder]; ok {
+		candidates = append([]string{last}, ex.passwords...)
+	}
+	for _, password := range candidates {
+		reader, err := openEncrypted(zf, password)
+		if err == errWrongPassword {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = ex.writeEntry(archived, folder, zf.Name, int64(zf.UncompressedSize64), reader)
+		reader.Close()
+		// The password check is only 1 byte for ZipCrypto, so a wrong password can get past it
+		if errors.Is(err, errBadChecksum) || errors.Is(err, errGarbled) {
+			ex.written, ex.files = written, files
+			continue
+		}
+		if err == nil {
+			ex.opened[folder] = password
+		}
+		return err
+	}
+	return &LockedError{Archive: filepath.Base(archived), Entry: zf.Name, Tried: len(ex.passwords)}
+}
+
+// safeJoin returns where an archive member belongs in folder or an error if it would land outside of it
+func (ex *extraction) safeJoin(archived string, folder string, name string) (string, error) {
+	slashName := strings.Replace(name, `\`, "/", -1)
+	if path.IsAbs(slashName) || filepath.VolumeName(name) != "" {
+		return "", ex.refuse(archived, name, RefusedPathTraversal, "has an absolute path")
+	}
+	dest := filepath.Join(folder, filepath.FromSlash(slashName))
+	cleanFolder := filepath.Clean(folder)
+	if dest != cleanFolder && !strings.HasPrefix(dest, cleanFolder+string(os.PathSeparator)) {
+		return "", ex.refuse(archived, name, RefusedPathTraversal, "would be written to %s", dest)
+	}
+	return dest, nil
+}
+
+func (ex *extraction) mkdir(archived string, folder string, name string) error {
+	dest, err := ex.safeJoin(archived, folder, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dest, 0744)
+}
+
+// writeEntry copies one member to disk, stopping as soon as it breaks a limit
+func (ex *extraction) writeEntry(archived string, folder string, name string, declaredSize int64, r io.Reader) error {
+	dest, err := ex.safeJoin(archived, folder, name)
+	if err != nil {
+		return err
+	}
+	ex.files++
+	if ex.files > ex.limits.MaxFiles {
+		return ex.refuse(archived, name, RefusedTooManyFiles, "has more than %d files", ex.limits.MaxFiles)
+	}
+	remaining := ex.limits.MaxTotalSize - ex.written
+	if declaredSize > remaining {
+		return ex.refuse(archived, name, RefusedTooLarge, "would extract more than %d bytes", ex.limits.MaxTotalSize)
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0744); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// The ratio is checked while copying too, so that a bomb stops once it breaks it rather than at the total cap
+	allowed := remaining
+	if ex.archiveSize > 0 {
+		ratioAllowed := int64(float64(ex.archiveSize) * ex.limits.MaxRatio)
+		if ratioAllowed < minRatioCheckBytes {
+			ratioAllowed = minRatioCheckBytes
+		}
+		if ratioAllowed-ex.written < allowed {
+			allowed = ratioAllowed - ex.written
+		}
+		if allowed < 0 {
+			allowed = 0
+		}
+	}
+	// Copy one byte past what's allowed to find out if a limit was broken
+	written, err := io.CopyN(out, r, allowed+1)
+	ex.written += written
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("extracting %s: %w", name, err)
+	}
+	if ex.written > ex.limits.MaxTotalSize {
+		return ex.refuse(archived, name, RefusedTooLarge, "extracts to more than %d bytes", ex.limits.MaxTotalSize)
+	}
+	if ex.archiveSize > 0 && ex.written > minRatioCheckBytes &&
+		float64(ex.written) > float64(ex.archiveSize)*ex.limits.MaxRatio {
+		return ex.refuse(archived, name, RefusedCompressionRatio, "%s expands %.0f times, over the limit of %.0f",
+			filepath.Base(ex.download), float64(ex.written)/float64(ex.archiveSize), ex.limits.MaxRatio)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package dl
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipWithHeaders makes a zip from headers so that tests can set modes and names that zip.Writer.Create can't
+func zipWithHeaders(t *testing.T, headers []*zip.FileHeader, contents [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for i, header := range headers {
+		w, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(contents[i])
+	}
+	zipWriter.Close()
+	return buf.Bytes()
+}
+
+// tgzWithHeaders makes a .tar.gz from headers and contents
+func tgzWithHeaders(t *testing.T, headers []*tar.Header, contents [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(buf)
+	for i, header := range headers {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write(contents[i])
+	}
+	tarWriter.Close()
+	return gzipBytes(t, buf.Bytes())
+}
+
+func Test_extractArchiveRefusals(t *testing.T) {
+	symlinkHeader := &zip.FileHeader{Name: "link", Method: zip.Store}
+	symlinkHeader.SetMode(os.ModeSymlink | 0777)
+	zeros := make([]byte, 20<<20)
+	fiveFiles := map[string][]byte{"1": {1}, "2": {2}, "3": {3}, "4": {4}, "5": {5}}
+	tests := []struct {
+		name       string
+		filename   string
+		contents   []byte
+		limits     func(*ExtractLimits)
+		wantReason string
+	}{
+		{"Zip slip", "slip.zip", zipBytes(t, map[string][]byte{"../../evil.pcap": []byte("x")}), nil, RefusedPathTraversal},
+		{"Windows zip slip", "slip.zip", zipBytes(t, map[string][]byte{`..\..\evil.pcap`: []byte("x")}), nil, RefusedPathTraversal},
+		{"Tar with absolute path", "abs.tgz", tgzWithHeaders(t, []*tar.Header{
+			{Name: "/tmp/evil.pcap", Mode: 0644, Size: 1, Typeflag: tar.TypeReg}}, [][]byte{[]byte("x")}), nil, RefusedPathTraversal},
+		{"Tar symlink", "link.tgz", tgzWithHeaders(t, []*tar.Header{
+			{Name: "passwd", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}}, [][]byte{nil}), nil, RefusedSymlink},
+		{"Tar hardlink", "link.tgz", tgzWithHeaders(t, []*tar.Header{
+			{Name: "passwd", Linkname: "../../etc/passwd", Typeflag: tar.TypeLink}}, [][]byte{nil}), nil, RefusedSymlink},
+		{"Zip symlink", "link.zip", zipWithHeaders(t, []*zip.FileHeader{symlinkHeader}, [][]byte{[]byte("/etc/passwd")}), nil, RefusedSymlink},
+		{"Zip bomb", "bomb.zip", zipBytes(t, map[string][]byte{"zeros.pcap": zeros}), nil, RefusedCompressionRatio},
+		{"Nested bomb", "nested.zip", zipBytes(t, map[string][]byte{"zeros.pcap.gz": gzipBytes(t, zeros)}),
+			func(l *ExtractLimits) { l.MaxRatio = 50 }, RefusedCompressionRatio},
+		{"Too many files", "many.zip", zipBytes(t, fiveFiles), func(l *ExtractLimits) { l.MaxFiles = 3 }, RefusedTooManyFiles},
+		{"Too large", "large.tgz", tgzBytes(t, map[string][]byte{"big.pcap": make([]byte, 200)}),
+			func(l *ExtractLimits) { l.MaxTotalSize = 100 }, RefusedTooLarge},
+		{"Too large compressed file", "big.pcap.gz", gzipBytes(t, make([]byte, 200)),
+			func(l *ExtractLimits) { l.MaxTotalSize = 100 }, RefusedTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hubcap")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			// Extract two levels down so that a successful escape would still land inside dir
+			archived := filepath.Join(dir, "a", "b", tt.filename)
+			os.MkdirAll(filepath.Dir(archived), 0744)
+			ioutil.WriteFile(archived, tt.contents, 0644)
+			limits := DefaultExtractLimits()
+			if tt.limits != nil {
+				tt.limits(&limits)
+			}
+			err = extractArchive(context.Background(), newExtraction(archived, limits, nil), archived, StripArchiveExt(archived), 1)
+			var refused *ExtractError
+			if !errors.As(err, &refused) {
+				t.Fatalf("extractArchive() error = %v, want an *ExtractError", err)
+			}
+			if refused.Reason != tt.wantReason {
+				t.Errorf("extractArchive() refused for %s, want %s", refused.Reason, tt.wantReason)
+			}
+			for _, escaped := range []string{"evil.pcap", "a/evil.pcap", "a/passwd"} {
+				if _, err := os.Lstat(filepath.Join(dir, escaped)); err == nil {
+					t.Errorf("extractArchive() wrote %s outside of the extraction folder", escaped)
+				}
+			}
+		})
+	}
+}
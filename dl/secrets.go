@@ -0,0 +1,75 @@
+package dl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	ds "github.com/pocc/hubcap/mutexmap"
+	"github.com/pocc/hubcap/pcap"
+)
+
+// Secrets are copied out of extracted archives into .cache/secrets/<capture sha256>/ so that
+// they outlive the extraction folder, which metadata-only crawls delete
+const secretsDir = "secrets"
+
+// StoreSecrets copies the siblings of a capture that can decrypt it next to the capture's other secrets.
+// root is the folder that contains .cache/ because sibling filenames are relative to it.
+func StoreSecrets(root string, captureHash string, siblings []ds.ArchiveMember) ([]ds.Secret, error) {
+	secrets := make([]ds.Secret, 0)
+	folder := filepath.Join(".cache", secretsDir, captureHash)
+	for _, sibling := range siblings {
+		if !ds.IsSecret(sibling.Type) {
+			continue
+		}
+		// Prefix the hash so that two keys.log from different folders don't overwrite each other
+		name := fmt.Sprintf("%.8s_%s", sibling.SHA256, filepath.Base(sibling.Filename))
+		dest := filepath.Join(folder, name)
+		if err := copyFile(filepath.Join(root, sibling.Filename), filepath.Join(root, dest)); err != nil {
+			return secrets, fmt.Errorf("\033[93mWARN\033[0m Problem storing secret %s: %s", sibling.Path, err)
+		}
+		secrets = append(secrets, ds.Secret{Type: sibling.Type, Filename: dest, SHA256: sibling.SHA256, From: sibling.Path})
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	return secrets, nil
+}
+
+// Decryption returns the tshark settings that use secrets stored under root
+func Decryption(root string, secrets []ds.Secret) pcap.Decryption {
+	var dec pcap.Decryption
+	for _, secret := range secrets {
+		fullPath := filepath.Join(root, secret.Filename)
+		switch secret.Type {
+		case ds.MemberKeylog:
+			dec.Keylogs = append(dec.Keylogs, fullPath)
+		case ds.MemberRSAKey:
+			dec.RSAKeys = append(dec.RSAKeys, fullPath)
+		case ds.MemberESPSA:
+			dec.ESPSAs = append(dec.ESPSAs, fullPath)
+		}
+	}
+	return dec
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dst), 0744); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,193 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pocc/hubcap/pcap"
+)
+
+// sniffLen is how much of a file is read or requested to tell its format
+const sniffLen = pcap.DetectLen
+
+// Formats that Sniff detects besides the capture formats of pcap.DetectFormat
+const (
+	FormatZip      = "zip"
+	FormatGzip     = "gzip"
+	FormatBzip2    = "bzip2"
+	FormatXz       = "xz"
+	FormatLzma     = "lzma"
+	FormatZstd     = "zstd"
+	FormatRar      = "rar"
+	Format7z       = "7z"
+	FormatTar      = "tar"
+	FormatPNG      = "png"
+	FormatJPEG     = "jpeg"
+	FormatGIF      = "gif"
+	FormatTIFF     = "tiff"
+	FormatPDF      = "pdf"
+	FormatMSOffice = "msoffice" // .doc and .xls
+	FormatOOXML    = "ooxml"    // .docx, .xlsx and .odt are zips
+	FormatHTML     = "html"
+	FormatXML      = "xml"
+	FormatText     = "text"
+	FormatUnknown  = "unknown"
+)
+
+// Kinds of formats
+const (
+	KindCapture  = "capture"
+	KindArchive  = "archive"
+	KindImage    = "image"
+	KindDocument = "document"
+	KindText     = "text"
+	KindUnknown  = "unknown"
+)
+
+type magic struct {
+	offset int
+	prefix string
+	format string
+}
+
+// magics are checked in order, so longer prefixes go before shorter ones that they start with
+var magics = []magic{
+	{0, "PK\x03\x04", FormatZip},
+	{0, "PK\x05\x06", FormatZip}, // Empty zip
+	{0, "\x1f\x8b", FormatGzip},
+	{0, "BZh", FormatBzip2},
+	{0, "\xfd7zXZ\x00", FormatXz},
+	{0, "\x28\xb5\x2f\xfd", FormatZstd},
+	{0, "Rar!\x1a\x07", FormatRar},
+	{0, "7z\xbc\xaf\x27\x1c", Format7z},
+	{257, "ustar", FormatTar},
+	{0, "\x89PNG\r\n\x1a\n", FormatPNG},
+	{0, "\xff\xd8\xff", FormatJPEG},
+	{0, "GIF87a", FormatGIF},
+	{0, "GIF89a", FormatGIF},
+	{0, "II*\x00", FormatTIFF},
+	{0, "MM\x00*", FormatTIFF},
+	{0, "%PDF-", FormatPDF},
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", FormatMSOffice},
+}
+
+var formatKinds = map[string]string{
+	FormatZip: KindArchive, FormatGzip: KindArchive, FormatBzip2: KindArchive, FormatXz: KindArchive,
+	FormatLzma: KindArchive, FormatZstd: KindArchive, FormatRar: KindArchive, Format7z: KindArchive, FormatTar: KindArchive,
+	FormatPNG: KindImage, FormatJPEG: KindImage, FormatGIF: KindImage, FormatTIFF: KindImage,
+	FormatPDF: KindDocument, FormatMSOffice: KindDocument, FormatOOXML: KindDocument,
+	FormatHTML: KindText, FormatXML: KindText, FormatText: KindText,
+}
+
+// Office formats that are zips inside
+var ooxmlExts = map[string]bool{".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".odp": true}
+
+// Sniff returns the format of a file from its first few KB. name is only used to tell formats with the
+// same magic bytes apart, like .docx and .zip.
+func Sniff(head []byte, name string) string {
+	for _, m := range magics {
+		if len(head) >= m.offset+len(m.prefix) && string(head[m.offset:m.offset+len(m.prefix)]) == m.prefix {
+			if m.format == FormatZip && ooxmlExts[strings.ToLower(filepath.Ext(name))] {
+				return FormatOOXML
+			}
+			return m.format
+		}
+	}
+	// After the magics above because ERF detection is a guess that other binaries can pass
+	if capture, ok := pcap.DetectFormat(head); ok {
+		return capture.Name
+	}
+	// .lzma has no magic bytes worth trusting
+	if strings.HasSuffix(strings.ToLower(name), ".lzma") {
+		return FormatLzma
+	}
+	if isText(head) {
+		start := head
+		if len(start) > 256 {
+			start = start[:256]
+		}
+		trimmed := strings.ToLower(string(bytes.TrimSpace(start)))
+		switch {
+		case strings.HasPrefix(trimmed, "<!doctype html") || strings.HasPrefix(trimmed, "<html"):
+			return FormatHTML
+		case strings.HasPrefix(trimmed, "<?xml"):
+			return FormatXML
+		}
+		return FormatText
+	}
+	return FormatUnknown
+}
+
+// FormatKind returns whether a format is a capture, archive, image, document, text or unknown
+func FormatKind(format string) string {
+	if pcap.IsCaptureFormat(format) {
+		return KindCapture
+	}
+	if kind, ok := formatKinds[format]; ok {
+		return kind
+	}
+	return KindUnknown
+}
+
+// isWorthDownloading returns whether a file of format might be or contain a capture.
+// Unknown binaries are kept because wireshark reads many formats that hubcap doesn't sniff.
+func isWorthDownloading(format string) bool {
+	kind := FormatKind(format)
+	return kind == KindCapture || kind == KindArchive || kind == KindUnknown
+}
+
+// isText returns whether head looks like UTF-8 text. A rune cut off at the end of head is allowed.
+func isText(head []byte) bool {
+	if len(head) == 0 || bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	if len(head) > utf8.UTFMax {
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(head); i++ {
+			head = head[:len(head)-1]
+		}
+	}
+	return utf8.Valid(head)
+}
+
+// SniffFile returns the format of a local file
+func SniffFile(fPath string) string {
+	f, err := os.Open(fPath)
+	if err != nil {
+		return FormatUnknown
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	return Sniff(head[:n], fPath)
+}
+
+// sniffURL gets the first few KB of a url with a Range request. Servers that ignore Range
+// send the whole file, so only the start of the body is read.
+func sniffURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sniffLen-1))
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("Range request to %s got code %d", url, resp.StatusCode)
+	}
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
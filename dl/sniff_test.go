@@ -0,0 +1,100 @@
+package dl
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pocc/hubcap/pcap"
+)
+
+func TestSniff(t *testing.T) {
+	erfRecord := "\x01\x02\x03\x04\x05\x06\x07\x08\x02\x04\x00\x14\x00\x00\x00\x04abcd"
+	tarHead := make([]byte, 512)
+	copy(tarHead[257:], "ustar")
+	tests := []struct {
+		name     string
+		head     string
+		filename string
+		want     string
+	}{
+		{"pcap", "\xd4\xc3\xb2\xa1\x02\x00\x04\x00", "a.cap", pcap.FormatPcap},
+		{"Nanosecond pcap", "\xa1\xb2\x3c\x4d\x00\x02\x00\x04", "a.pcap", pcap.FormatPcapNsec},
+		{"pcapng", "\x0a\x0d\x0d\x0a\x1c\x00\x00\x00\x4d\x3c\x2b\x1a", "a.pcapng", pcap.FormatPcapng},
+		{"pcapng named .txt", "\x0a\x0d\x0d\x0a\x1c\x00\x00\x00\x4d\x3c\x2b\x1a", "a.txt", pcap.FormatPcapng},
+		{"ERF", erfRecord + erfRecord, "a.erf", pcap.FormatERF},
+		{"snoop", "snoop\x00\x00\x00\x00\x00\x00\x02", "a.snoop", pcap.FormatSnoop},
+		{"K12", "\x00\x00\x02\x00\x12\x05\x00\x10", "a.rf5", pcap.FormatK12},
+		{"NetMon", "GMBU\x00\x02", "a.cap", pcap.FormatNetmon2},
+		{"iSeries text trace", "   COMMUNICATIONS TRACE       Title: LAB\n", "a.txt", pcap.FormatISeries},
+		{"zip", "PK\x03\x04\x14\x00", "a.zip", FormatZip},
+		{"docx is a zip", "PK\x03\x04\x14\x00", "a.docx", FormatOOXML},
+		{"gzip", "\x1f\x8b\x08\x00", "a.pcap.gz", FormatGzip},
+		{"tar", string(tarHead), "a.tar", FormatTar},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00", "a.png", FormatPNG},
+		{"PDF", "%PDF-1.4\n", "a.pdf", FormatPDF},
+		{"HTML error page", "\n<!DOCTYPE html>\n<html>", "a.pcap", FormatHTML},
+		{"Patch", "diff --git a/epan/packet.c b/epan/packet.c\n", "a.patch", FormatText},
+		{"Unknown binary", "\x00\x01\x02\x03\xff\xfe", "a.bin", FormatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sniff([]byte(tt.head), tt.filename); got != tt.want {
+				t.Errorf("Sniff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchFileSniffsFirst(t *testing.T) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Write([]byte(strings.Repeat("Not a capture, just notes.\n", 1000)))
+	}))
+	defer server.Close()
+	_, err := FetchFile(context.Background(), server.URL+"/notes.pcap")
+	if err == nil || !strings.Contains(err.Error(), "non-pcap") {
+		t.Errorf("FetchFile() error = %v, want a skipped non-pcap", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=0-4095" {
+		t.Errorf("FetchFile() made requests with ranges %q, want one range request", ranges)
+	}
+}
+
+func Test_sniffURL(t *testing.T) {
+	pcapHead := "\xd4\xc3\xb2\xa1" + strings.Repeat("\x00", 10000)
+	tests := []struct {
+		name         string
+		ignoresRange bool
+		status       int
+		wantLen      int
+		wantErr      bool
+	}{
+		{"Partial content", false, http.StatusPartialContent, sniffLen, false},
+		{"Server ignores Range", true, http.StatusOK, sniffLen, false},
+		{"Not found", false, http.StatusNotFound, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				if tt.ignoresRange {
+					w.Write([]byte(pcapHead))
+				} else {
+					w.Write([]byte(pcapHead[:sniffLen]))
+				}
+			}))
+			defer server.Close()
+			head, err := sniffURL(context.Background(), server.URL+"/a.pcap")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sniffURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(head) != tt.wantLen {
+				t.Errorf("sniffURL() read %d bytes, want %d", len(head), tt.wantLen)
+			}
+		})
+	}
+}
@@ -1,53 +1,255 @@
 package dl
 
 import (
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
-	"github.com/mholt/archiver"
+	"github.com/klauspost/compress/zstd"
+	ds "github.com/pocc/hubcap/mutexmap"
 	"github.com/pocc/hubcap/pcap"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
-// UnarchivePcaps will unarchive pcaps from archive f to a folder of the same name before removing f
-func UnarchivePcaps(archived string) ([]string, error) {
+// ExtractLimits bounds what hubcap will extract from a downloaded archive
+type ExtractLimits struct {
+	// MaxDepth is how many layers of archives inside archives to extract. 1 only extracts the download.
+	MaxDepth int
+	// MaxTotalSize is the most bytes that one download may extract to, including nested archives
+	MaxTotalSize int64
+	// MaxFiles is the most files that one download may extract to, including nested archives
+	MaxFiles int
+	// MaxRatio is the most that extracted bytes may outnumber downloaded bytes
+	MaxRatio float64
+}
+
+// DefaultExtractLimits returns the limits used unless SetExtractLimits is called
+func DefaultExtractLimits() ExtractLimits {
+	return ExtractLimits{MaxDepth: 4, MaxTotalSize: 10 << 30, MaxFiles: 10000, MaxRatio: 200}
+}
+
+var extractLimits = DefaultExtractLimits()
+
+// SetExtractLimits changes the limits for every later extraction
+func SetExtractLimits(limits ExtractLimits) {
+	extractLimits = limits
+}
+
+// Nested archives are extracted next to themselves into a folder of the same name ending in `!`,
+// so a member's path mirrors its archive chain like outer/inner.tgz!/a.pcapng
+const nestedSuffix = "!"
+
+// UnarchivePcaps will unarchive pcaps from archive f to a folder of the same name.
+// Archives and compressed files inside of f are extracted too, up to the configured depth.
+// Encrypted archives are opened with the first of passwords that works.
+// f is then moved to .cache/archives/<sha256><ext> and the returned manifest, which lists every member,
+// is saved next to it with the links it was downloaded from. The manifest is returned whenever f was extracted, even if it had no pcaps.
+// If f breaks an extraction limit, nothing is kept and the error wraps an *ExtractError.
+// If f is encrypted and no password opens it, the error wraps a *LockedError.
+func UnarchivePcaps(ctx context.Context, archived string, sources []string, passwords []string) ([]string, *ds.ArchiveManifest, error) {
 	fmt.Printf("\033[92mINFO\033[0m Unarchiving %s\n", archived)
 	folderName := string(StripArchiveExt(archived))
 	if folderName == archived {
-		return nil, fmt.Errorf("\033[91mERROR\033[0m Unarchive called for nonarchive %s", archived)
+		return nil, nil, fmt.Errorf("\033[91mERROR\033[0m Unarchive called for nonarchive %s", archived)
 	}
-	if err := os.MkdirAll(folderName, 0744); err != nil {
-		return nil, fmt.Errorf("\033[91mERROR\033[0m Cannot create folder %s to extract files to. Got error: %s", folderName, err)
-	}
-	archiveErr := archiver.Unarchive(archived, folderName)
+	ex := newExtraction(archived, extractLimits, passwords)
+	archiveErr := extractArchive(ctx, ex, archived, folderName, 1)
 	if archiveErr != nil {
-		return nil, fmt.Errorf("\033[93mWARN\033[0m Problem with archive %s.\nError: %s", archived, archiveErr)
+		os.RemoveAll(folderName)
+		return nil, nil, fmt.Errorf("\033[93mWARN\033[0m Problem with archive %s.\nError: %w", archived, archiveErr)
+	}
+	diskQuota.Track(folderName, dirSize(folderName))
+	files, err := WalkArchive(ctx, folderName)
+	if err != nil {
+		// Start over next time rather than trust a half walked folder
+		os.RemoveAll(folderName)
+		diskQuota.Release(folderName)
+		return nil, nil, fmt.Errorf("\033[91mERROR\033[0m Could not read archive directory %s", folderName)
 	}
-	files, err := WalkArchive(folderName)
+	manifest, err := ex.record(archived, folderName, sources, files)
 	if err != nil {
-		return nil, fmt.Errorf("\033[91mERROR\033[0m Could not read archive directory %s", folderName)
+		return nil, nil, err
 	}
 	if len(files) == 0 {
-		return nil, fmt.Errorf("\033[93mWARN\033[0m Archive %s had no pcaps", archived)
+		// If the only thing that could have had pcaps was locked, say so instead
+		if ex.locked != nil {
+			return nil, manifest, fmt.Errorf("\033[93mWARN\033[0m Archive %s had no pcaps outside of an encrypted archive.\nError: %w",
+				archived, ex.locked)
+		}
+		return nil, manifest, fmt.Errorf("\033[93mWARN\033[0m Archive %s had no pcaps", archived)
+	}
+	fmt.Printf("\033[92mINFO\033[0m Kept archive %s as %s\n", archived, manifest.SHA256)
+	return files, manifest, nil
+}
+
+// extractArchive extracts or decompresses archived into folder, then does the same for archives inside it
+func extractArchive(ctx context.Context, ex *extraction, archived string, folder string, depth int) error {
+	if err := os.MkdirAll(folder, 0744); err != nil {
+		return fmt.Errorf("Cannot create folder %s to extract files to. Got error: %s", folder, err)
+	}
+	if isCompressedFile(archived) {
+		compressedName := filepath.Base(archived)
+		decompressed := filepath.Join(folder, strings.TrimSuffix(compressedName, filepath.Ext(compressedName)))
+		if err := ex.decompressFile(archived, decompressed); err != nil {
+			return err
+		}
+		// A tarball compressed with something archiver doesn't know, like .tar.zst, is one layer not two
+		if strings.HasSuffix(decompressed, ".tar") {
+			// The tarball's bytes were counted when it was decompressed, so don't count them twice
+			ex.written -= fileSize(decompressed)
+			ex.files--
+			if err := ex.unarchive(decompressed, folder); err != nil {
+				return err
+			}
+			os.Remove(decompressed)
+		}
+	} else if err := ex.unarchive(archived, folder); err != nil {
+		return err
+	}
+	if depth >= ex.limits.MaxDepth {
+		return nil
+	}
+	nested := make([]string, 0)
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && StripArchiveExt(path) != path {
+			nested = append(nested, path)
+		}
+		return nil
+	})
+	for _, inner := range nested {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := extractArchive(ctx, ex, inner, inner+nestedSuffix, depth+1); err != nil {
+			var refused *ExtractError
+			if errors.As(err, &refused) {
+				return err // An unsafe inner archive makes the whole download unsafe
+			}
+			var locked *LockedError
+			if errors.As(err, &locked) && ex.locked == nil {
+				ex.locked = locked
+			}
+			// A bad inner archive shouldn't stop the pcaps next to it from being analyzed
+			fmt.Printf("\033[93mWARN\033[0m Problem with nested archive %s.\nError: %s\n", inner, err)
+			os.RemoveAll(inner + nestedSuffix)
+			continue
+		}
+		// Its contents are kept, so only remember what the inner archive was
+		ex.nested = append(ex.nested, ds.ArchiveMember{
+			Path:     ArchiveChain(ex.download, inner),
+			SHA256:   pcap.GetSHA256(inner),
+			Size:     fileSize(inner),
+			Type:     ds.MemberArchive,
+			Password: ex.passwordFor(inner),
+		})
+		os.Remove(inner)
+	}
+	return nil
+}
+
+// passwordFor returns the password of the innermost encrypted archive that file came from
+func (ex *extraction) passwordFor(file string) string {
+	innermost, password := "", ""
+	for folder, folderPassword := range ex.opened {
+		if strings.HasPrefix(file, folder+string(os.PathSeparator)) && len(folder) > len(innermost) {
+			innermost, password = folder, folderPassword
+		}
 	}
-	delErr := os.Remove(archived)
-	if delErr != nil {
-		return nil, fmt.Errorf("\033[91mERROR\033[0m Problem deleting archive `%s` "+
-			"(Do you have permissions?).\nERROR: %s", archived, delErr)
+	return password
+}
+
+// ArchiveChain returns where an extracted member came from, like outer.zip!/inner.tgz!/a.pcapng
+func ArchiveChain(archived string, member string) string {
+	relPath, err := filepath.Rel(StripArchiveExt(archived), member)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return ""
 	}
-	fmt.Println("\033[92mINFO\033[0m Deleted archive file", archived)
-	return files, nil
+	return filepath.Base(archived) + nestedSuffix + "/" + filepath.ToSlash(relPath)
+}
+
+// compressedRe matches single-file compression that archiver can't unarchive on its own
+var compressedRe = regexp.MustCompile(`\.(?:gz|bz2|xz|lzma|zst|zstd)$`)
+
+// tarballRe matches compressed tarballs that archiver unarchives in one step
+var tarballRe = regexp.MustCompile(`\.(?:n?tar\.gz|tar\.bz2|tar\.xz|tgz|tbz2|txz)$`)
+
+func isCompressedFile(fPath string) bool {
+	return compressedRe.MatchString(fPath) && !tarballRe.MatchString(fPath)
+}
+
+// decompressFile writes the decompressed contents of a .gz/.bz2/.xz/.lzma/.zst file to dst
+func (ex *extraction) decompressFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var reader io.Reader
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".gz":
+		gzReader, gzErr := gzip.NewReader(in)
+		if gzErr != nil {
+			return gzErr
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	case ".bz2":
+		reader = bzip2.NewReader(in)
+	case ".xz":
+		reader, err = xz.NewReader(in)
+	case ".lzma":
+		reader, err = lzma.NewReader(in)
+	case ".zst", ".zstd":
+		zstdReader, zstdErr := zstd.NewReader(in)
+		if zstdErr != nil {
+			return zstdErr
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	default:
+		return fmt.Errorf("%s is not a compressed file", src)
+	}
+	if err != nil {
+		return err
+	}
+	if err = ex.writeEntry(src, filepath.Dir(dst), filepath.Base(dst), 0, reader); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+func fileSize(fPath string) int64 {
+	info, err := os.Stat(fPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 // WalkArchive walks an extracted archive
-func WalkArchive(startpath string) ([]string, error) {
+func WalkArchive(ctx context.Context, startpath string) ([]string, error) {
 	files := make([]string, 0)
 	err := filepath.Walk(startpath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		pcapErr := pcap.IsPcap(path)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Don't bother capinfos with files that are plainly something else
+		if kind := FormatKind(SniffFile(path)); kind != KindCapture && kind != KindUnknown {
+			return nil
+		}
+		pcapErr := pcap.IsPcap(ctx, path)
 		// If a file inside the archive isn't a pcap, skip it silently
 		if pcapErr == nil {
 			files = append(files, path)
@@ -60,9 +262,21 @@ func WalkArchive(startpath string) ([]string, error) {
 	return files, err
 }
 
+// dirSize returns the bytes used by regular files in a folder
+func dirSize(folder string) int64 {
+	var size int64
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
 // StripArchiveExt removes archive extensions `.tar.gz` and `.bz2` or returns filename otherwise
 func StripArchiveExt(fPath string) string {
-	archiveRe := regexp.MustCompile(`(.*?)\.(?:n?tar\.gz|bz2|lzma|ntar|rar|tbz2|tgz|tar|xz|zip)$`)
+	archiveRe := regexp.MustCompile(`(.*?)\.(?:n?tar\.gz|tar\.bz2|tar\.xz|tar\.zst|bz2|gz|lzma|ntar|rar|tbz2|tgz|txz|tar|xz|zip|zst|zstd)$`)
 	archiveMatches := archiveRe.FindStringSubmatch(fPath)
 	if len(archiveMatches) == 2 {
 		return archiveMatches[1]
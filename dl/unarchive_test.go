@@ -1,8 +1,16 @@
 package dl
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/mholt/archiver"
@@ -23,7 +31,7 @@ func TestUnarchivePcaps(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := UnarchivePcaps(tt.args.f)
+			got, _, err := UnarchivePcaps(context.Background(), tt.args.f, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UnarchivePcaps() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -55,6 +63,10 @@ func TestStripArchiveExt(t *testing.T) {
 		{".ntar.gz", args{"ws_w-I.ntar.gz"}, "ws_w-I"},
 		{".tar.gz", args{"ws_w-I.tar.gz"}, "ws_w-I"},
 		{".tgz", args{"ws_w-I.tgz"}, "ws_w-I"},
+		{".pcap.gz", args{"ws_w-I.pcap.gz"}, "ws_w-I.pcap"},
+		{".pcapng.zst", args{"ws_w-I.pcapng.zst"}, "ws_w-I.pcapng"},
+		{".tar.zst", args{"ws_w-I.tar.zst"}, "ws_w-I"},
+		{"Not an archive", args{"ws_w-I.pcapng"}, "ws_w-I.pcapng"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -64,3 +76,89 @@ func TestStripArchiveExt(t *testing.T) {
 		})
 	}
 }
+
+// gzipBytes compresses contents with gzip
+func gzipBytes(t *testing.T, contents []byte) []byte {
+	buf := new(bytes.Buffer)
+	gzWriter := gzip.NewWriter(buf)
+	if _, err := gzWriter.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	gzWriter.Close()
+	return buf.Bytes()
+}
+
+// zipBytes makes a zip with the given filenames and contents
+func zipBytes(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for name, contents := range files {
+		w, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(contents)
+	}
+	zipWriter.Close()
+	return buf.Bytes()
+}
+
+// tgzBytes makes a .tar.gz with the given filenames and contents
+func tgzBytes(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	tarWriter := tar.NewWriter(buf)
+	for name, contents := range files {
+		tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})
+		tarWriter.Write(contents)
+	}
+	tarWriter.Close()
+	return gzipBytes(t, buf.Bytes())
+}
+
+func Test_extractArchive(t *testing.T) {
+	pcapBytes := []byte("\xd4\xc3\xb2\xa1 pretend pcap")
+	innerZip := zipBytes(t, map[string][]byte{"b.pcap.gz": gzipBytes(t, pcapBytes)})
+	tests := []struct {
+		name      string
+		filename  string
+		contents  []byte
+		maxDepth  int
+		wantChain []string
+	}{
+		{"Compressed pcap", "a.pcap.gz", gzipBytes(t, pcapBytes), 4, []string{"a.pcap.gz!/a.pcap"}},
+		{"Zip of compressed pcaps", "outer.zip", zipBytes(t, map[string][]byte{"a.pcap.gz": gzipBytes(t, pcapBytes), "c.pcap": pcapBytes}), 4,
+			[]string{"outer.zip!/a.pcap.gz!/a.pcap", "outer.zip!/c.pcap"}},
+		{"Tarball of zips", "outer.tgz", tgzBytes(t, map[string][]byte{"inner.zip": innerZip}), 4,
+			[]string{"outer.tgz!/inner.zip!/b.pcap.gz!/b.pcap"}},
+		{"Depth limit", "outer.tgz", tgzBytes(t, map[string][]byte{"inner.zip": innerZip}), 2,
+			[]string{"outer.tgz!/inner.zip!/b.pcap.gz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hubcap")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			limits := DefaultExtractLimits()
+			limits.MaxDepth = tt.maxDepth
+			archived := filepath.Join(dir, tt.filename)
+			ioutil.WriteFile(archived, tt.contents, 0644)
+			ex := newExtraction(archived, limits, nil)
+			if err := extractArchive(context.Background(), ex, archived, StripArchiveExt(archived), 1); err != nil {
+				t.Fatal("extractArchive() error =", err)
+			}
+			chains := make([]string, 0)
+			filepath.Walk(StripArchiveExt(archived), func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					chains = append(chains, ArchiveChain(archived, path))
+				}
+				return nil
+			})
+			sort.Strings(chains)
+			if !reflect.DeepEqual(chains, tt.wantChain) {
+				t.Errorf("extractArchive() members = %v, want %v", chains, tt.wantChain)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package dl
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// archive/zip can't read encrypted members, so this decrypts traditional PKWARE (ZipCrypto)
+// and WinZip AES members from their raw bytes before decompressing them.
+
+var (
+	errWrongPassword = errors.New("wrong password")
+	// errBadChecksum usually means a wrong password got past a 1 byte password check
+	errBadChecksum = errors.New("checksum mismatch after decrypting")
+	// errGarbled is any other error reading a member after its password check, which also
+	// usually means a wrong password got past it and left flate with garbage
+	errGarbled = errors.New("unreadable after decrypting")
+)
+
+const (
+	zipEncryptedFlag  = 0x1
+	zipDescriptorFlag = 0x8
+	zipMethodAES      = 99
+	winzipAESTag      = 0x9901
+)
+
+func isEncryptedZip(zf *zip.File) bool {
+	return zf.Flags&zipEncryptedFlag != 0
+}
+
+// openEncrypted returns a reader of zf's decompressed contents or errWrongPassword
+func openEncrypted(zf *zip.File, password string) (io.ReadCloser, error) {
+	raw, err := zf.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	var decrypted io.Reader
+	method := zf.Method
+	checkCRC := true
+	if zf.Method == zipMethodAES {
+		aesExtra, err := parseAESExtra(zf.Extra)
+		if err != nil {
+			return nil, err
+		}
+		method = aesExtra.method
+		// AE-2 leaves the CRC out since the HMAC already authenticates the data
+		checkCRC = aesExtra.version == 1
+		decrypted, err = newWinzipAESReader(raw, int64(zf.CompressedSize64), aesExtra.strength, password)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Without a CRC in the header, the check byte is the high byte of the DOS modified time
+		checkByte := byte(zf.CRC32 >> 24)
+		if zf.Flags&zipDescriptorFlag != 0 {
+			checkByte = byte(zf.ModifiedTime >> 8)
+		}
+		decrypted, err = newZipCryptoReader(raw, checkByte, password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var decompressed io.ReadCloser
+	switch method {
+	case zip.Store:
+		decompressed = ioutil.NopCloser(decrypted)
+	case zip.Deflate:
+		decompressed = flate.NewReader(decrypted)
+	default:
+		return nil, fmt.Errorf("encrypted member %s uses unsupported compression method %d", zf.Name, method)
+	}
+	checked := &checkedReader{ReadCloser: decompressed, want: zf.CRC32}
+	if checkCRC {
+		checked.hash = crc32.NewIEEE()
+	}
+	return checked, nil
+}
+
+// checkedReader returns errBadChecksum at EOF if the contents don't match the header's CRC-32,
+// and wraps every other read error in errGarbled
+type checkedReader struct {
+	io.ReadCloser
+	hash hash.Hash32 // nil if there's no CRC-32 to check
+	want uint32
+}
+
+func (r *checkedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	switch {
+	case err == io.EOF && r.hash != nil && r.hash.Sum32() != r.want:
+		return n, errBadChecksum
+	case err != nil && err != io.EOF && !errors.Is(err, errBadChecksum):
+		return n, fmt.Errorf("%w: %v", errGarbled, err)
+	}
+	return n, err
+}
+
+// zipCryptoKeys are the 3 keys of the traditional PKWARE stream cipher
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	return keys
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32Update(k[0], b)
+	k[1] = (k[1]+k[0]&0xff)*134775813 + 1
+	k[2] = crc32Update(k[2], byte(k[1]>>24))
+}
+
+func (k *zipCryptoKeys) decryptByte(c byte) byte {
+	temp := k[2] | 2
+	plain := c ^ byte((temp*(temp^1))>>8)
+	k.update(plain)
+	return plain
+}
+
+type zipCryptoReader struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+// newZipCryptoReader checks password against the 12 byte encryption header that starts r
+func newZipCryptoReader(r io.Reader, checkByte byte, password string) (io.Reader, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	keys := newZipCryptoKeys(password)
+	for i := range header {
+		header[i] = keys.decryptByte(header[i])
+	}
+	if header[11] != checkByte {
+		return nil, errWrongPassword
+	}
+	return &zipCryptoReader{r: r, keys: keys}, nil
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] = z.keys.decryptByte(p[i])
+	}
+	return n, err
+}
+
+// aesExtra is the WinZip AES extra field, which holds the real compression method
+type aesExtra struct {
+	version  uint16
+	strength byte // 1, 2 or 3 for AES-128, AES-192 or AES-256
+	method   uint16
+}
+
+func parseAESExtra(extra []byte) (aesExtra, error) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if tag != winzipAESTag || size < 7 {
+			continue
+		}
+		ae := aesExtra{version: binary.LittleEndian.Uint16(field), strength: field[4], method: binary.LittleEndian.Uint16(field[5:])}
+		if ae.strength < 1 || ae.strength > 3 {
+			return ae, fmt.Errorf("unknown WinZip AES strength %d", ae.strength)
+		}
+		return ae, nil
+	}
+	return aesExtra{}, errors.New("encrypted with AES but has no WinZip AES extra field")
+}
+
+const (
+	aesVerifierLen = 2
+	aesAuthCodeLen = 10
+	aesIterations  = 1000
+)
+
+// winzipAESReader decrypts AES-CTR with WinZip's little endian counter and checks the HMAC at EOF
+type winzipAESReader struct {
+	r         io.Reader // Limited to the encrypted data
+	authCode  io.Reader // What follows the encrypted data
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	used      int // Keystream bytes already used
+	mac       hash.Hash
+}
+
+func newWinzipAESReader(r io.Reader, compressedSize int64, strength byte, password string) (io.Reader, error) {
+	saltLen := 4*int(strength) + 4
+	keyLen := 8*int(strength) + 8
+	dataLen := compressedSize - int64(saltLen+aesVerifierLen+aesAuthCodeLen)
+	if dataLen < 0 {
+		return nil, errors.New("AES encrypted member is too short")
+	}
+	saltAndVerifier := make([]byte, saltLen+aesVerifierLen)
+	if _, err := io.ReadFull(r, saltAndVerifier); err != nil {
+		return nil, err
+	}
+	derived := pbkdf2SHA1([]byte(password), saltAndVerifier[:saltLen], aesIterations, 2*keyLen+aesVerifierLen)
+	if !hmac.Equal(derived[2*keyLen:], saltAndVerifier[saltLen:]) {
+		return nil, errWrongPassword
+	}
+	block, err := aes.NewCipher(derived[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return &winzipAESReader{
+		r:        io.LimitReader(r, dataLen),
+		authCode: r,
+		block:    block,
+		used:     aes.BlockSize,
+		mac:      hmac.New(sha1.New, derived[keyLen:2*keyLen]),
+	}, nil
+}
+
+func (w *winzipAESReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.mac.Write(p[:n])
+	for i := 0; i < n; i++ {
+		if w.used == aes.BlockSize {
+			// Increment the 128 bit little endian counter, which starts at 1
+			for j := range w.counter {
+				w.counter[j]++
+				if w.counter[j] != 0 {
+					break
+				}
+			}
+			w.block.Encrypt(w.keystream[:], w.counter[:])
+			w.used = 0
+		}
+		p[i] ^= w.keystream[w.used]
+		w.used++
+	}
+	if err == io.EOF {
+		authCode := make([]byte, aesAuthCodeLen)
+		if _, readErr := io.ReadFull(w.authCode, authCode); readErr != nil {
+			return n, readErr
+		}
+		if !hmac.Equal(w.mac.Sum(nil)[:aesAuthCodeLen], authCode) {
+			return n, errBadChecksum
+		}
+	}
+	return n, err
+}
+
+// pbkdf2SHA1 derives a key as in RFC 2898 with HMAC-SHA1, which WinZip AES uses
+func pbkdf2SHA1(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	derived := make([]byte, 0, keyLen+prf.Size())
+	for block := uint32(1); len(derived) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:keyLen]
+}
@@ -0,0 +1,100 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_pbkdf2SHA1(t *testing.T) {
+	// Test vectors from RFC 6070
+	tests := []struct {
+		name       string
+		iterations int
+		keyLen     int
+		want       string
+	}{
+		{"1 iteration", 1, 20, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"2 iterations", 2, 20, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"4096 iterations", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{"Longer than one block", 4096, 25, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password, salt := []byte("password"), []byte("salt")
+			if tt.keyLen == 25 {
+				password, salt = []byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt")
+			}
+			got := hex.EncodeToString(pbkdf2SHA1(password, salt, tt.iterations, tt.keyLen))
+			if got != tt.want {
+				t.Errorf("pbkdf2SHA1() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extractEncrypted(t *testing.T) {
+	// The fixtures were made with `zip -P infected` and bsdtar's zip:encryption option
+	capture := bytes.Repeat([]byte("hubcap password test\n"), 50)
+	tests := []struct {
+		name         string
+		fixture      string
+		passwords    []string
+		wantPassword string
+		wantLocked   bool
+	}{
+		{"ZipCrypto", "infected_zipcrypto.zip", []string{"wrong", "infected"}, "infected", false},
+		{"ZipCrypto with a data descriptor", "infected_stream.zip", []string{"infected"}, "infected", false},
+		// These wrong passwords get past the check byte and leave flate with garbage
+		{"ZipCrypto past the check byte", "infected_zipcrypto.zip", []string{"wrong531", "infected"}, "infected", false},
+		{"Data descriptor past the check byte", "infected_stream.zip", []string{"wrong58", "infected"}, "infected", false},
+		{"WinZip AES-256", "infected_aes256.zip", []string{"malware", "infected"}, "infected", false},
+		{"WinZip AES-128", "infected_aes128.zip", []string{"infected"}, "infected", false},
+		{"No passwords", "infected_zipcrypto.zip", nil, "", true},
+		{"Only wrong passwords", "infected_aes256.zip", []string{"malware", "virus"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "hubcap")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			contents, err := ioutil.ReadFile(filepath.Join("../test/files", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			archived := filepath.Join(dir, tt.fixture)
+			ioutil.WriteFile(archived, contents, 0644)
+			folder := StripArchiveExt(archived)
+			ex := newExtraction(archived, DefaultExtractLimits(), tt.passwords)
+			err = extractArchive(context.Background(), ex, archived, folder, 1)
+			var locked *LockedError
+			if errors.As(err, &locked) != tt.wantLocked {
+				t.Fatalf("extractArchive() error = %v, want locked %v", err, tt.wantLocked)
+			}
+			if tt.wantLocked {
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractArchive() error = %v", err)
+			}
+			if ex.opened[folder] != tt.wantPassword {
+				t.Errorf("extractArchive() opened with %q, want %q", ex.opened[folder], tt.wantPassword)
+			}
+			members, _ := filepath.Glob(filepath.Join(folder, "*"))
+			if len(members) == 0 {
+				t.Fatal("extractArchive() extracted nothing")
+			}
+			got, _ := ioutil.ReadFile(members[0])
+			if !bytes.Equal(got, capture) {
+				t.Errorf("extractArchive() decrypted %s to %q", filepath.Base(members[0]), got)
+			}
+		})
+	}
+}
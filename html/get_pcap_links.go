@@ -2,6 +2,7 @@
 package html
 
 import (
+	"context"
 	"fmt"
 	"html"
 	"io/ioutil"
@@ -64,11 +65,18 @@ func getPlCapPages(wg *sync.WaitGroup) []string {
 	return pageUrls
 }
 
-// GetWsBugzillaLinks gets wireshark bugzilla attachments, which are sequential, but not all are pcaps
-func GetWsBugzillaLinks(cachedLinks []string, allLinks map[string]string) {
+// GetWsBugzillaLinks gets wireshark bugzilla attachments, which are sequential, but not all are pcaps.
+// Scanning starts at attachment ID start and stops early if ctx is cancelled.
+// It returns the ID to resume scanning from on the next run.
+func GetWsBugzillaLinks(ctx context.Context, start int, cachedLinks []string, allLinks map[string]string) int {
+	var wg sync.WaitGroup
 	linkCache := LinkCache{Cache: make(map[string]string)}
 	idRe := regexp.MustCompile(`id=(.*?)(?:&|$)`)
-	index := 1
+	index := start
+	if index < 1 {
+		index = 1
+	}
+	lastID := 20000
 	numCached := 0
 	haveCachedAttachment := make([]bool, 20000)
 	for _, link := range cachedLinks {
@@ -82,10 +90,10 @@ func GetWsBugzillaLinks(cachedLinks []string, allLinks map[string]string) {
 			numCached++
 		}
 	}
-	done := make(chan bool)
-	backoff := make(chan bool)
+	done := make(chan int, 1)
+	backoff := make(chan bool, 1)
 	backoffSwitch := false
-	for index < 20000 {
+	for index < lastID {
 		if haveCachedAttachment[index] {
 			index++
 			continue
@@ -96,24 +104,36 @@ func GetWsBugzillaLinks(cachedLinks []string, allLinks map[string]string) {
 			backoffSwitch = false
 		}
 		select {
-		case <-done:
+		case <-ctx.Done():
+			fmt.Printf("\033[93mWARN\033[0m Stopping bugzilla scan at attachment %d\n", index)
+			lastID = index
+		case invalidID := <-done:
 			fmt.Printf("Waiting for %d goroutines to finish\n", runtime.NumGoroutine())
-			index = 20000 // Just hardcode to max for the time being
+			lastID = invalidID // New attachments will show up here on later runs
 		case <-backoff:
 			time.Sleep(time.Duration(1000) * time.Millisecond)
 			backoffSwitch = true
 		default:
-			go getBugzillaHTML(index, 200, &linkCache, backoff, done)
+			wg.Add(1)
+			go func(index int) {
+				getBugzillaHTML(index, 200, &linkCache, backoff, done)
+				wg.Done()
+			}(index)
 			time.Sleep(500 * time.Millisecond)
 			index++
 		}
 	}
+	wg.Wait()
 	for link, desc := range linkCache.Cache {
 		allLinks[link] = desc
 	}
+	if index < lastID {
+		return index
+	}
+	return lastID
 }
 
-func getBugzillaHTML(index int, delay int, linkCache *LinkCache, backoff chan<- bool, done chan<- bool) {
+func getBugzillaHTML(index int, delay int, linkCache *LinkCache, backoff chan<- bool, done chan<- int) {
 	var description, filename string
 	baseURL := "https://bugs.wireshark.org/bugzilla/attachment.cgi?id="
 	descRe := regexp.MustCompile(`<title>([\s\S]*?)<\/title>(?:[\s\S]*?<div class=\"details\">(.*?) \()?`)
@@ -131,7 +151,10 @@ func getBugzillaHTML(index int, delay int, linkCache *LinkCache, backoff chan<-
 	case "Invalid Attachment ID": // Quit once attachment number is invalid
 		fmt.Printf("\033[93mWARN\033[0m Invalid Attachment ID found for %s. Skipping...\n", baseURL+indexStr)
 		if index != 15252 && index != 15253 { // Weird invalid attachments in middle of list, not at end
-			done <- true
+			select {
+			case done <- index:
+			default: // The scan is already stopping
+			}
 		}
 	case "Authorization Required": // Skip pulling files that don't exist
 		fmt.Printf("\033[93mWARN\033[0m Authorization Required for viewing %s. Skipping...\n", baseURL+indexStr)
@@ -142,7 +165,10 @@ func getBugzillaHTML(index int, delay int, linkCache *LinkCache, backoff chan<-
 		rand.New(rand.NewSource(time.Now().UnixNano()))
 		newDelay := delay*4 + rand.Int()%2000
 		fmt.Println("\033[93mWARN\033[0m ", indexStr+": SSL handshake failed. Retrying in", newDelay, "ms")
-		backoff <- true
+		select {
+		case backoff <- true:
+		default: // A backoff is already pending
+		}
 	default:
 		filename = attachmentDetails[0][2]
 		filename = strings.Replace(filename, " ", "_", -1)
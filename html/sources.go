@@ -0,0 +1,36 @@
+package html
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SourceName returns the short name of the site a link is from, which is also its .cache/ folder
+func SourceName(link string) string {
+	switch {
+	case strings.Contains(link, "wiki.wireshark.org"):
+		return "wireshark_wiki"
+	case strings.Contains(link, "packetlife.net"):
+		return "packetlife"
+	case strings.Contains(link, "bugs.wireshark.org"):
+		return "wireshark_bugs"
+	}
+	return "unknown"
+}
+
+// LinkTitle returns the name that a source page gives a capture, which is the filename in its link
+func LinkTitle(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	query := parsed.Query()
+	// Wiki attachments are named by target and bugzilla attachments by the name hubcap appends
+	for _, key := range []string{"target", "name"} {
+		if title := query.Get(key); title != "" {
+			return title
+		}
+	}
+	return path.Base(parsed.Path)
+}
@@ -0,0 +1,26 @@
+package html
+
+import "testing"
+
+func TestLinkTitle(t *testing.T) {
+	tests := []struct {
+		name       string
+		link       string
+		wantTitle  string
+		wantSource string
+	}{
+		{"Wiki", "https://wiki.wireshark.org/SampleCaptures?action=AttachFile&do=get&target=sip%20call.pcap", "sip call.pcap", "wireshark_wiki"},
+		{"Packetlife", "http://packetlife.net/captures/802.1Q.cap", "802.1Q.cap", "packetlife"},
+		{"Bugzilla", "https://bugs.wireshark.org/bugzilla/attachment.cgi?id=123&name=dhcp.pcapng", "dhcp.pcapng", "wireshark_bugs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LinkTitle(tt.link); got != tt.wantTitle {
+				t.Errorf("LinkTitle() = %v, want %v", got, tt.wantTitle)
+			}
+			if got := SourceName(tt.link); got != tt.wantSource {
+				t.Errorf("SourceName() = %v, want %v", got, tt.wantSource)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package mutexmap
+
+import (
+	"path"
+	"strings"
+)
+
+// Types of archive members
+const (
+	MemberPcap    = "pcap"
+	MemberArchive = "archive"
+	MemberKeylog  = "keylog" // TLS keylog (SSLKEYLOGFILE) or premaster secrets
+	MemberRSAKey  = "rsakey" // PEM private key
+	MemberESPSA   = "esp_sa" // Wireshark's table of IPsec security associations
+	MemberText    = "text"
+	MemberOther   = "other"
+)
+
+// IsSecret returns whether members of this type can decrypt captures
+func IsSecret(memberType string) bool {
+	return memberType == MemberKeylog || memberType == MemberRSAKey || memberType == MemberESPSA
+}
+
+// Secret is a copy of a file that can decrypt a capture, kept in .cache/secrets/<capture sha256>/
+type Secret struct {
+	Type     string // MemberKeylog, MemberRSAKey or MemberESPSA
+	Filename string // Relative to the project root
+	SHA256   string
+	From     string // Where in the archive it came from
+}
+
+// ArchiveManifest lists everything that a downloaded archive contained
+type ArchiveManifest struct {
+	SHA256   string
+	Filename string // What the archive was downloaded as
+	Size     int64
+	Sources  []string
+	Members  []ArchiveMember
+}
+
+// ArchiveMember is one file that came out of an archive
+type ArchiveMember struct {
+	Path     string // Where in the archive it is, like outer.zip!/inner.tgz!/a.pcapng
+	Filename string `json:",omitempty"` // Where it was extracted to, relative to the project root. Empty for nested archives.
+	SHA256   string
+	Size     int64
+	Type     string // One of the Member* constants
+	Password string `json:",omitempty"` // What opened the encrypted archive it came from
+}
+
+// Member returns the member at archivePath
+func (m *ArchiveManifest) Member(archivePath string) (ArchiveMember, bool) {
+	for _, member := range m.Members {
+		if member.Path == archivePath {
+			return member, true
+		}
+	}
+	return ArchiveMember{}, false
+}
+
+// Siblings returns the files that shipped with the capture at archivePath, like keylogs and READMEs.
+// These are the members that aren't captures or archives in its folder or any folder above it.
+func (m *ArchiveManifest) Siblings(archivePath string) []ArchiveMember {
+	captureDir := path.Dir(archivePath)
+	siblings := make([]ArchiveMember, 0)
+	for _, member := range m.Members {
+		if member.Type == MemberPcap || member.Type == MemberArchive {
+			continue
+		}
+		memberDir := path.Dir(member.Path)
+		if memberDir == captureDir || strings.HasPrefix(captureDir, memberDir+"/") {
+			siblings = append(siblings, member)
+		}
+	}
+	if len(siblings) == 0 {
+		return nil
+	}
+	return siblings
+}
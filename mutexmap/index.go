@@ -0,0 +1,157 @@
+package mutexmap
+
+import (
+	"sort"
+	"strings"
+)
+
+// CaptureEndpoints counts the packets of a capture with each endpoint, by kind and then value.
+// Kinds are ip, mac, domain and port.
+type CaptureEndpoints map[string]map[string]int
+
+// EndpointStore maps capture hashes to their endpoints as captures are analyzed
+type EndpointStore = Store[string, CaptureEndpoints]
+
+// NewEndpointStore is the EndpointStore constructor. Analyzing a capture again replaces its endpoints.
+func NewEndpointStore() *EndpointStore {
+	return NewStore[string, CaptureEndpoints](cloneEndpoints, func(old CaptureEndpoints, addend CaptureEndpoints) CaptureEndpoints {
+		return addend
+	})
+}
+
+func cloneEndpoints(endpoints CaptureEndpoints) CaptureEndpoints {
+	clone := make(CaptureEndpoints, len(endpoints))
+	for kind, counts := range endpoints {
+		clone[kind] = cloneCounts(counts)
+	}
+	return clone
+}
+
+// Index is the inverted form of an EndpointStore. It maps keys like ip:8.8.8.8 or port:47808 to the
+// hashes of the captures with that endpoint and how many of their packets have it.
+type Index map[string]map[string]int
+
+// IndexTerm is an endpoint to look up. Domains starting with *. match every subdomain.
+type IndexTerm struct {
+	Kind  string
+	Value string
+}
+
+func (term IndexTerm) String() string {
+	return IndexKey(term.Kind, term.Value)
+}
+
+// IndexMatch is a capture that has every term of a query
+type IndexMatch struct {
+	Hash     string
+	Filename string         `json:",omitempty"`
+	Packets  int            // Packets with any of the terms, counted once for each term
+	Counts   map[string]int // Packets with each term
+}
+
+// IndexKey is how an endpoint is keyed in an Index
+func IndexKey(kind string, value string) string {
+	return kind + ":" + value
+}
+
+// NewIndex inverts the endpoints of captures, which are keyed by hash
+func NewIndex(captures map[string]CaptureEndpoints) Index {
+	index := make(Index)
+	for hash, endpoints := range captures {
+		for kind, counts := range endpoints {
+			for value, count := range counts {
+				key := IndexKey(kind, value)
+				if index[key] == nil {
+					index[key] = make(map[string]int)
+				}
+				index[key][hash] = count
+			}
+		}
+	}
+	return index
+}
+
+// Captures turns an Index back into the endpoints of each capture, keeping only those of hashes that keep returns true for
+func (index Index) Captures(keep func(hash string) bool) map[string]CaptureEndpoints {
+	captures := make(map[string]CaptureEndpoints)
+	for key, postings := range index {
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for hash, count := range postings {
+			if !keep(hash) {
+				continue
+			}
+			if captures[hash] == nil {
+				captures[hash] = make(CaptureEndpoints)
+			}
+			if captures[hash][parts[0]] == nil {
+				captures[hash][parts[0]] = make(map[string]int)
+			}
+			captures[hash][parts[0]][parts[1]] = count
+		}
+	}
+	return captures
+}
+
+// Lookup returns the captures with an endpoint and how many of their packets have it
+func (index Index) Lookup(term IndexTerm) map[string]int {
+	if !strings.HasPrefix(term.Value, "*.") {
+		return index[term.String()]
+	}
+	// Subdomains are summed, so a capture with a.example.com and b.example.com counts both
+	prefix, suffix := term.Kind+":", term.Value[1:]
+	found := make(map[string]int)
+	for key, postings := range index {
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) {
+			for hash, count := range postings {
+				found[hash] += count
+			}
+		}
+	}
+	return found
+}
+
+// Query returns the captures that have every term, with the most packets first
+func (index Index) Query(terms []IndexTerm) []IndexMatch {
+	matches := make([]IndexMatch, 0)
+	if len(terms) == 0 {
+		return matches
+	}
+	// A term given twice is one count, so it would never add up to len(terms)
+	unique := make([]IndexTerm, 0, len(terms))
+	seen := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		if !seen[term.String()] {
+			seen[term.String()] = true
+			unique = append(unique, term)
+		}
+	}
+	terms = unique
+	found := make([]map[string]int, len(terms))
+	for i, term := range terms {
+		found[i] = index.Lookup(term)
+	}
+	for hash := range found[0] {
+		match := IndexMatch{Hash: hash, Counts: make(map[string]int, len(terms))}
+		for i, term := range terms {
+			count, ok := found[i][hash]
+			if !ok {
+				break
+			}
+			match.Counts[term.String()] = count
+			match.Packets += count
+		}
+		if len(match.Counts) == len(terms) {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Packets != matches[j].Packets {
+			return matches[i].Packets > matches[j].Packets
+		}
+		return matches[i].Hash < matches[j].Hash
+	})
+	return matches
+}
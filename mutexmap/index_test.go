@@ -0,0 +1,51 @@
+package mutexmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestIndexQuery tests that queries find the captures with every term
+func TestIndexQuery(t *testing.T) {
+	store := NewEndpointStore()
+	store.Merge("a", CaptureEndpoints{"ip": {"8.8.8.8": 4, "10.0.0.1": 4}, "port": {"53": 4}, "domain": {"www.example.com": 2}})
+	store.Merge("b", CaptureEndpoints{"ip": {"8.8.8.8": 1}, "port": {"47808": 9}})
+	store.Merge("c", CaptureEndpoints{"ip": {"8.8.8.8": 7}, "domain": {"mail.example.com": 1, "example.org": 3}})
+	// Analyzing a capture again replaces its endpoints
+	store.Merge("c", CaptureEndpoints{"ip": {"8.8.8.8": 2}, "domain": {"mail.example.com": 1, "example.org": 3}})
+	index := NewIndex(store.Snapshot())
+	tests := []struct {
+		name  string
+		terms []IndexTerm
+		want  []IndexMatch
+	}{
+		{"One term", []IndexTerm{{"ip", "8.8.8.8"}}, []IndexMatch{
+			{Hash: "a", Packets: 4, Counts: map[string]int{"ip:8.8.8.8": 4}},
+			{Hash: "c", Packets: 2, Counts: map[string]int{"ip:8.8.8.8": 2}},
+			{Hash: "b", Packets: 1, Counts: map[string]int{"ip:8.8.8.8": 1}}}},
+		{"Every term", []IndexTerm{{"ip", "8.8.8.8"}, {"port", "47808"}}, []IndexMatch{
+			{Hash: "b", Packets: 10, Counts: map[string]int{"ip:8.8.8.8": 1, "port:47808": 9}}}},
+		{"Repeated term", []IndexTerm{{"port", "47808"}, {"port", "47808"}}, []IndexMatch{
+			{Hash: "b", Packets: 9, Counts: map[string]int{"port:47808": 9}}}},
+		{"Subdomains", []IndexTerm{{"domain", "*.example.com"}}, []IndexMatch{
+			{Hash: "a", Packets: 2, Counts: map[string]int{"domain:*.example.com": 2}},
+			{Hash: "c", Packets: 1, Counts: map[string]int{"domain:*.example.com": 1}}}},
+		{"No match", []IndexTerm{{"mac", "aa:bb:cc:dd:ee:ff"}}, []IndexMatch{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := index.Query(tt.terms); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Resuming from a saved index keeps only the captures still in captures.json
+	captures := index.Captures(func(hash string) bool { return hash != "b" })
+	want := map[string]CaptureEndpoints{
+		"a": {"ip": {"8.8.8.8": 4, "10.0.0.1": 4}, "port": {"53": 4}, "domain": {"www.example.com": 2}},
+		"c": {"ip": {"8.8.8.8": 2}, "domain": {"mail.example.com": 1, "example.org": 3}},
+	}
+	if !reflect.DeepEqual(captures, want) {
+		t.Errorf("Captures() = %v, want %v", captures, want)
+	}
+}
@@ -2,8 +2,7 @@
 package mutexmap
 
 import (
-	"reflect"
-	"sync"
+	"sort"
 )
 
 // PcapInfo stores info about an individual pcap
@@ -15,56 +14,416 @@ type PcapInfo struct {
 	Protocols   []string
 	Ports       map[string][]int
 	ErrorStr    string
+	Format      string `json:",omitempty"` // Format found from the file header, like pcap, pcapng or erf
+	Endianness  string `json:",omitempty"` // Byte order of the capture's headers, big or little
+	Precision   string `json:",omitempty"` // Timestamp precision like us or ns
+	Discarded   bool   `json:",omitempty"` // Capture bytes were deleted after analysis
+	ArchivePath string `json:",omitempty"` // Where in a downloaded archive this came from, like outer.zip!/inner.tgz!/a.pcapng
+	// ArchivePassword opened the encrypted archive this came from
+	ArchivePassword string `json:",omitempty"`
+	// Archive is the SHA256 of the download this came from. Its manifest is .cache/archives/<Archive>.json.
+	Archive  string          `json:",omitempty"`
+	Siblings []ArchiveMember `json:",omitempty"` // Files that shipped next to this capture
+	Secrets  []Secret        `json:",omitempty"` // Siblings that tshark was given to decrypt this capture
+	// Decryptable is set when the secrets revealed protocols. Protocols and Ports are then of the decrypted capture.
+	Decryptable bool `json:",omitempty"`
+	// Descriptions has what every source says about this file. Description is the primary one.
+	Descriptions []SourceInfo `json:",omitempty"`
+	Failures     []Failure    `json:",omitempty"` // Why links in an ->Error: bucket failed
+	Repair       *Repair      `json:",omitempty"` // Set when a damaged capture was repaired into a copy
+	// Versions of the Wireshark tools that analyzed this capture
+	TsharkVersion   string `json:",omitempty"`
+	CapinfosVersion string `json:",omitempty"`
+	// ProtocolFrames counts frames by protocol stack, like eth:ip:tcp
+	ProtocolFrames map[string]int `json:",omitempty"`
+	Conversations  map[string]int `json:",omitempty"` // TCP and UDP conversations by protocol
+	// Sample is set when the capture was too large to dissect fully. Capinfos is of every packet,
+	// while Protocols, Ports, ProtocolFrames and Conversations are of the sample.
+	Sample  *Sample  `json:",omitempty"`
+	Quality *Quality `json:",omitempty"` // How clean the capture is, with a score to sort by
+	// Pcapng has the comments and interface options of a pcapng file, which capinfos leaves out
+	Pcapng *PcapngInfo `json:",omitempty"`
+	// Tags are topics from the tag rules, like voip or ics-scada, for browsing by category
+	Tags []string `json:",omitempty"`
 }
 
-// DataStore is the container for a map
-// Taken from https://hackernoon.com/dancing-with-go-s-mutexes-92407ae927bf
-// Assumes that a map has concurrent writes but serial reads
-type DataStore struct {
-	sync.Mutex // ← this mutex protects the cache below
-	Cache      map[string]PcapInfo
+// Which copy of a repaired capture an entry is about
+const (
+	ServeOriginal = "original"
+	ServeRepaired = "repaired"
+)
+
+// Repair describes the repaired copy that was written next to a damaged capture
+type Repair struct {
+	Original       string // Filename of the capture as downloaded
+	OriginalSHA256 string
+	Repaired       string // Filename of the repaired copy
+	RepairedSHA256 string
+	Served         string   // ServeOriginal or ServeRepaired, for the copy the entry's hash, Filename and analysis are of
+	Fixes          []string // Like TruncatedPacket, BadBlockLength or OutOfOrder
+	Packets        int      // Packets recovered into the repaired copy
+	Skipped        int64    // Bytes of damaged records that were left out
+}
+
+// Sample describes how a large capture was sampled
+type Sample struct {
+	Mode       string // head, packets or time
+	Packets    int    // Packets a sample was asked to have
+	MaxSize    int64  `json:",omitempty"` // Size limit that captures are sampled over
+	MaxPackets int    `json:",omitempty"` // Packet limit that captures are sampled over
+	Analyzed   int    // Packets that were dissected
+	Total      int    // Packets in the capture, or -1 if they couldn't be counted
+}
+
+// Quality says how clean a capture is. Drops and Duplicates are of every packet of the file,
+// while the rest are of the packets that were dissected, which are those of Sample if it's set.
+type Quality struct {
+	Packets            int
+	Drops              int64 // Packets that interfaces or the OS dropped, from pcapng interface statistics
+	Duplicates         int   // Packets identical to one of the 5 before them
+	Truncated          int   // Packets cut short by the snaplen
+	TCPSegments        int
+	Retransmissions    int
+	LostSegments       int
+	OutOfOrder         int
+	BackwardTimestamps int // Packets timestamped before the packet before them
+	ZeroTimestamps     int
+	FutureTimestamps   int
+	Score              float64 // From 0 to 100, where 100 is a capture with none of these problems
+}
+
+// PcapngInfo is what a pcapng file says about itself in comments and options
+type PcapngInfo struct {
+	SectionComments []string           `json:",omitempty"`
+	PacketComments  []PacketComment    `json:",omitempty"` // The first 1000
+	Interfaces      []InterfaceOptions `json:",omitempty"` // In the order of their interface IDs
+	NameResolution  []NameRecord       `json:",omitempty"` // Names from name resolution blocks, the first 1000
+	// DecryptionSecrets counts the decryption secrets blocks of each kind, like TLS key log
+	DecryptionSecrets map[string]int `json:",omitempty"`
+}
+
+// PacketComment is a comment on a packet, like those added in Wireshark
+type PacketComment struct {
+	Frame   int // Like tshark's frame.number
+	Comment string
+}
+
+// InterfaceOptions are the options of an interface that capinfos doesn't show
+type InterfaceOptions struct {
+	Name        string   `json:",omitempty"`
+	Description string   `json:",omitempty"`
+	Filter      string   `json:",omitempty"` // Capture filter, like tcp port 80
+	Speed       uint64   `json:",omitempty"` // Bits per second
+	TSOffset    int64    `json:",omitempty"` // Seconds added to every timestamp of the interface
+	Comments    []string `json:",omitempty"`
 }
 
-// NewDS is the DataStore constructor
-func NewDS() *DataStore {
-	return &DataStore{
-		Cache: make(map[string]PcapInfo),
+// NameRecord is an address and the names a name resolution block gives it
+type NameRecord struct {
+	Address string
+	Names   []string
+}
+
+// Comments returns every comment of a pcapng file, section comments first
+func (p *PcapngInfo) Comments() []string {
+	if p == nil {
+		return nil
+	}
+	comments := append([]string(nil), p.SectionComments...)
+	for _, iface := range p.Interfaces {
+		comments = append(comments, iface.Comments...)
 	}
+	for _, pc := range p.PacketComments {
+		comments = append(comments, pc.Comment)
+	}
+	return comments
+}
+
+// Failure records why one link could not be analyzed
+type Failure struct {
+	Link     string
+	Category string // Like PathTraversal or CompressionRatio
+	Detail   string
+}
+
+// SourceInfo is what one source page says about a capture
+type SourceInfo struct {
+	Source      string // Like packetlife, wireshark_wiki or wireshark_bugs
+	Link        string
+	Title       string
+	Description string
+}
+
+// sourcePriority ranks sources for the primary description. Curated pages beat bug attachments.
+var sourcePriority = map[string]int{
+	"wireshark_wiki": 0,
+	"packetlife":     1,
+	"wireshark_bugs": 2,
 }
 
-// Set a set of strings for a key
-func (ds *DataStore) Set(hash string, pi *PcapInfo) {
-	ds.Lock()
-	defer ds.Unlock()
-	// If the file has already been analyzed (by hash), add the link so that hubcap does not redownload/reanalyze this file
-	_, hashInCache := ds.Cache[hash]
-	if hashInCache {
-		if reflect.DeepEqual(ds.Cache[hash].Sources, pi.Sources) {
-			return // If two PcapInfos are completely equal, adding to cache is a waste
+// PcapStore maps file hashes (or ->Error: buckets) to what is known about them
+type PcapStore = Store[string, PcapInfo]
+
+// NewPcapStore is the PcapStore constructor
+func NewPcapStore() *PcapStore {
+	return NewStore[string, PcapInfo](ClonePcapInfo, MergePcapInfo)
+}
+
+// ClonePcapInfo deep copies a PcapInfo so that the copy shares no slices or maps with the original
+func ClonePcapInfo(pi PcapInfo) PcapInfo {
+	clone := pi
+	if pi.Sources != nil {
+		clone.Sources = append([]string(nil), pi.Sources...)
+	}
+	if pi.Descriptions != nil {
+		clone.Descriptions = append([]SourceInfo(nil), pi.Descriptions...)
+	}
+	if pi.Siblings != nil {
+		clone.Siblings = append([]ArchiveMember(nil), pi.Siblings...)
+	}
+	if pi.Secrets != nil {
+		clone.Secrets = append([]Secret(nil), pi.Secrets...)
+	}
+	if pi.Failures != nil {
+		clone.Failures = append([]Failure(nil), pi.Failures...)
+	}
+	if pi.Repair != nil {
+		repair := *pi.Repair
+		repair.Fixes = append([]string(nil), pi.Repair.Fixes...)
+		clone.Repair = &repair
+	}
+	if pi.Sample != nil {
+		sample := *pi.Sample
+		clone.Sample = &sample
+	}
+	if pi.Quality != nil {
+		quality := *pi.Quality
+		clone.Quality = &quality
+	}
+	if pi.Pcapng != nil {
+		clone.Pcapng = clonePcapngInfo(pi.Pcapng)
+	}
+	if pi.Protocols != nil {
+		clone.Protocols = append([]string(nil), pi.Protocols...)
+	}
+	if pi.Tags != nil {
+		clone.Tags = append([]string(nil), pi.Tags...)
+	}
+	if pi.Capinfos != nil {
+		clone.Capinfos = cloneJSONMap(pi.Capinfos)
+	}
+	if pi.Ports != nil {
+		clone.Ports = make(map[string][]int, len(pi.Ports))
+		for k, v := range pi.Ports {
+			clone.Ports[k] = append([]int(nil), v...)
 		}
-		ds.addSources(hash, pi.Sources)
+	}
+	if pi.ProtocolFrames != nil {
+		clone.ProtocolFrames = cloneCounts(pi.ProtocolFrames)
+	}
+	if pi.Conversations != nil {
+		clone.Conversations = cloneCounts(pi.Conversations)
+	}
+	return clone
+}
+
+func clonePcapngInfo(p *PcapngInfo) *PcapngInfo {
+	clone := *p
+	clone.SectionComments = append([]string(nil), p.SectionComments...)
+	clone.PacketComments = append([]PacketComment(nil), p.PacketComments...)
+	clone.Interfaces = nil
+	for _, iface := range p.Interfaces {
+		iface.Comments = append([]string(nil), iface.Comments...)
+		clone.Interfaces = append(clone.Interfaces, iface)
+	}
+	clone.NameResolution = nil
+	for _, record := range p.NameResolution {
+		clone.NameResolution = append(clone.NameResolution, NameRecord{record.Address, append([]string(nil), record.Names...)})
+	}
+	if p.DecryptionSecrets != nil {
+		clone.DecryptionSecrets = cloneCounts(p.DecryptionSecrets)
+	}
+	return &clone
+}
+
+func cloneCounts(m map[string]int) map[string]int {
+	clone := make(map[string]int, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// cloneJSONMap copies the nested maps and slices that encoding/json produces
+func cloneJSONMap(m map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		clone[k] = cloneJSONValue(v)
+	}
+	return clone
+}
+
+func cloneJSONValue(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		return cloneJSONMap(typed)
+	case []interface{}:
+		clone := make([]interface{}, len(typed))
+		for i, elem := range typed {
+			clone[i] = cloneJSONValue(elem)
+		}
+		return clone
+	default:
+		return v
+	}
+}
+
+// MergePcapInfo combines two PcapInfos stored under the same hash.
+// Sources are a set. The result does not depend on which PcapInfo arrived first.
+func MergePcapInfo(old PcapInfo, addend PcapInfo) PcapInfo {
+	merged := old
+	// Prefer the analysis of a file still on disk, then the lowest filename so that merges are deterministic
+	if hasAnalysis(addend) && (!hasAnalysis(old) || preferFile(addend, old)) {
+		merged = addend
+	}
+	merged.Sources = mergeSources(old.Sources, addend.Sources)
+	merged.Descriptions = mergeSourceInfos(old.Descriptions, addend.Descriptions)
+	if len(merged.Descriptions) > 0 {
+		merged.Description = merged.Descriptions[0].Description
 	} else {
-		ds.Cache[hash] = *pi
+		merged.Description = mergeDescription(old.Description, addend.Description)
 	}
+	merged.Failures = mergeFailures(old.Failures, addend.Failures)
+	return merged
 }
 
-// DeleteFilename removes redundant capinfos filename
-func (ds *DataStore) DeleteFilename(hash string, pi *PcapInfo) {
-	ds.Lock()
-	defer ds.Unlock()
-	delete(ds.Cache[hash].Capinfos, "FileName")
+// mergeFailures returns the sorted union of two lists of failures
+func mergeFailures(a []Failure, b []Failure) []Failure {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	seen := make(map[Failure]bool, len(a)+len(b))
+	merged := make([]Failure, 0, len(a)+len(b))
+	for _, list := range [][]Failure{a, b} {
+		for _, f := range list {
+			if !seen[f] {
+				seen[f] = true
+				merged = append(merged, f)
+			}
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].Link != merged[j].Link {
+			return merged[i].Link < merged[j].Link
+		}
+		if merged[i].Category != merged[j].Category {
+			return merged[i].Category < merged[j].Category
+		}
+		return merged[i].Detail < merged[j].Detail
+	})
+	return merged
 }
 
-// Add links to datastore object
-func (ds *DataStore) addSources(hash string, addend []string) {
-	temp := PcapInfo{
-		Filename:    ds.Cache[hash].Filename,
-		Sources:     append(ds.Cache[hash].Sources, addend...),
-		Description: ds.Cache[hash].Description,
-		Capinfos:    ds.Cache[hash].Capinfos,
-		Protocols:   ds.Cache[hash].Protocols,
-		Ports:       ds.Cache[hash].Ports,
-		ErrorStr:    ds.Cache[hash].ErrorStr,
+// mergeSourceInfos returns the union of two lists, one per link, with the primary description first
+func mergeSourceInfos(a []SourceInfo, b []SourceInfo) []SourceInfo {
+	if len(a)+len(b) == 0 {
+		return nil
 	}
-	ds.Cache[hash] = temp
+	byLink := make(map[string]SourceInfo, len(a)+len(b))
+	for _, list := range [][]SourceInfo{a, b} {
+		for _, si := range list {
+			if existing, ok := byLink[si.Link]; ok {
+				si.Description = mergeDescription(existing.Description, si.Description)
+				if si.Title == "" {
+					si.Title = existing.Title
+				}
+			}
+			byLink[si.Link] = si
+		}
+	}
+	merged := make([]SourceInfo, 0, len(byLink))
+	for _, si := range byLink {
+		merged = append(merged, si)
+	}
+	SortSourceInfos(merged)
+	return merged
+}
+
+// SortSourceInfos orders descriptions so that the primary one is first.
+// Real descriptions beat placeholders, then sources are ranked by sourcePriority,
+// then longer descriptions win and ties go to the alphabetically first link.
+func SortSourceInfos(infos []SourceInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if aEmpty, bEmpty := isPlaceholderDesc(a.Description), isPlaceholderDesc(b.Description); aEmpty != bEmpty {
+			return bEmpty
+		}
+		if aRank, bRank := rankSource(a.Source), rankSource(b.Source); aRank != bRank {
+			return aRank < bRank
+		}
+		if len(a.Description) != len(b.Description) {
+			return len(a.Description) > len(b.Description)
+		}
+		return a.Link < b.Link
+	})
+}
+
+func rankSource(source string) int {
+	if rank, ok := sourcePriority[source]; ok {
+		return rank
+	}
+	return len(sourcePriority)
+}
+
+func hasAnalysis(pi PcapInfo) bool {
+	return pi.Capinfos != nil || pi.Protocols != nil
+}
+
+// preferFile returns whether a's file should be kept over b's
+func preferFile(a PcapInfo, b PcapInfo) bool {
+	if a.Discarded != b.Discarded {
+		return !a.Discarded
+	}
+	return a.Filename < b.Filename
+}
+
+// mergeSources returns the sorted union of two source lists
+func mergeSources(a []string, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	merged := make([]string, 0, len(a)+len(b))
+	for _, list := range [][]string{a, b} {
+		for _, source := range list {
+			if !seen[source] {
+				seen[source] = true
+				merged = append(merged, source)
+			}
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// mergeDescription picks a description: real ones over placeholders, then longer, then alphabetically first
+func mergeDescription(a string, b string) string {
+	aEmpty, bEmpty := isPlaceholderDesc(a), isPlaceholderDesc(b)
+	switch {
+	case aEmpty != bEmpty:
+		if aEmpty {
+			return b
+		}
+		return a
+	case len(a) != len(b):
+		if len(a) > len(b) {
+			return a
+		}
+		return b
+	case a < b:
+		return a
+	default:
+		return b
+	}
+}
+
+func isPlaceholderDesc(desc string) bool {
+	return desc == "" || desc == "No Description"
 }
@@ -0,0 +1,395 @@
+package mutexmap
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Fields of captures that TextIndex searches
+const (
+	FieldDesc    = "desc"    // What sources say about a capture
+	FieldTitle   = "title"   // Titles of source pages, like bug titles
+	FieldComment = "comment" // Section, interface and packet comments of pcapng files
+	FieldFile    = "file"    // Filename and where in an archive it was
+	FieldProto   = "proto"   // Protocol names, matched whole
+	FieldSource  = "source"  // Names of sources, like wireshark_bugs
+	FieldTag     = "tag"     // Tags from the tag rules, like voip
+)
+
+// searchFieldWeights scale the scores of matches in each field
+var searchFieldWeights = map[string]float64{FieldDesc: 1, FieldTitle: 2, FieldFile: 1.5, FieldProto: 1.5, FieldSource: 0.5, FieldTag: 1, FieldComment: 1}
+
+// defaultSearchFields are searched by terms that don't name a field
+var defaultSearchFields = []string{FieldDesc, FieldTitle, FieldComment, FieldFile, FieldProto}
+
+// snippetFields are where snippets come from, most useful first
+var snippetFields = []string{FieldDesc, FieldTitle, FieldComment, FieldFile, FieldProto}
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// snippetLen is about how many bytes of a long text a snippet has
+const snippetLen = 200
+
+// textToken is a word of a field, with where it is in the field's values
+type textToken struct {
+	term       string
+	value      int // Which of the field's values it's in
+	start, end int // Byte offsets in the value
+}
+
+// textDoc is one capture's fields
+type textDoc struct {
+	hash     string
+	filename string
+	values   map[string][]string    // The text of each field
+	tokens   map[string][]textToken // The words of each field in order
+}
+
+// TextIndex is a full-text index of what's known about captures, ranked with BM25
+type TextIndex struct {
+	docs     []textDoc
+	postings map[string]map[string][]int // Field to term to the docs with it, in order
+	avgLen   map[string]float64          // Average words of each field
+}
+
+// SearchResult is a capture that matched a search
+type SearchResult struct {
+	Hash     string
+	Filename string
+	Score    float64
+	// Snippet is HTML of where the capture matched, with matches in <mark>
+	Snippet      string `json:",omitempty"`
+	SnippetField string `json:",omitempty"`
+}
+
+// searchClause is one part of a query, like sip, -rtp, "call transfer" or desc:"call transfer"
+type searchClause struct {
+	field  string // Empty for defaultSearchFields
+	words  []string
+	negate bool
+}
+
+// tokenize splits text into lowercase words of letters and digits
+func tokenize(text string) []textToken {
+	tokens := make([]textToken, 0)
+	start := -1
+	for i, r := range text + " " {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, textToken{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// analyze turns a word into how it's indexed in a field. Only prose is stemmed.
+func analyze(field string, word string) string {
+	if field == FieldDesc || field == FieldTitle || field == FieldComment {
+		return stem(word)
+	}
+	return word
+}
+
+// NewTextIndex indexes the captures of a captures.json, leaving out error buckets
+func NewTextIndex(captures map[string]PcapInfo) *TextIndex {
+	hashes := make([]string, 0, len(captures))
+	for hash := range captures {
+		if !strings.HasPrefix(hash, "->") {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	index := &TextIndex{postings: make(map[string]map[string][]int), avgLen: make(map[string]float64)}
+	for field := range searchFieldWeights {
+		index.postings[field] = make(map[string][]int)
+	}
+	for i, hash := range hashes {
+		doc := newTextDoc(hash, captures[hash])
+		for field, tokens := range doc.tokens {
+			index.avgLen[field] += float64(len(tokens))
+			for _, token := range tokens {
+				docs := index.postings[field][token.term]
+				if len(docs) == 0 || docs[len(docs)-1] != i {
+					index.postings[field][token.term] = append(docs, i)
+				}
+			}
+		}
+		index.docs = append(index.docs, doc)
+	}
+	for field := range index.avgLen {
+		index.avgLen[field] /= float64(len(index.docs))
+	}
+	return index
+}
+
+func newTextDoc(hash string, pi PcapInfo) textDoc {
+	doc := textDoc{hash: hash, filename: pi.Filename, values: make(map[string][]string), tokens: make(map[string][]textToken)}
+	descs := []string{pi.Description}
+	titles := make([]string, 0, len(pi.Descriptions))
+	sources := make([]string, 0, len(pi.Descriptions))
+	for _, si := range pi.Descriptions {
+		if si.Description != pi.Description {
+			descs = append(descs, si.Description)
+		}
+		titles = append(titles, si.Title)
+		sources = append(sources, si.Source)
+	}
+	files := []string{path.Base(pi.Filename)}
+	if pi.ArchivePath != "" {
+		files = append(files, pi.ArchivePath)
+	}
+	for field, values := range map[string][]string{FieldDesc: descs, FieldTitle: titles, FieldFile: files,
+		FieldProto: pi.Protocols, FieldSource: sources, FieldTag: pi.Tags, FieldComment: pi.Pcapng.Comments()} {
+		for _, value := range values {
+			if isPlaceholderDesc(value) {
+				continue
+			}
+			for _, token := range tokenize(value) {
+				token.term = analyze(field, token.term)
+				token.value = len(doc.values[field])
+				doc.tokens[field] = append(doc.tokens[field], token)
+			}
+			doc.values[field] = append(doc.values[field], value)
+		}
+	}
+	return doc
+}
+
+// parseSearchQuery reads a query like proto:sip desc:"call transfer" -rtp
+func parseSearchQuery(query string) ([]searchClause, error) {
+	clauses := make([]searchClause, 0)
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		var clause searchClause
+		if strings.HasPrefix(rest, "-") {
+			clause.negate = true
+			rest = rest[1:]
+		}
+		if colon := strings.Index(rest, ":"); colon > 0 {
+			if _, ok := searchFieldWeights[strings.ToLower(rest[:colon])]; ok {
+				clause.field = strings.ToLower(rest[:colon])
+				rest = rest[colon+1:]
+			}
+		}
+		var text string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				return nil, fmt.Errorf("The quote in `%s` isn't closed", query)
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			text, rest = rest[:end], rest[end:]
+		}
+		// Words joined by punctuation, like call-transfer, are a phrase
+		for _, token := range tokenize(text) {
+			clause.words = append(clause.words, token.term)
+		}
+		if len(clause.words) > 0 {
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses, nil
+}
+
+// occurrences returns the positions in a doc's field where a clause's words start
+func (index *TextIndex) occurrences(doc int, field string, words []string) []int {
+	tokens := index.docs[doc].tokens[field]
+	found := make([]int, 0)
+	for pos := 0; pos+len(words) <= len(tokens); pos++ {
+		matched := true
+		for i, word := range words {
+			token := tokens[pos+i]
+			if token.term != analyze(field, word) || token.value != tokens[pos].value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			found = append(found, pos)
+		}
+	}
+	return found
+}
+
+// candidates returns the docs whose field has every word of a clause, in order
+func (index *TextIndex) candidates(field string, words []string) []int {
+	docs := index.postings[field][analyze(field, words[0])]
+	for _, word := range words[1:] {
+		other := index.postings[field][analyze(field, word)]
+		both := make([]int, 0, len(docs))
+		for i, j := 0, 0; i < len(docs) && j < len(other); {
+			switch {
+			case docs[i] < other[j]:
+				i++
+			case docs[i] > other[j]:
+				j++
+			default:
+				both = append(both, docs[i])
+				i, j = i+1, j+1
+			}
+		}
+		docs = both
+	}
+	return docs
+}
+
+// Search returns the captures that match every clause of a query, best first. Terms match
+// desc, title, comment, file and proto unless they name a field, quoted words are a phrase,
+// and terms starting with - leave out captures that match them.
+func (index *TextIndex) Search(query string) ([]SearchResult, error) {
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[int]float64)
+	matched := make(map[int]int)                   // How many clauses each doc matched
+	marks := make(map[int]map[string]map[int]bool) // Positions of matched words of each doc by field
+	excluded := make(map[int]bool)
+	required := 0
+	for _, clause := range clauses {
+		fields := defaultSearchFields
+		if clause.field != "" {
+			fields = []string{clause.field}
+		}
+		if !clause.negate {
+			required++
+		}
+		clauseDocs := make(map[int]bool)
+		for _, field := range fields {
+			candidates := index.candidates(field, clause.words)
+			found := make(map[int][]int, len(candidates))
+			for _, doc := range candidates {
+				if positions := index.occurrences(doc, field, clause.words); len(positions) > 0 {
+					found[doc] = positions
+				}
+			}
+			// Phrases are scored like a word whose documents are those with the phrase
+			idf := math.Log(1 + (float64(len(index.docs))-float64(len(found))+0.5)/(float64(len(found))+0.5))
+			for doc, positions := range found {
+				clauseDocs[doc] = true
+				if clause.negate {
+					continue
+				}
+				tf := float64(len(positions))
+				length := float64(len(index.docs[doc].tokens[field]))
+				norm := 1 - bm25B + bm25B*length/index.avgLen[field]
+				scores[doc] += searchFieldWeights[field] * idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+				if marks[doc] == nil {
+					marks[doc] = make(map[string]map[int]bool)
+				}
+				if marks[doc][field] == nil {
+					marks[doc][field] = make(map[int]bool)
+				}
+				for _, pos := range positions {
+					for i := range clause.words {
+						marks[doc][field][pos+i] = true
+					}
+				}
+			}
+		}
+		for doc := range clauseDocs {
+			if clause.negate {
+				excluded[doc] = true
+			} else {
+				matched[doc]++
+			}
+		}
+	}
+	if required == 0 {
+		return nil, fmt.Errorf("`%s` has nothing to look for", query)
+	}
+	results := make([]SearchResult, 0)
+	for doc, count := range matched {
+		if count < required || excluded[doc] {
+			continue
+		}
+		result := SearchResult{Hash: index.docs[doc].hash, Filename: index.docs[doc].filename, Score: scores[doc]}
+		result.Snippet, result.SnippetField = index.snippet(doc, marks[doc])
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Hash < results[j].Hash
+	})
+	return results, nil
+}
+
+// snippet returns HTML of the part of a doc that matched, with matched words in <mark>, and its field
+func (index *TextIndex) snippet(doc int, marks map[string]map[int]bool) (string, string) {
+	for _, field := range snippetFields {
+		if len(marks[field]) == 0 {
+			continue
+		}
+		tokens := index.docs[doc].tokens[field]
+		first := len(tokens)
+		for pos := range marks[field] {
+			if pos < first {
+				first = pos
+			}
+		}
+		value := tokens[first].value
+		text := index.docs[doc].values[field][value]
+		// A window of the text around the first match, cut at word boundaries
+		from, to := 0, len(text)
+		if len(text) > snippetLen {
+			from = tokens[first].start - snippetLen/4
+			if from < 0 {
+				from = 0
+			}
+			to = from + snippetLen
+			if to > len(text) {
+				to = len(text)
+			}
+		}
+		var b strings.Builder
+		if from > 0 {
+			b.WriteString("…")
+		}
+		written := from
+		for pos, token := range tokens {
+			if token.value != value || token.start < from || token.end > to {
+				continue
+			}
+			if written == from && from > 0 {
+				// Start at the first whole word
+				written = token.start
+			}
+			if !marks[field][pos] {
+				continue
+			}
+			b.WriteString(html.EscapeString(text[written:token.start]))
+			b.WriteString("<mark>" + html.EscapeString(text[token.start:token.end]) + "</mark>")
+			written = token.end
+		}
+		if to < len(text) {
+			// End at the last whole word
+			if space := strings.LastIndexFunc(text[written:to], unicode.IsSpace); space >= 0 {
+				to = written + space
+			}
+		}
+		b.WriteString(html.EscapeString(text[written:to]))
+		if to < len(text) {
+			b.WriteString("…")
+		}
+		return b.String(), field
+	}
+	return "", ""
+}
@@ -0,0 +1,98 @@
+package mutexmap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestStem tests the Porter stemmer with words from its paper
+func TestStem(t *testing.T) {
+	words := map[string]string{
+		"caresses": "caress", "ponies": "poni", "cats": "cat", "feed": "feed", "agreed": "agre",
+		"plastered": "plaster", "motoring": "motor", "sing": "sing", "conflated": "conflat",
+		"hopping": "hop", "filing": "file", "happy": "happi", "relational": "relat",
+		"conditional": "condit", "generalization": "gener", "electrical": "electr",
+		"adjustment": "adjust", "adoption": "adopt", "controll": "control", "roll": "roll",
+		"transfers": "transfer", "transferred": "transfer", "calling": "call", "http2": "http2",
+	}
+	for word, want := range words {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+// TestTextIndexSearch tests ranking, phrases, fields and exclusions
+func TestTextIndexSearch(t *testing.T) {
+	captures := map[string]PcapInfo{
+		"a": {Filename: ".cache/wireshark_wiki/sip-call-transfer.pcap", Description: "A SIP call that is transferred with REFER.",
+			Protocols: []string{"eth", "ip", "udp", "sip", "rtp"}, Tags: []string{"voip"}},
+		"b": {Filename: ".cache/wireshark_bugs/12345.pcapng", Description: "Calls to a PBX. The transfer fails & the call drops.",
+			Protocols: []string{"eth", "ip", "tcp", "sip"},
+			Descriptions: []SourceInfo{{Source: "wireshark_bugs", Link: "https://bugs/12345", Title: "SIP dissector crashes on transfers",
+				Description: "Calls to a PBX. The transfer fails & the call drops."}}},
+		"c": {Filename: ".cache/packetlife/dns.pcap", Description: "DNS queries for a call center",
+			Protocols: []string{"eth", "ip", "udp", "dns"},
+			Pcapng:    &PcapngInfo{PacketComments: []PacketComment{{Frame: 7, Comment: "The resolver retries here"}}}},
+		"->Error:NotAPcap": {Description: "SIP call transfer"},
+	}
+	index := NewTextIndex(captures)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// a has sip in three fields and b in two
+		{"sip", []string{"a", "b"}},
+		{`"call transfer"`, []string{"a"}},
+		{`desc:"call transfer"`, []string{}},
+		{"proto:sip desc:transfers", []string{"b", "a"}},
+		{"call -proto:dns", []string{"a", "b"}},
+		{"title:crash", []string{"b"}},
+		{"source:wireshark_bugs", []string{"b"}},
+		{"proto:dn", []string{}},
+		{"tag:voip", []string{"a"}},
+		{"retrying", []string{"c"}},
+		{"comment:dns", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			results, err := index.Search(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(results))
+			for i, result := range results {
+				got[i] = result.Hash
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+	results, _ := index.Search(`transfer -"call center"`)
+	want := []SearchResult{
+		{Hash: "a", Filename: ".cache/wireshark_wiki/sip-call-transfer.pcap",
+			Snippet: "A SIP call that is <mark>transferred</mark> with REFER.", SnippetField: FieldDesc},
+		{Hash: "b", Filename: ".cache/wireshark_bugs/12345.pcapng",
+			Snippet: "Calls to a PBX. The <mark>transfer</mark> fails &amp; the call drops.", SnippetField: FieldDesc},
+	}
+	for i := range results {
+		results[i].Score = 0
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Search() = %+v, want %+v", results, want)
+	}
+	// Long texts are cut to a window around the first match
+	long := strings.Repeat("filler words ", 30) + "the BACnet device answers " + strings.Repeat("more words ", 30)
+	results, _ = NewTextIndex(map[string]PcapInfo{"d": {Description: long}}).Search("bacnet")
+	if snippet := results[0].Snippet; !strings.HasPrefix(snippet, "…words filler") || !strings.Contains(snippet, "the <mark>BACnet</mark> device") ||
+		!strings.HasSuffix(snippet, "more…") || len(snippet) > snippetLen+20 {
+		t.Errorf("Snippet = %q", snippet)
+	}
+	for _, query := range []string{`"call`, "-sip", ""} {
+		if _, err := index.Search(query); err == nil {
+			t.Errorf("Search(%q) should fail", query)
+		}
+	}
+}
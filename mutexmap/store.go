@@ -0,0 +1,92 @@
+package mutexmap
+
+import "sync"
+
+// Store is a concurrent safe map.
+// Values go in and come out as copies, so callers can never race on a value the store holds.
+type Store[K comparable, V any] struct {
+	mu    sync.RWMutex
+	items map[K]V
+	clone func(V) V
+	merge func(old V, addend V) V
+}
+
+// NewStore is the Store constructor.
+// clone deep copies a value and merge combines a value with the one already stored for its key.
+func NewStore[K comparable, V any](clone func(V) V, merge func(old V, addend V) V) *Store[K, V] {
+	return &Store[K, V]{
+		items: make(map[K]V),
+		clone: clone,
+		merge: merge,
+	}
+}
+
+// Get returns a copy of the value for key and whether it exists
+func (s *Store[K, V]) Get(key K) (V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.items[key]
+	if !ok {
+		return v, false
+	}
+	return s.clone(v), true
+}
+
+// Upsert atomically replaces the value for key with what update returns.
+// update gets a copy of the current value and whether it exists.
+func (s *Store[K, V]) Upsert(key K, update func(current V, exists bool) V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.items[key]
+	if ok {
+		current = s.clone(current)
+	}
+	s.items[key] = s.clone(update(current, ok))
+}
+
+// Merge adds v under key, combining it with any existing value using the store's merge policy
+func (s *Store[K, V]) Merge(key K, v V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.items[key]
+	if !ok {
+		s.items[key] = s.clone(v)
+		return
+	}
+	s.items[key] = s.merge(s.clone(current), s.clone(v))
+}
+
+// Delete removes key
+func (s *Store[K, V]) Delete(key K) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+// Len returns the number of keys
+func (s *Store[K, V]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.items)
+}
+
+// Snapshot returns a deep copy of every key and value
+func (s *Store[K, V]) Snapshot() map[K]V {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := make(map[K]V, len(s.items))
+	for k, v := range s.items {
+		snapshot[k] = s.clone(v)
+	}
+	return snapshot
+}
+
+// Range calls fn with copies of each key and value until fn returns false.
+// It iterates over a snapshot, so fn may call other Store methods.
+func (s *Store[K, V]) Range(fn func(key K, v V) bool) {
+	for k, v := range s.Snapshot() {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
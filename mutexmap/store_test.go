@@ -0,0 +1,140 @@
+package mutexmap
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestPcapStoreConcurrent hammers one store from many goroutines. Run with `go test -race`.
+func TestPcapStoreConcurrent(t *testing.T) {
+	store := NewPcapStore()
+	var wg sync.WaitGroup
+	numWriters, numLinks := 50, 20
+	for w := 0; w < numWriters; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numLinks; i++ {
+				pi := PcapInfo{
+					Filename:    fmt.Sprintf(".cache/packetlife/%d.pcap", w),
+					Sources:     []string{fmt.Sprintf("http://example.com/%d", i), "http://example.com/dup"},
+					Description: fmt.Sprintf("Writer %d", w),
+					Capinfos:    map[string]interface{}{"FileName": "x", "SHA256": "abc"},
+					Protocols:   []string{"eth", "ip"},
+					Ports:       map[string][]int{"tcpSrcPorts": {80}},
+				}
+				store.Merge(fmt.Sprintf("hash%d", i%5), pi)
+				// The store must have copied pi, so changing it afterwards can't race with readers
+				pi.Sources[0] = "mutated"
+				delete(pi.Capinfos, "FileName")
+				pi.Ports["tcpSrcPorts"][0] = 0
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < numLinks; i++ {
+				if pi, ok := store.Get("hash0"); ok {
+					pi.Sources = append(pi.Sources, "local only")
+					delete(pi.Capinfos, "SHA256")
+				}
+				store.Upsert("counter", func(current PcapInfo, exists bool) PcapInfo {
+					current.Sources = append(current.Sources, "tick")
+					return current
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < numLinks; i++ {
+				for _, pi := range store.Snapshot() {
+					_ = fmt.Sprint(pi)
+				}
+				store.Range(func(hash string, pi PcapInfo) bool {
+					store.Len() // Calling back into the store from Range must not deadlock
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	counter, _ := store.Get("counter")
+	if len(counter.Sources) != numWriters*numLinks {
+		t.Errorf("Upsert() lost updates: got %d sources, want %d", len(counter.Sources), numWriters*numLinks)
+	}
+	for i := 0; i < 5; i++ {
+		pi, ok := store.Get(fmt.Sprintf("hash%d", i))
+		if !ok {
+			t.Fatalf("Get(hash%d) missing", i)
+		}
+		// Each hash gets links i, i+5, i+10, i+15 and the shared duplicate exactly once
+		if len(pi.Sources) != 5 {
+			t.Errorf("Merge() hash%d sources = %v, want 5 unique links", i, pi.Sources)
+		}
+		if pi.Capinfos["FileName"] != "x" || pi.Ports["tcpSrcPorts"][0] != 80 {
+			t.Errorf("Merge() hash%d was changed by a caller after it was stored: %v", i, pi)
+		}
+		if pi.Description != "Writer 10" { // Longest, then alphabetically first
+			t.Errorf("Merge() hash%d description = %s, want the deterministic choice Writer 10", i, pi.Description)
+		}
+		if pi.Filename != ".cache/packetlife/0.pcap" {
+			t.Errorf("Merge() hash%d filename = %s, want the deterministic choice 0.pcap", i, pi.Filename)
+		}
+	}
+}
+
+func TestMergePcapInfo(t *testing.T) {
+	analyzed := PcapInfo{Filename: ".cache/b.pcap", Sources: []string{"b"}, Description: "No Description", Capinfos: map[string]interface{}{}}
+	unanalyzed := PcapInfo{Sources: []string{"a", "b"}, Description: "Has a description"}
+	tests := []struct {
+		name     string
+		old      PcapInfo
+		addend   PcapInfo
+		wantFile string
+		wantSrcs []string
+		wantDesc string
+	}{
+		{"Equal sources still merge", analyzed, analyzed, ".cache/b.pcap", []string{"b"}, "No Description"},
+		{"Analysis wins", unanalyzed, analyzed, ".cache/b.pcap", []string{"a", "b"}, "Has a description"},
+		{"Order does not matter", analyzed, unanalyzed, ".cache/b.pcap", []string{"a", "b"}, "Has a description"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergePcapInfo(tt.old, tt.addend)
+			if got.Filename != tt.wantFile || !reflect.DeepEqual(got.Sources, tt.wantSrcs) || got.Description != tt.wantDesc {
+				t.Errorf("MergePcapInfo() = %+v, want file %s, sources %v and description %s", got, tt.wantFile, tt.wantSrcs, tt.wantDesc)
+			}
+		})
+	}
+}
+
+func TestMergeDescriptions(t *testing.T) {
+	wiki := SourceInfo{"wireshark_wiki", "https://wiki.wireshark.org/a", "a.pcap", "Wiki says"}
+	pl := SourceInfo{"packetlife", "http://packetlife.net/captures/a.pcap", "a.pcap", "Packetlife has a longer description"}
+	bug := SourceInfo{"wireshark_bugs", "https://bugs.wireshark.org/bugzilla/attachment.cgi?id=1", "a.pcap", "No Description"}
+	tests := []struct {
+		name     string
+		arrivals [][]SourceInfo
+		wantDesc string
+		wantLen  int
+	}{
+		{"Wiki beats packetlife", [][]SourceInfo{{pl}, {wiki}}, "Wiki says", 2},
+		{"Arrival order does not matter", [][]SourceInfo{{wiki}, {pl}}, "Wiki says", 2},
+		{"Placeholders lose to any source", [][]SourceInfo{{bug}, {pl}}, "Packetlife has a longer description", 2},
+		{"Same link is kept once", [][]SourceInfo{{pl}, {pl}, {bug}}, "Packetlife has a longer description", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewPcapStore()
+			for _, descs := range tt.arrivals {
+				store.Merge("hash", PcapInfo{Sources: []string{descs[0].Link}, Description: descs[0].Description, Descriptions: descs})
+			}
+			got, _ := store.Get("hash")
+			if got.Description != tt.wantDesc || len(got.Descriptions) != tt.wantLen {
+				t.Errorf("Merge() description = %s with %d descriptions, want %s with %d", got.Description, len(got.Descriptions), tt.wantDesc, tt.wantLen)
+			}
+		})
+	}
+}
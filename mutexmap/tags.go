@@ -0,0 +1,111 @@
+package mutexmap
+
+import (
+	"path"
+	"strings"
+)
+
+// TagRule gives a capture a tag when any of its patterns match. Protocols and Encapsulations
+// match whole names, or names that start with what's before a trailing *, ignoring case.
+type TagRule struct {
+	Tag         string // Like voip, wireless or ics-scada
+	Description string `json:",omitempty"` // What the tag means, for people editing the rules
+	// Protocols are names from tshark's protocol hierarchy, like sip or gsm_*
+	Protocols []string `json:",omitempty"`
+	// Encapsulations are capinfos link types, like IEEE 802.11*
+	Encapsulations []string `json:",omitempty"`
+	// Keywords are words of filenames, source page titles and descriptions, like malware
+	Keywords []string `json:",omitempty"`
+}
+
+// TagRules map what's found in captures onto a taxonomy of tags
+type TagRules struct {
+	Rules []TagRule
+}
+
+// matchesName returns whether name matches one of patterns
+func matchesName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// encapsulations returns the link types of a capture, from the file and from each interface
+func encapsulations(pi PcapInfo) []string {
+	encaps := make([]string, 0)
+	if encap, ok := pi.Capinfos["FileEncapsulation"].(string); ok {
+		encaps = append(encaps, encap)
+	}
+	interfaces, _ := pi.Capinfos["Interfaces"].([]interface{})
+	for _, iface := range interfaces {
+		fields, _ := iface.(map[string]interface{})
+		// Interfaces have the number and short name too, like Ethernet (1 - ether)
+		if encap, ok := fields["Encapsulation"].(string); ok {
+			if paren := strings.LastIndex(encap, " ("); paren > 0 {
+				encap = encap[:paren]
+			}
+			encaps = append(encaps, encap)
+		}
+	}
+	return encaps
+}
+
+// keywords returns the words of a capture's filename, source page titles and descriptions
+func keywords(pi PcapInfo) map[string]bool {
+	texts := []string{path.Base(pi.Filename), pi.ArchivePath, pi.Description}
+	for _, si := range pi.Descriptions {
+		texts = append(texts, si.Title, si.Description)
+	}
+	words := make(map[string]bool)
+	for _, text := range texts {
+		if isPlaceholderDesc(text) {
+			continue
+		}
+		for _, token := range tokenize(text) {
+			words[token.term] = true
+		}
+	}
+	return words
+}
+
+// Tag returns the tags of a capture in the order of the rules, without duplicates
+func (rules TagRules) Tag(pi PcapInfo) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	encaps := encapsulations(pi)
+	var words map[string]bool
+	for _, rule := range rules.Rules {
+		if seen[rule.Tag] {
+			continue
+		}
+		matched := false
+		for _, proto := range pi.Protocols {
+			matched = matched || matchesName(rule.Protocols, proto)
+		}
+		for _, encap := range encaps {
+			matched = matched || matchesName(rule.Encapsulations, encap)
+		}
+		if !matched && len(rule.Keywords) > 0 {
+			if words == nil {
+				words = keywords(pi)
+			}
+			for _, keyword := range rule.Keywords {
+				matched = matched || words[strings.ToLower(keyword)]
+			}
+		}
+		if matched {
+			seen[rule.Tag] = true
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,40 @@
+package mutexmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestTagRules tests that captures get the tags of every rule they match, in rule order
+func TestTagRules(t *testing.T) {
+	rules := TagRules{Rules: []TagRule{
+		{Tag: "voip", Protocols: []string{"sip", "rtp"}},
+		{Tag: "wireless", Protocols: []string{"wlan"}, Encapsulations: []string{"IEEE 802.11*", "Bluetooth*"}},
+		{Tag: "cellular", Protocols: []string{"gsm_*", "gtp"}},
+		{Tag: "malware", Keywords: []string{"Trojan", "malware"}},
+		{Tag: "voip", Protocols: []string{"h225"}},
+	}}
+	tests := []struct {
+		name string
+		pi   PcapInfo
+		want []string
+	}{
+		{"Protocols", PcapInfo{Protocols: []string{"eth", "ethertype", "ip", "udp", "sip", "sdp", "rtp"}}, []string{"voip"}},
+		{"Wildcard", PcapInfo{Protocols: []string{"gsmtap", "gsm_a.dtap"}}, []string{"cellular"}},
+		{"File encapsulation", PcapInfo{Capinfos: map[string]interface{}{"FileEncapsulation": "IEEE 802.11 plus radiotap radio header"}},
+			[]string{"wireless"}},
+		{"Interface encapsulation", PcapInfo{Capinfos: map[string]interface{}{"FileEncapsulation": "Per packet",
+			"Interfaces": []interface{}{map[string]interface{}{"Encapsulation": "Bluetooth H4 with linux header (99 - bluetooth-h4-linux)"}}}},
+			[]string{"wireless"}},
+		{"Keywords", PcapInfo{Filename: ".cache/packetlife/trojan-beacon.pcap", Protocols: []string{"eth", "ip", "tcp", "rtp"},
+			Descriptions: []SourceInfo{{Title: "Some traffic"}}}, []string{"voip", "malware"}},
+		{"Partial words", PcapInfo{Description: "Antimalware updates", Protocols: []string{"gsm"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.Tag(tt.pi); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tag() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
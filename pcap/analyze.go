@@ -0,0 +1,153 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CaptureAnalysis is what hubcap records about a capture, from capinfos and one tshark pass
+type CaptureAnalysis struct {
+	Capinfos       map[string]interface{} // From GetCapinfos, which reads every packet without dissecting it
+	Protocols      []string
+	Ports          map[string][]int
+	ProtocolFrames map[string]int  // Frames of each protocol stack, like eth:ip:tcp, from io,phs
+	Conversations  map[string]int  // Conversations of tcp and udp, from conv,tcp and conv,udp
+	Endpoints      Endpoints       // Packets with each IP, MAC, domain and port
+	Quality        *Quality        // Drops, truncation, TCP problems and bad timestamps, with a score
+	Pcapng         *PcapngMetadata // Comments and options of a pcapng file, if it has any
+	// Sample is set when only a sample was dissected. Capinfos and Pcapng are still of every
+	// packet, while everything else is of the sample apart from what Quality says.
+	Sample *SampleReport
+}
+
+// Fields and statistics of the analysis pass
+var (
+	analysisFields = append(append(append([]string{"frame.time_epoch", "frame.len"}, protoPortFields...), endpointFields...), qualityFields...)
+	analysisStats  = []string{"io,phs", "conv,tcp", "conv,udp"}
+	qualityOffset  = 2 + len(protoPortFields) + len(endpointFields) // Where qualityFields start
+)
+
+// captureSummary adds up packets without dissecting them, for sampling
+type captureSummary struct {
+	packets     int
+	dataSize    int64
+	first, last float64
+	prev        float64
+	inOrder     bool
+}
+
+func (s *captureSummary) add(epoch float64, length int64) {
+	if s.packets == 0 {
+		s.first, s.last, s.prev, s.inOrder = epoch, epoch, epoch, true
+	}
+	s.first = math.Min(s.first, epoch)
+	s.last = math.Max(s.last, epoch)
+	s.inOrder = s.inOrder && epoch >= s.prev
+	s.prev = epoch
+	s.packets++
+	s.dataSize += length
+}
+
+// AnalyzeCapture gets the metadata of a capture from capinfos, and its protocols, ports and statistics
+// with one tshark pass. Captures over the Sampling limits are sampled for the tshark pass.
+// prefs are extra tshark arguments, like those of Decryption.
+func AnalyzeCapture(ctx context.Context, filename string, prefs []string) (*CaptureAnalysis, error) {
+	plan, err := planSample(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	analyzed := 0
+	var pp protoPorts
+	var endpoints endpointCounter
+	quality := newQualityCounter()
+	pass := Pass{Prefs: prefs, Fields: analysisFields, Stats: analysisStats, OnPacket: func(values []string) {
+		epoch, _ := strconv.ParseFloat(values[0], 64)
+		length, _ := strconv.ParseInt(values[1], 10, 64)
+		analyzed++
+		pp.add(values[2:])
+		endpoints.add(values[2:])
+		// The TCP source port is the first of protoPortFields after frame.protocols
+		quality.add(epoch, length, values[3] != "", values[qualityOffset:])
+	}}
+	target := filename
+	if plan.report != nil {
+		fmt.Printf("\033[92mINFO\033[0m Sampling %d of %d packets of `%s` by %s\n", plan.report.Packets, plan.report.Total, filename, plan.report.Mode)
+		if plan.report.Mode == SampleHead {
+			pass.MaxPackets = plan.report.Packets
+		} else {
+			target, err = writeSample(filename, plan.format, plan.report.Mode, plan.report.Packets, *plan.exact)
+			if err != nil {
+				return nil, err
+			}
+			defer os.Remove(target)
+		}
+	}
+	result, passErr := pass.Run(ctx, target)
+	if ctx.Err() != nil || FailureCategory(passErr) != "" {
+		return nil, passErr
+	}
+	analysis := &CaptureAnalysis{
+		ProtocolFrames: parseProtocolHierarchy(result.Stats["io,phs"]),
+		Conversations:  make(map[string]int),
+		Endpoints:      endpoints.counts,
+		Sample:         plan.report,
+	}
+	analysis.Protocols, analysis.Ports = pp.result()
+	var fq fileQuality
+	if format, ok := DetectFileFormat(filename); ok && canWalk(format) {
+		// A damaged file still has the quality and metadata of what's before the damage
+		fq, _ = walkQuality(filename, format)
+		if format.Name == FormatPcapng {
+			analysis.Pcapng, _ = ReadPcapngMetadata(filename)
+		}
+	}
+	analysis.Quality = quality.result(fq)
+	for _, proto := range []string{"tcp", "udp"} {
+		analysis.Conversations[proto] = strings.Count(result.Stats["conv,"+proto], "<->")
+	}
+	if plan.report != nil {
+		plan.report.Analyzed = analyzed
+	}
+	// capinfos reads records without dissecting them, so it costs little next to the pass
+	analysis.Capinfos = plan.capinfos
+	if analysis.Capinfos == nil {
+		capinfos, err := GetCapinfos(ctx, filename)
+		if ctx.Err() != nil || FailureCategory(err) != "" {
+			return nil, err
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		analysis.Capinfos = capinfos
+	}
+	return analysis, passErr
+}
+
+// Like "    tcp                                  frames:8 bytes:800"
+var phsLineRe = regexp.MustCompile(`^( *)(\S+)\s+frames:(\d+)\s+bytes:\d+`)
+
+// parseProtocolHierarchy turns io,phs output into frames by protocol stack, like eth:ip:tcp
+func parseProtocolHierarchy(text string) map[string]int {
+	frames := make(map[string]int)
+	stack := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		match := phsLineRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		// Each level is indented by two more spaces
+		depth := len(match[1]) / 2
+		if depth > len(stack) {
+			depth = len(stack)
+		}
+		stack = append(stack[:depth], match[2])
+		count, _ := strconv.Atoi(match[3])
+		frames[strings.Join(stack, ":")] += count
+	}
+	return frames
+}
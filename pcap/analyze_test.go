@@ -0,0 +1,129 @@
+package pcap
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPassParse tests that fields and statistics are split out of one tshark output
+func TestPassParse(t *testing.T) {
+	banner := strings.Repeat("=", 80)
+	sep := fieldSeparator
+	tests := []struct {
+		name       string
+		pass       Pass
+		output     string
+		wantValues [][]string
+		wantStats  map[string]string
+	}{
+		{"Fields only", Pass{Fields: []string{"frame.protocols", "tcp.srcport"}},
+			"eth:ip:tcp" + sep + "443\neth:ip:udp\n",
+			[][]string{{"eth:ip:tcp", "443"}, {"eth:ip:udp", ""}}, map[string]string{}},
+		{"Fields and stats", Pass{Fields: []string{"frame.len"}, Stats: []string{"io,phs", "conv,tcp"}},
+			"60\n1514\n" + banner + "\nProtocol Hierarchy Statistics\n" + banner + "\n" + banner + "\nTCP Conversations\n" + banner + "\n",
+			[][]string{{"60"}, {"1514"}},
+			map[string]string{"io,phs": "Protocol Hierarchy Statistics\n", "conv,tcp": "TCP Conversations\n"}},
+		{"Stats only", Pass{Stats: []string{"io,phs"}},
+			"Running as user \"root\"\n" + banner + "\neth frames:1 bytes:60\n" + banner + "\n",
+			nil, map[string]string{"io,phs": "eth frames:1 bytes:60\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var values [][]string
+			tt.pass.OnPacket = func(v []string) { values = append(values, v) }
+			got := tt.pass.parse(strings.NewReader(tt.output))
+			assert.Equal(t, tt.wantValues, values)
+			assert.Equal(t, len(tt.wantValues), got.Packets)
+			assert.Equal(t, tt.wantStats, got.Stats)
+		})
+	}
+}
+
+// TestPassArgs tests that a pass without fields is quiet and that stats come last
+func TestPassArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		pass Pass
+		want []string
+	}{
+		{"Stats only", Pass{Stats: []string{"io,phs"}}, []string{"-n", "-r", "a.pcap", "-q", "-z", "io,phs"}},
+		{"Fields and filter", Pass{Prefs: []string{"-o", "tls.keylog_file:k"}, Filter: "tcp", Fields: []string{"tcp.port"}},
+			[]string{"-o", "tls.keylog_file:k", "-n", "-r", "a.pcap", "-Y", "tcp", "-T", "fields", "-E", "separator=" + fieldSeparator, "-e", "tcp.port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.pass.args("a.pcap"))
+		})
+	}
+}
+
+// TestParseProtocolHierarchy tests that io,phs output becomes frames by protocol stack
+func TestParseProtocolHierarchy(t *testing.T) {
+	phs := `Protocol Hierarchy Statistics
+Filter:
+
+eth                                      frames:10 bytes:1200
+  ip                                     frames:9 bytes:1100
+    tcp                                  frames:6 bytes:800
+      tls                                frames:2 bytes:400
+    udp                                  frames:3 bytes:300
+      dns                                frames:3 bytes:300
+  arp                                    frames:1 bytes:60
+`
+	want := map[string]int{
+		"eth": 10, "eth:ip": 9, "eth:ip:tcp": 6, "eth:ip:tcp:tls": 2,
+		"eth:ip:udp": 3, "eth:ip:udp:dns": 3, "eth:arp": 1,
+	}
+	assert.Equal(t, want, parseProtocolHierarchy(phs))
+}
+
+// BenchmarkAnalysis compares two ways of getting what AnalyzeCapture gets from each capture of $HUBCAP_CORPUS.
+// Both check the capture with IsPcap and run capinfos -M. One then reads the capture with tshark for protocols
+// and ports and again for statistics, endpoints and quality, while the other reads it with tshark once.
+func BenchmarkAnalysis(b *testing.B) {
+	corpus := os.Getenv("HUBCAP_CORPUS")
+	if corpus == "" {
+		b.Skip("Set HUBCAP_CORPUS to a folder of captures to benchmark analysis")
+	}
+	if _, err := exec.LookPath(tools.Tshark); err != nil {
+		b.Skip("tshark is not installed")
+	}
+	files, _ := filepath.Glob(filepath.Join(corpus, "*"))
+	ctx := context.Background()
+	rest := Pass{Fields: append(append([]string{"frame.time_epoch", "frame.len"}, endpointFields...), qualityFields...),
+		Stats: analysisStats, OnPacket: func([]string) {}}
+	b.Run("TwoTsharkPasses", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, file := range files {
+				if IsPcap(ctx, file) != nil {
+					continue
+				}
+				GetCapinfos(ctx, file)
+				GetTsharkJSON(ctx, file)
+				rest.Run(ctx, file)
+				if format, ok := DetectFileFormat(file); ok && canWalk(format) {
+					walkQuality(file, format)
+					if format.Name == FormatPcapng {
+						ReadPcapngMetadata(file)
+					}
+				}
+			}
+		}
+	})
+	b.Run("OneTsharkPass", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, file := range files {
+				if IsPcap(ctx, file) != nil {
+					continue
+				}
+				AnalyzeCapture(ctx, file, nil)
+			}
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package pcap
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// bpfInsn is a classic BPF instruction, laid out like struct bpf_insn
+type bpfInsn struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+// Classic BPF opcodes, as in linux/bpf_common.h
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfST   = 0x02
+	bpfSTX  = 0x03
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfMISC = 0x07
+
+	bpfW = 0x00
+	bpfH = 0x08
+	bpfB = 0x10
+
+	bpfIMM = 0x00
+	bpfABS = 0x20
+	bpfIND = 0x40
+	bpfMEM = 0x60
+	bpfLEN = 0x80
+	bpfMSH = 0xa0
+
+	bpfADD = 0x00
+	bpfSUB = 0x10
+	bpfMUL = 0x20
+	bpfDIV = 0x30
+	bpfOR  = 0x40
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfRSH = 0x70
+	bpfNEG = 0x80
+	bpfMOD = 0x90
+	bpfXOR = 0xa0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfJSET = 0x40
+
+	bpfK = 0x00
+	bpfX = 0x08
+	bpfA = 0x10
+
+	bpfTAX = 0x00
+	bpfTXA = 0x80
+)
+
+// bpfMemWords is how many scratch memory words a program has
+const bpfMemWords = 16
+
+// bpfAccept is what a program returns for packets that match, which like libpcap's is the snaplen
+const bpfAccept = maxRecordLen
+
+// newBPFVM loads a program into x/net/bpf's VM, which rejects packets on loads past their end and on
+// division by zero. Its len is the captured length of a packet, since the VM only has the captured bytes.
+func newBPFVM(prog []bpfInsn) (*bpf.VM, error) {
+	insns := make([]bpf.Instruction, len(prog))
+	for i, insn := range prog {
+		insns[i] = bpf.RawInstruction{Op: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}.Disassemble()
+	}
+	return bpf.NewVM(insns)
+}
+
+// String prints an instruction like tcpdump -dd does
+func (insn bpfInsn) String() string {
+	return fmt.Sprintf("{ 0x%x, %d, %d, 0x%08x }", insn.Op, insn.Jt, insn.Jf, insn.K)
+}
@@ -0,0 +1,1122 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/bpf"
+)
+
+// Link types that capture filters can be compiled for
+const (
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+// bpfLink is where the network layer of a link type's packets is
+type bpfLink struct {
+	netOffset  uint32
+	typeOffset int  // Offset of the ethertype, or -1 if the link has none
+	ipv4, ipv6 bool // Which IP versions a link without an ethertype carries
+	ethernet   bool
+}
+
+var bpfLinks = map[uint32]bpfLink{
+	linkTypeEthernet:  {netOffset: 14, typeOffset: 12, ethernet: true},
+	linkTypeLinuxSLL:  {netOffset: 16, typeOffset: 14},
+	linkTypeLinuxSLL2: {netOffset: 20, typeOffset: 0},
+	linkTypeRaw:       {typeOffset: -1, ipv4: true, ipv6: true},
+	linkTypeIPv4:      {typeOffset: -1, ipv4: true},
+	linkTypeIPv6:      {typeOffset: -1, ipv6: true},
+}
+
+// Layers that a packet comparison is relative to
+const (
+	layerLink      = iota
+	layerNet       // The IP or ARP header
+	layerTransport // The header after an IPv4 header, whose length varies
+)
+
+// bpfNode is a boolean part of a capture filter
+type bpfNode interface{}
+
+type bpfAnd struct{ left, right bpfNode }
+type bpfOr struct{ left, right bpfNode }
+type bpfNot struct{ node bpfNode }
+type bpfConst bool
+
+// bpfRelation compares two arithmetic expressions, like tcp[13] & 2 != 0
+type bpfRelation struct {
+	op          string
+	left, right bpfArith
+}
+
+// bpfPrimitive is a qualified id like src host 10.0.0.1, tcp port 80 or ip6
+type bpfPrimitive struct {
+	proto string // Like ether, ip, ip6, arp, tcp or udp
+	dir   string // src, dst, "src or dst" or "src and dst"
+	kind  string // host, net, port, portrange or proto, or empty for a bare protocol
+	id    string
+	mask  string // Of net ... mask ...
+}
+
+// bpfCmp compares bytes of a packet with a constant. Primitives and relations are lowered to these.
+type bpfCmp struct {
+	layer  int
+	offset uint32
+	size   uint16 // bpfB, bpfH or bpfW
+	mask   uint32 // ANDed with the bytes before comparing
+	op     string // ==, >, >= or & for any bits set
+	value  uint32
+}
+
+// bpfArith is an arithmetic part of a capture filter
+type bpfArith interface{}
+
+type bpfNumber uint32
+type bpfLen struct{}
+
+// bpfLoad is a protocol accessor like tcp[13] or ip[2:2]
+type bpfLoad struct {
+	proto  string
+	offset bpfArith
+	size   uint16
+}
+
+type bpfBinary struct {
+	op          string
+	left, right bpfArith
+}
+
+// Named constants of capture filters, as in pcap-filter(7)
+var bpfConstants = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+	"icmptype": 0, "icmpcode": 1, "icmp-echoreply": 0, "icmp-unreach": 3, "icmp-sourcequench": 4,
+	"icmp-redirect": 5, "icmp-echo": 8, "icmp-routeradvert": 9, "icmp-routersolicit": 10,
+	"icmp-timxceed": 11, "icmp-paramprob": 12, "icmp-tstamp": 13, "icmp-tstampreply": 14,
+	"icmp-ireq": 15, "icmp-ireqreply": 16, "icmp-maskreq": 17, "icmp-maskreply": 18,
+}
+
+// Protocols of the IP header's protocol field
+var bpfIPProtos = map[string]uint32{"icmp": 1, "igmp": 2, "tcp": 6, "udp": 17, "gre": 47, "esp": 50, "ah": 51, "icmp6": 58, "sctp": 132}
+
+var bpfEtherTypes = map[string]uint32{"ip": 0x0800, "arp": 0x0806, "rarp": 0x8035, "ip6": 0x86dd}
+
+// Protocols that qualify primitives, and those with accessors like tcp[13]
+var (
+	bpfProtos    = map[string]bool{"ether": true, "ip": true, "ip6": true, "arp": true, "tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true}
+	bpfAccessors = map[string]int{"ether": layerLink, "link": layerLink, "ip": layerNet, "ip6": layerNet, "arp": layerNet,
+		"tcp": layerTransport, "udp": layerTransport, "icmp": layerTransport}
+)
+
+var bpfALUOps = map[string]uint16{"+": bpfADD, "-": bpfSUB, "*": bpfMUL, "/": bpfDIV, "%": bpfMOD,
+	"&": bpfAND, "|": bpfOR, "^": bpfXOR, "<<": bpfLSH, ">>": bpfRSH}
+
+// Arithmetic operators from lowest to highest precedence, as in libpcap's grammar
+var bpfArithLevels = [][]string{{"|", "^"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/", "%"}}
+
+// Operators, longest first so that && isn't read as &
+var bpfOperators = []string{"&&", "||", "<<", ">>", "==", "!=", "<=", ">=",
+	"(", ")", "[", "]", ":", "!", "&", "|", "^", "+", "-", "*", "/", "%", "=", "<", ">"}
+
+// BPFFilter is a capture filter like `tcp port 5060`, compiled to classic BPF for each link type it's run on.
+// It supports a subset of pcap-filter(7): host, net, port, portrange, proto, less and greater with
+// ether, ip, ip6, arp, tcp, udp, sctp and icmp qualifiers, accessors like tcp[13] and arithmetic.
+// Transport accessors like tcp[13] are of IPv4 packets, as in libpcap. Programs run on x/net/bpf's VM,
+// so len, less and greater are of the captured length of packets rather than their length on the wire.
+type BPFFilter struct {
+	Expr  string
+	root  bpfNode
+	mutex sync.Mutex
+	vms   map[uint32]*bpf.VM
+}
+
+// CompileBPF parses a capture filter. Hostnames aren't resolved, so hosts have to be addresses.
+func CompileBPF(expr string) (*BPFFilter, error) {
+	tokens, err := lexBPF(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &bpfParser{tokens: tokens}
+	root, err := parser.parseFilter()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capture filter `%s`: %s", expr, err)
+	}
+	filter := &BPFFilter{Expr: expr, root: root, vms: make(map[uint32]*bpf.VM)}
+	// Compiling for Ethernet finds bad addresses and ports before any capture is read
+	if _, err := filter.vm(linkTypeEthernet); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// vm returns the filter compiled for a link type and loaded into a VM
+func (f *BPFFilter) vm(linkType uint32) (*bpf.VM, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if vm, ok := f.vms[linkType]; ok {
+		return vm, nil
+	}
+	prog, err := compileBPF(f.root, linkType)
+	var vm *bpf.VM
+	if err == nil {
+		vm, err = newBPFVM(prog)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid capture filter `%s`: %s", f.Expr, err)
+	}
+	f.vms[linkType] = vm
+	return vm, nil
+}
+
+// Match returns whether a captured packet of a link type matches
+func (f *BPFFilter) Match(linkType uint32, packet []byte) (bool, error) {
+	vm, err := f.vm(linkType)
+	if err != nil {
+		return false, err
+	}
+	accepted, err := vm.Run(packet)
+	return accepted != 0, err
+}
+
+// lexBPF splits a capture filter into words and operators. Words are ids, numbers and addresses,
+// so outside of brackets they can have : and /, like fe80::1/64.
+func lexBPF(expr string) ([]string, error) {
+	tokens := make([]string, 0)
+	depth := 0
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isWordByte(c) || (depth == 0 && strings.HasPrefix(expr[i:], "::")):
+			j := i + 1
+			for j < len(expr) && continuesWord(expr[i:j], expr[j], depth) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			op := ""
+			for _, candidate := range bpfOperators {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("Invalid capture filter `%s`: unexpected %q", expr, c)
+			}
+			if op == "[" {
+				depth++
+			} else if op == "]" {
+				depth--
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// continuesWord returns whether c is part of word, like the - of tcp-syn or 1-1024 and the : of a MAC
+func continuesWord(word string, c byte, depth int) bool {
+	switch {
+	case isWordByte(c) || c == '.':
+		return true
+	case c == '-':
+		return depth == 0 || !isDigits(word)
+	case c == ':':
+		return depth == 0
+	case c == '/':
+		return depth == 0 && (strings.Contains(word, ".") || strings.Contains(word, ":"))
+	}
+	return false
+}
+
+func isDigits(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if word[i] < '0' || word[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// bpfSyntaxError is a parse error at a token
+type bpfSyntaxError struct {
+	pos int
+	msg string
+}
+
+func (e *bpfSyntaxError) Error() string {
+	return e.msg
+}
+
+// bpfParser parses capture filters by recursive descent. Relations and primitives are tried in turn,
+// so the error that got furthest is the one reported.
+type bpfParser struct {
+	tokens   []string
+	pos      int
+	furthest *bpfSyntaxError
+}
+
+func (p *bpfParser) peekAt(ahead int) string {
+	if p.pos+ahead < len(p.tokens) {
+		return p.tokens[p.pos+ahead]
+	}
+	return ""
+}
+
+func (p *bpfParser) peek() string {
+	return p.peekAt(0)
+}
+
+func (p *bpfParser) accept(words ...string) bool {
+	for _, word := range words {
+		if p.peek() == word {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *bpfParser) fail(format string, args ...interface{}) error {
+	at := "the end"
+	if p.pos < len(p.tokens) {
+		at = "`" + p.tokens[p.pos] + "`"
+	}
+	err := &bpfSyntaxError{pos: p.pos, msg: fmt.Sprintf(format, args...) + " at " + at}
+	if p.furthest == nil || err.pos > p.furthest.pos {
+		p.furthest = err
+	}
+	return err
+}
+
+// parseFilter parses a whole filter, which matches everything if it's empty
+func (p *bpfParser) parseFilter() (bpfNode, error) {
+	if len(p.tokens) == 0 {
+		return bpfConst(true), nil
+	}
+	node, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = p.fail("expected and or or")
+	}
+	if err != nil {
+		return nil, p.furthest
+	}
+	return node, nil
+}
+
+func (p *bpfParser) parseOr() (bpfNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("or", "||") {
+		var right bpfNode
+		if right, err = p.parseAnd(); err == nil {
+			left = bpfOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *bpfParser) parseAnd() (bpfNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("and", "&&") {
+		var right bpfNode
+		if right, err = p.parseUnary(); err == nil {
+			left = bpfAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *bpfParser) parseUnary() (bpfNode, error) {
+	if p.accept("not", "!") {
+		node, err := p.parseUnary()
+		return bpfNot{node}, err
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a relation, a parenthesized filter or a primitive. Both relations and
+// filters can start with (, so a relation is tried first.
+func (p *bpfParser) parsePrimary() (bpfNode, error) {
+	start := p.pos
+	relation, err := p.parseRelation()
+	if err == nil {
+		return relation, nil
+	}
+	p.pos = start
+	var node bpfNode
+	if p.accept("(") {
+		node, err = p.parseOr()
+		if err == nil && !p.accept(")") {
+			err = p.fail("expected )")
+		}
+	} else {
+		node, err = p.parsePrimitive()
+	}
+	return node, err
+}
+
+func (p *bpfParser) parseRelation() (bpfNode, error) {
+	left, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "=", "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+	default:
+		return nil, p.fail("expected a comparison")
+	}
+	right, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	if op == "=" {
+		op = "=="
+	}
+	return bpfRelation{op, left, right}, nil
+}
+
+// parseArith parses arithmetic with operators of bpfArithLevels[level] or higher
+func (p *bpfParser) parseArith(level int) (bpfArith, error) {
+	if level == len(bpfArithLevels) {
+		return p.parseAtom()
+	}
+	left, err := p.parseArith(level + 1)
+	for err == nil {
+		op := p.peek()
+		isOp := false
+		for _, levelOp := range bpfArithLevels[level] {
+			isOp = isOp || op == levelOp
+		}
+		if !isOp {
+			break
+		}
+		p.pos++
+		var right bpfArith
+		if right, err = p.parseArith(level + 1); err == nil {
+			left = bpfBinary{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *bpfParser) parseAtom() (bpfArith, error) {
+	word := p.peek()
+	if _, ok := bpfAccessors[word]; ok && p.peekAt(1) == "[" {
+		p.pos += 2
+		offset, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		size := uint16(bpfB)
+		if p.accept(":") {
+			sizes := map[string]uint16{"1": bpfB, "2": bpfH, "4": bpfW}
+			var ok bool
+			if size, ok = sizes[p.peek()]; !ok {
+				return nil, p.fail("expected a size of 1, 2 or 4")
+			}
+			p.pos++
+		}
+		if !p.accept("]") {
+			return nil, p.fail("expected ]")
+		}
+		return bpfLoad{word, offset, size}, nil
+	}
+	switch {
+	case p.accept("("):
+		inner, err := p.parseArith(0)
+		if err == nil && !p.accept(")") {
+			err = p.fail("expected )")
+		}
+		return inner, err
+	case p.accept("len"):
+		return bpfLen{}, nil
+	}
+	if value, ok := bpfConstants[word]; ok {
+		p.pos++
+		return bpfNumber(value), nil
+	}
+	if value, err := strconv.ParseUint(word, 0, 32); err == nil {
+		p.pos++
+		return bpfNumber(value), nil
+	}
+	return nil, p.fail("expected a number")
+}
+
+func (p *bpfParser) parsePrimitive() (bpfNode, error) {
+	if word := p.peek(); word == "less" || word == "greater" {
+		p.pos++
+		value, err := strconv.ParseUint(p.peek(), 0, 32)
+		if err != nil {
+			return nil, p.fail("expected a length")
+		}
+		p.pos++
+		if word == "less" {
+			return bpfRelation{"<=", bpfLen{}, bpfNumber(value)}, nil
+		}
+		return bpfRelation{">=", bpfLen{}, bpfNumber(value)}, nil
+	}
+	var prim bpfPrimitive
+	if bpfProtos[p.peek()] {
+		prim.proto = p.peek()
+		p.pos++
+	}
+	if p.accept("proto") {
+		prim.kind = "proto"
+	} else {
+		if dir := p.peek(); dir == "src" || dir == "dst" {
+			p.pos++
+			prim.dir = dir
+			if other := p.peekAt(1); (p.peek() == "or" || p.peek() == "and") && (other == "src" || other == "dst") && other != dir {
+				prim.dir = "src " + p.peek() + " dst"
+				p.pos += 2
+			}
+		}
+		if kind := p.peek(); kind == "host" || kind == "net" || kind == "port" || kind == "portrange" {
+			prim.kind = kind
+			p.pos++
+		}
+		if prim.kind == "" && prim.dir == "" {
+			if prim.proto == "" {
+				return nil, p.fail("expected a filter")
+			}
+			return prim, nil
+		}
+	}
+	id := p.peek()
+	if id == "" || !isWordByte(id[0]) && id[0] != ':' {
+		return nil, p.fail("expected an address, port or protocol")
+	}
+	p.pos++
+	if prim.kind == "" {
+		prim.kind = "host"
+	}
+	prim.id = id
+	if prim.kind == "net" && p.accept("mask") {
+		prim.mask = p.peek()
+		p.pos++
+	}
+	return prim, nil
+}
+
+// bpfAndOf joins nodes with and, leaving out those that are always true
+func bpfAndOf(nodes ...bpfNode) bpfNode {
+	var joined bpfNode = bpfConst(true)
+	for _, node := range nodes {
+		switch {
+		case node == bpfConst(false):
+			return node
+		case node == bpfConst(true):
+		case joined == bpfConst(true):
+			joined = node
+		default:
+			joined = bpfAnd{joined, node}
+		}
+	}
+	return joined
+}
+
+// bpfOrOf joins nodes with or, leaving out those that are always false
+func bpfOrOf(nodes ...bpfNode) bpfNode {
+	var joined bpfNode = bpfConst(false)
+	for _, node := range nodes {
+		switch {
+		case node == bpfConst(true):
+			return node
+		case node == bpfConst(false):
+		case joined == bpfConst(false):
+			joined = node
+		default:
+			joined = bpfOr{joined, node}
+		}
+	}
+	return joined
+}
+
+// bpfDir combines the source and destination tests of a primitive
+func bpfDir(dir string, src bpfNode, dst bpfNode) bpfNode {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return bpfAndOf(src, dst)
+	}
+	return bpfOrOf(src, dst)
+}
+
+func cmpEq(layer int, offset uint32, size uint16, value uint32) bpfNode {
+	return bpfCmp{layer: layer, offset: offset, size: size, mask: ^uint32(0), op: "==", value: value}
+}
+
+func (l bpfLink) etherType(value uint32) bpfNode {
+	if l.typeOffset < 0 {
+		return bpfConst(false)
+	}
+	return cmpEq(layerLink, uint32(l.typeOffset), bpfH, value)
+}
+
+func (l bpfLink) isIPv4() bpfNode {
+	if l.typeOffset >= 0 {
+		return l.etherType(bpfEtherTypes["ip"])
+	}
+	if !l.ipv4 || !l.ipv6 {
+		return bpfConst(l.ipv4)
+	}
+	return bpfCmp{layer: layerNet, size: bpfB, mask: 0xf0, op: "==", value: 0x40}
+}
+
+func (l bpfLink) isIPv6() bpfNode {
+	if l.typeOffset >= 0 {
+		return l.etherType(bpfEtherTypes["ip6"])
+	}
+	if !l.ipv4 || !l.ipv6 {
+		return bpfConst(l.ipv6)
+	}
+	return bpfCmp{layer: layerNet, size: bpfB, mask: 0xf0, op: "==", value: 0x60}
+}
+
+func (l bpfLink) ipProto(proto uint32) bpfNode {
+	return bpfAndOf(l.isIPv4(), cmpEq(layerNet, 9, bpfB, proto))
+}
+
+func (l bpfLink) ip6Proto(proto uint32) bpfNode {
+	return bpfAndOf(l.isIPv6(), cmpEq(layerNet, 6, bpfB, proto))
+}
+
+// notFragment is true of IPv4 packets that have their transport header, which later fragments don't
+func notFragment() bpfNode {
+	return bpfCmp{layer: layerNet, offset: 6, size: bpfH, mask: 0x1fff, op: "==", value: 0}
+}
+
+// layerCheck returns what has to be true of a packet for a protocol's accessor to be read
+func (l bpfLink) layerCheck(proto string) bpfNode {
+	switch proto {
+	case "ether":
+		return bpfConst(l.ethernet)
+	case "ip":
+		return l.isIPv4()
+	case "ip6":
+		return l.isIPv6()
+	case "arp":
+		return l.etherType(bpfEtherTypes["arp"])
+	case "tcp", "udp", "icmp":
+		return bpfAndOf(l.ipProto(bpfIPProtos[proto]), notFragment())
+	}
+	return bpfConst(true)
+}
+
+// loadedProtos adds the protocols whose accessors arithmetic reads to protos
+func loadedProtos(arith bpfArith, protos map[string]bool) {
+	switch a := arith.(type) {
+	case bpfLoad:
+		protos[a.proto] = true
+		loadedProtos(a.offset, protos)
+	case bpfBinary:
+		loadedProtos(a.left, protos)
+		loadedProtos(a.right, protos)
+	}
+}
+
+// lower turns primitives into comparisons of a link type's packets, and makes relations
+// check that the protocols they read are there
+func (l bpfLink) lower(node bpfNode) (bpfNode, error) {
+	switch n := node.(type) {
+	case bpfAnd, bpfOr:
+		var left, right bpfNode
+		if and, ok := n.(bpfAnd); ok {
+			left, right = and.left, and.right
+		} else {
+			left, right = n.(bpfOr).left, n.(bpfOr).right
+		}
+		loweredLeft, err := l.lower(left)
+		if err != nil {
+			return nil, err
+		}
+		loweredRight, err := l.lower(right)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := n.(bpfAnd); ok {
+			return bpfAndOf(loweredLeft, loweredRight), nil
+		}
+		return bpfOrOf(loweredLeft, loweredRight), nil
+	case bpfNot:
+		lowered, err := l.lower(n.node)
+		if c, ok := lowered.(bpfConst); ok {
+			return !c, err
+		}
+		return bpfNot{lowered}, err
+	case bpfRelation:
+		protos := make(map[string]bool)
+		loadedProtos(n.left, protos)
+		loadedProtos(n.right, protos)
+		checks := make([]bpfNode, 0, len(protos)+1)
+		// In a fixed order so that programs are the same every time
+		for _, proto := range []string{"ether", "link", "ip", "ip6", "arp", "tcp", "udp", "icmp"} {
+			if protos[proto] {
+				checks = append(checks, l.layerCheck(proto))
+			}
+		}
+		return bpfAndOf(append(checks, n)...), nil
+	case bpfPrimitive:
+		return l.lowerPrimitive(n)
+	}
+	return node, nil
+}
+
+func (l bpfLink) lowerPrimitive(prim bpfPrimitive) (bpfNode, error) {
+	switch prim.kind {
+	case "":
+		switch prim.proto {
+		case "ether", "ip", "ip6", "arp":
+			return l.layerCheck(prim.proto), nil
+		case "icmp":
+			return l.ipProto(bpfIPProtos["icmp"]), nil
+		case "icmp6":
+			return l.ip6Proto(bpfIPProtos["icmp6"]), nil
+		}
+		proto := bpfIPProtos[prim.proto]
+		return bpfOrOf(l.ipProto(proto), l.ip6Proto(proto)), nil
+	case "proto":
+		return l.lowerProto(prim)
+	case "host":
+		return l.lowerHost(prim)
+	case "net":
+		return l.lowerNet(prim)
+	}
+	return l.lowerPort(prim)
+}
+
+// lowerProto lowers ether proto, ip proto and ip6 proto
+func (l bpfLink) lowerProto(prim bpfPrimitive) (bpfNode, error) {
+	names := bpfIPProtos
+	if prim.proto == "ether" {
+		names = bpfEtherTypes
+	}
+	value, ok := names[prim.id]
+	if !ok {
+		number, err := strconv.ParseUint(prim.id, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown protocol `%s`", prim.id)
+		}
+		value = uint32(number)
+	}
+	switch prim.proto {
+	case "ether":
+		return l.etherType(value), nil
+	case "ip":
+		return l.ipProto(value), nil
+	case "ip6":
+		return l.ip6Proto(value), nil
+	case "":
+		return bpfOrOf(l.ipProto(value), l.ip6Proto(value)), nil
+	}
+	return nil, fmt.Errorf("%s proto isn't supported", prim.proto)
+}
+
+func (l bpfLink) lowerHost(prim bpfPrimitive) (bpfNode, error) {
+	if prim.proto == "ether" {
+		mac, err := net.ParseMAC(prim.id)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("`%s` isn't a MAC address", prim.id)
+		}
+		if !l.ethernet {
+			return bpfConst(false), nil
+		}
+		macAt := func(offset uint32) bpfNode {
+			return bpfAndOf(cmpEq(layerLink, offset, bpfW, uint32(mac[0])<<24|uint32(mac[1])<<16|uint32(mac[2])<<8|uint32(mac[3])),
+				cmpEq(layerLink, offset+4, bpfH, uint32(mac[4])<<8|uint32(mac[5])))
+		}
+		return bpfDir(prim.dir, macAt(6), macAt(0)), nil
+	}
+	ip := net.ParseIP(prim.id)
+	if ip == nil {
+		return nil, fmt.Errorf("`%s` isn't an IP address (hostnames aren't looked up)", prim.id)
+	}
+	prefix := 32
+	if ip.To4() == nil {
+		prefix = 128
+	}
+	return l.lowerAddress(prim, ip, prefix)
+}
+
+func (l bpfLink) lowerNet(prim bpfPrimitive) (bpfNode, error) {
+	id := prim.id
+	if prim.mask != "" {
+		mask := net.ParseIP(prim.mask).To4()
+		if mask == nil {
+			return nil, fmt.Errorf("`%s` isn't a netmask", prim.mask)
+		}
+		ones, bits := net.IPMask(mask).Size()
+		if bits == 0 {
+			return nil, fmt.Errorf("`%s` isn't a netmask", prim.mask)
+		}
+		id = fmt.Sprintf("%s/%d", id, ones)
+	}
+	if !strings.Contains(id, "/") {
+		if ip := net.ParseIP(id); ip != nil && ip.To4() == nil {
+			id += "/128"
+		} else {
+			// Like libpcap, 10.1 is 10.1.0.0/16
+			octets := strings.Split(id, ".")
+			prefix := 8 * len(octets)
+			for len(octets) < 4 {
+				octets = append(octets, "0")
+			}
+			id = fmt.Sprintf("%s/%d", strings.Join(octets, "."), prefix)
+		}
+	}
+	ip, ipNet, err := net.ParseCIDR(id)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` isn't a network", prim.id)
+	}
+	ones, _ := ipNet.Mask.Size()
+	return l.lowerAddress(prim, ip, ones)
+}
+
+// lowerAddress compares the source or destination address of IPv4, ARP or IPv6 packets with the first prefix bits of ip
+func (l bpfLink) lowerAddress(prim bpfPrimitive, ip net.IP, prefix int) (bpfNode, error) {
+	// addressAt compares the words of an address at offset
+	addressAt := func(address net.IP, offset uint32) bpfNode {
+		words := make([]bpfNode, 0, 4)
+		for i := 0; i < len(address)/4; i++ {
+			bits := prefix - 32*i
+			if bits <= 0 {
+				break
+			}
+			mask := ^uint32(0)
+			if bits < 32 {
+				mask <<= uint(32 - bits)
+			}
+			word := uint32(address[4*i])<<24 | uint32(address[4*i+1])<<16 | uint32(address[4*i+2])<<8 | uint32(address[4*i+3])
+			words = append(words, bpfCmp{layer: layerNet, offset: offset + uint32(4*i), size: bpfW, mask: mask, op: "==", value: word & mask})
+		}
+		return bpfAndOf(words...)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		nodes := make([]bpfNode, 0, 2)
+		switch prim.proto {
+		case "", "ip", "tcp", "udp", "sctp", "icmp":
+			var isProto bpfNode = l.isIPv4()
+			if prim.proto != "" && prim.proto != "ip" {
+				isProto = l.ipProto(bpfIPProtos[prim.proto])
+			}
+			nodes = append(nodes, bpfAndOf(isProto, bpfDir(prim.dir, addressAt(ip4, 12), addressAt(ip4, 16))))
+		case "ip6", "icmp6":
+			return nil, fmt.Errorf("`%s` isn't an IPv6 address", prim.id)
+		}
+		if prim.proto == "" || prim.proto == "arp" {
+			nodes = append(nodes, bpfAndOf(l.layerCheck("arp"), bpfDir(prim.dir, addressAt(ip4, 14), addressAt(ip4, 24))))
+		}
+		return bpfOrOf(nodes...), nil
+	}
+	switch prim.proto {
+	case "", "ip6":
+		return bpfAndOf(l.isIPv6(), bpfDir(prim.dir, addressAt(ip, 8), addressAt(ip, 24))), nil
+	case "tcp", "udp", "sctp", "icmp6":
+		return bpfAndOf(l.ip6Proto(bpfIPProtos[prim.proto]), bpfDir(prim.dir, addressAt(ip, 8), addressAt(ip, 24))), nil
+	}
+	return nil, fmt.Errorf("`%s` isn't an IPv4 address", prim.id)
+}
+
+// lowerPort lowers port and portrange of TCP, UDP and SCTP over IPv4 and IPv6
+func (l bpfLink) lowerPort(prim bpfPrimitive) (bpfNode, error) {
+	low, high, err := parsePortRange(prim)
+	if err != nil {
+		return nil, err
+	}
+	protos := []string{"tcp", "udp", "sctp"}
+	ipv4, ipv6 := true, true
+	switch prim.proto {
+	case "tcp", "udp", "sctp":
+		protos = []string{prim.proto}
+	case "ip":
+		ipv6 = false
+	case "ip6":
+		ipv4 = false
+	case "":
+	default:
+		return nil, fmt.Errorf("%s %s isn't supported", prim.proto, prim.kind)
+	}
+	portAt := func(layer int, offset uint32) bpfNode {
+		if low == high {
+			return cmpEq(layer, offset, bpfH, low)
+		}
+		return bpfAndOf(bpfCmp{layer: layer, offset: offset, size: bpfH, mask: ^uint32(0), op: ">=", value: low},
+			bpfNot{bpfCmp{layer: layer, offset: offset, size: bpfH, mask: ^uint32(0), op: ">", value: high}})
+	}
+	nodes := make([]bpfNode, 0, 2)
+	if ipv4 {
+		isProto := make([]bpfNode, len(protos))
+		for i, proto := range protos {
+			isProto[i] = cmpEq(layerNet, 9, bpfB, bpfIPProtos[proto])
+		}
+		nodes = append(nodes, bpfAndOf(l.isIPv4(), bpfOrOf(isProto...), notFragment(),
+			bpfDir(prim.dir, portAt(layerTransport, 0), portAt(layerTransport, 2))))
+	}
+	if ipv6 {
+		// Like libpcap, only transport headers right after the IPv6 header are found
+		isProto := make([]bpfNode, len(protos))
+		for i, proto := range protos {
+			isProto[i] = cmpEq(layerNet, 6, bpfB, bpfIPProtos[proto])
+		}
+		nodes = append(nodes, bpfAndOf(l.isIPv6(), bpfOrOf(isProto...),
+			bpfDir(prim.dir, portAt(layerNet, 40), portAt(layerNet, 42))))
+	}
+	return bpfOrOf(nodes...), nil
+}
+
+// parsePortRange returns the lowest and highest port of a port, like 80 or http, or of a portrange like 1-1023
+func parsePortRange(prim bpfPrimitive) (uint32, uint32, error) {
+	parts := []string{prim.id}
+	if prim.kind == "portrange" {
+		if parts = strings.SplitN(prim.id, "-", 2); len(parts) != 2 {
+			return 0, 0, fmt.Errorf("`%s` isn't a port range like 1-1023", prim.id)
+		}
+	}
+	ports := make([]uint32, len(parts))
+	for i, part := range parts {
+		port, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			named, lookupErr := net.LookupPort("tcp", part)
+			if lookupErr != nil {
+				return 0, 0, fmt.Errorf("`%s` isn't a port", part)
+			}
+			port = uint64(named)
+		}
+		ports[i] = uint32(port)
+	}
+	if ports[0] > ports[len(ports)-1] {
+		return ports[len(ports)-1], ports[0], nil
+	}
+	return ports[0], ports[len(ports)-1], nil
+}
+
+// bpfCode generates a program. Jumps go to labels, which are resolved to offsets once every instruction is placed.
+type bpfCode struct {
+	link   bpfLink
+	insns  []bpfInsn
+	jumps  map[int][2]int // Instruction index to its true and false labels
+	labels []int          // Instruction index of each label
+}
+
+// compileBPF compiles a parsed filter to a program for a link type
+func compileBPF(root bpfNode, linkType uint32) ([]bpfInsn, error) {
+	link, ok := bpfLinks[linkType]
+	if !ok {
+		return nil, fmt.Errorf("link type %d isn't supported", linkType)
+	}
+	lowered, err := link.lower(root)
+	if err != nil {
+		return nil, err
+	}
+	c := &bpfCode{link: link, jumps: make(map[int][2]int)}
+	accept, reject := c.label(), c.label()
+	if err := c.cond(lowered, accept, reject); err != nil {
+		return nil, err
+	}
+	c.place(accept)
+	c.emit(bpfRET|bpfK, bpfAccept)
+	c.place(reject)
+	c.emit(bpfRET|bpfK, 0)
+	return c.resolve()
+}
+
+func (c *bpfCode) label() int {
+	c.labels = append(c.labels, -1)
+	return len(c.labels) - 1
+}
+
+func (c *bpfCode) place(label int) {
+	c.labels[label] = len(c.insns)
+}
+
+func (c *bpfCode) emit(op uint16, k uint32) {
+	c.insns = append(c.insns, bpfInsn{Op: op, K: k})
+}
+
+func (c *bpfCode) jump(op uint16, k uint32, onTrue int, onFalse int) {
+	c.jumps[len(c.insns)] = [2]int{onTrue, onFalse}
+	c.emit(op, k)
+}
+
+// resolve turns labels into jump offsets, which classic BPF limits to 255 instructions for conditional jumps
+func (c *bpfCode) resolve() ([]bpfInsn, error) {
+	for i := range c.insns {
+		targets, ok := c.jumps[i]
+		if !ok {
+			continue
+		}
+		onTrue, onFalse := c.labels[targets[0]]-(i+1), c.labels[targets[1]]-(i+1)
+		if c.insns[i].Op == bpfJMP|bpfJA {
+			c.insns[i].K = uint32(onTrue)
+			continue
+		}
+		if onTrue > 255 || onFalse > 255 {
+			return nil, fmt.Errorf("filter is too long for BPF's jumps")
+		}
+		c.insns[i].Jt, c.insns[i].Jf = uint8(onTrue), uint8(onFalse)
+	}
+	return c.insns, nil
+}
+
+// cond generates code that jumps to onTrue if node is true of a packet and to onFalse if not
+func (c *bpfCode) cond(node bpfNode, onTrue int, onFalse int) error {
+	switch n := node.(type) {
+	case bpfConst:
+		target := onFalse
+		if n {
+			target = onTrue
+		}
+		c.jump(bpfJMP|bpfJA, 0, target, target)
+	case bpfAnd:
+		next := c.label()
+		if err := c.cond(n.left, next, onFalse); err != nil {
+			return err
+		}
+		c.place(next)
+		return c.cond(n.right, onTrue, onFalse)
+	case bpfOr:
+		next := c.label()
+		if err := c.cond(n.left, onTrue, next); err != nil {
+			return err
+		}
+		c.place(next)
+		return c.cond(n.right, onTrue, onFalse)
+	case bpfNot:
+		return c.cond(n.node, onFalse, onTrue)
+	case bpfCmp:
+		c.load(n.layer, n.offset, n.size)
+		if n.mask != ^uint32(0) {
+			c.emit(bpfALU|bpfAND|bpfK, n.mask)
+		}
+		c.compare(n.op, bpfK, n.value, onTrue, onFalse)
+	case bpfRelation:
+		if value, ok := n.right.(bpfNumber); ok {
+			if err := c.arith(n.left, 0); err != nil {
+				return err
+			}
+			c.compare(n.op, bpfK, uint32(value), onTrue, onFalse)
+			return nil
+		}
+		if err := c.arith(n.right, 0); err != nil {
+			return err
+		}
+		c.emit(bpfST, 0)
+		if err := c.arith(n.left, 1); err != nil {
+			return err
+		}
+		c.emit(bpfLDX|bpfMEM, 0)
+		c.compare(n.op, bpfX, 0, onTrue, onFalse)
+	default:
+		return fmt.Errorf("unexpected %T", node)
+	}
+	return nil
+}
+
+// compare jumps on A compared with k or X. Classic BPF only has ==, > and >=, so the others swap targets.
+func (c *bpfCode) compare(op string, src uint16, k uint32, onTrue int, onFalse int) {
+	switch op {
+	case "==":
+		c.jump(bpfJMP|bpfJEQ|src, k, onTrue, onFalse)
+	case "!=":
+		c.jump(bpfJMP|bpfJEQ|src, k, onFalse, onTrue)
+	case ">":
+		c.jump(bpfJMP|bpfJGT|src, k, onTrue, onFalse)
+	case "<=":
+		c.jump(bpfJMP|bpfJGT|src, k, onFalse, onTrue)
+	case ">=":
+		c.jump(bpfJMP|bpfJGE|src, k, onTrue, onFalse)
+	case "<":
+		c.jump(bpfJMP|bpfJGE|src, k, onFalse, onTrue)
+	case "&":
+		c.jump(bpfJMP|bpfJSET|src, k, onTrue, onFalse)
+	}
+}
+
+// load loads size bytes at offset of a layer into A
+func (c *bpfCode) load(layer int, offset uint32, size uint16) {
+	switch layer {
+	case layerLink:
+		c.emit(bpfLD|size|bpfABS, offset)
+	case layerNet:
+		c.emit(bpfLD|size|bpfABS, c.link.netOffset+offset)
+	case layerTransport:
+		c.emit(bpfLDX|bpfB|bpfMSH, c.link.netOffset)
+		c.emit(bpfLD|size|bpfIND, c.link.netOffset+offset)
+	}
+}
+
+// arith generates code that leaves the value of arithmetic in A, using scratch memory from scratch up
+func (c *bpfCode) arith(arith bpfArith, scratch uint32) error {
+	if scratch >= bpfMemWords {
+		return fmt.Errorf("arithmetic is nested too deeply")
+	}
+	switch a := arith.(type) {
+	case bpfNumber:
+		c.emit(bpfLD|bpfIMM, uint32(a))
+	case bpfLen:
+		c.emit(bpfLD|bpfW|bpfLEN, 0)
+	case bpfLoad:
+		layer := bpfAccessors[a.proto]
+		if offset, ok := a.offset.(bpfNumber); ok {
+			c.load(layer, uint32(offset), a.size)
+			return nil
+		}
+		if err := c.arith(a.offset, scratch); err != nil {
+			return err
+		}
+		base := c.link.netOffset
+		switch layer {
+		case layerLink:
+			base = 0
+		case layerTransport:
+			// Add the length of the IPv4 header to the offset
+			c.emit(bpfST, scratch)
+			c.emit(bpfLDX|bpfB|bpfMSH, c.link.netOffset)
+			c.emit(bpfLD|bpfMEM, scratch)
+			c.emit(bpfALU|bpfADD|bpfX, 0)
+		}
+		c.emit(bpfMISC|bpfTAX, 0)
+		c.emit(bpfLD|a.size|bpfIND, base)
+	case bpfBinary:
+		op := bpfALUOps[a.op]
+		if value, ok := a.right.(bpfNumber); ok {
+			if err := c.arith(a.left, scratch); err != nil {
+				return err
+			}
+			c.emit(bpfALU|op|bpfK, uint32(value))
+			return nil
+		}
+		if err := c.arith(a.right, scratch); err != nil {
+			return err
+		}
+		c.emit(bpfST, scratch)
+		if err := c.arith(a.left, scratch+1); err != nil {
+			return err
+		}
+		c.emit(bpfLDX|bpfMEM, scratch)
+		c.emit(bpfALU|op|bpfX, 0)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ipv4Packet returns an Ethernet frame with an IPv4 header and the start of a TCP or UDP header
+func ipv4Packet(proto byte, src string, dst string, srcPort uint16, dstPort uint16, tcpFlags byte) []byte {
+	packet := make([]byte, 14+20+20)
+	copy(packet, []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x08, 0x00})
+	ip := packet[14:]
+	ip[0] = 0x45
+	ip[9] = proto
+	copy(ip[12:], net.ParseIP(src).To4())
+	copy(ip[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ip[20:], srcPort)
+	binary.BigEndian.PutUint16(ip[22:], dstPort)
+	ip[33] = tcpFlags
+	return packet
+}
+
+// ipv6Packet returns an Ethernet frame with an IPv6 header from ::1 to ::2 and a UDP header
+func ipv6Packet(srcPort uint16, dstPort uint16) []byte {
+	packet := make([]byte, 14+40+8)
+	copy(packet[12:], []byte{0x86, 0xdd})
+	ip := packet[14:]
+	ip[0] = 0x60
+	ip[6] = 17
+	ip[23] = 1
+	ip[39] = 2
+	binary.BigEndian.PutUint16(ip[40:], srcPort)
+	binary.BigEndian.PutUint16(ip[42:], dstPort)
+	return packet
+}
+
+// TestBPFFilter tests that filters match the packets they describe
+func TestBPFFilter(t *testing.T) {
+	syn := ipv4Packet(6, "10.0.0.1", "192.168.1.2", 40000, 5060, 0x02)
+	ack := ipv4Packet(6, "10.0.0.1", "192.168.1.2", 40000, 5060, 0x10)
+	dns := ipv4Packet(17, "192.168.1.2", "8.8.8.8", 53000, 53, 0)
+	arp := make([]byte, 42)
+	copy(arp[12:], []byte{0x08, 0x06})
+	copy(arp[14+14:], net.ParseIP("10.0.0.1").To4())
+	ip6 := ipv6Packet(5060, 5061)
+	tests := []struct {
+		expr    string
+		packets [][]byte
+		want    []bool
+	}{
+		{"", [][]byte{syn, arp}, []bool{true, true}},
+		{"tcp[13] & 2 != 0 and port 5060", [][]byte{syn, ack, dns, ip6}, []bool{true, false, false, false}},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", [][]byte{syn, ack}, []bool{true, false}},
+		{"host 10.0.0.1", [][]byte{syn, dns, arp}, []bool{true, false, true}},
+		{"ip host 10.0.0.1", [][]byte{syn, arp}, []bool{true, false}},
+		{"src host 192.168.1.2", [][]byte{syn, dns}, []bool{false, true}},
+		{"net 10.0.0.0/8", [][]byte{syn, dns}, []bool{true, false}},
+		{"dst net 192.168", [][]byte{syn, dns}, []bool{true, false}},
+		{"net 8.0.0.0 mask 255.0.0.0", [][]byte{syn, dns}, []bool{false, true}},
+		{"udp", [][]byte{syn, dns, ip6}, []bool{false, true, true}},
+		{"not arp", [][]byte{syn, arp}, []bool{true, false}},
+		{"udp dst port 53 or arp", [][]byte{syn, dns, arp}, []bool{false, true, true}},
+		{"portrange 5060-5070", [][]byte{syn, dns, ip6}, []bool{true, false, true}},
+		{"less 50", [][]byte{syn, arp}, []bool{false, true}},
+		{"greater 60", [][]byte{syn, ip6}, []bool{false, true}},
+		{"ip6 host ::1", [][]byte{syn, ip6}, []bool{false, true}},
+		{"ip6 and dst port 5061", [][]byte{syn, ip6}, []bool{false, true}},
+		{"ether src 11:22:33:44:55:66", [][]byte{syn, ip6}, []bool{true, false}},
+		{"ether proto 0x86dd", [][]byte{syn, ip6}, []bool{false, true}},
+		{"ip proto 17", [][]byte{syn, dns}, []bool{false, true}},
+		{"ip[9] == 6 && (tcp[2:2] = 5060)", [][]byte{syn, dns}, []bool{true, false}},
+		{"len - 14 >= 40 and (ip[0] & 0xf) * 4 = 20", [][]byte{syn, arp}, []bool{true, false}},
+		{"ip[0] & 0xf * 4 = 4", [][]byte{syn}, []bool{true}},
+		{"tcp[(ip[0] & 0) + 13] & 2 != 0", [][]byte{syn, ack}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			filter, err := CompileBPF(tt.expr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for i, packet := range tt.packets {
+				got, err := filter.Match(linkTypeEthernet, packet)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want[i], got, "packet %d", i)
+			}
+		})
+	}
+}
+
+// TestBPFFilterLinkTypes tests that filters find the network layer of other link types
+func TestBPFFilterLinkTypes(t *testing.T) {
+	ethernet := ipv4Packet(17, "192.168.1.2", "8.8.8.8", 53000, 53, 0)
+	sll := append(make([]byte, 16), ethernet[14:]...)
+	copy(sll[14:], []byte{0x08, 0x00})
+	filter, err := CompileBPF("udp port 53 and host 8.8.8.8")
+	assert.NoError(t, err)
+	for linkType, packet := range map[uint32][]byte{linkTypeEthernet: ethernet, linkTypeLinuxSLL: sll,
+		linkTypeRaw: ethernet[14:], linkTypeIPv4: ethernet[14:]} {
+		got, err := filter.Match(linkType, packet)
+		assert.NoError(t, err)
+		assert.True(t, got, "link type %d", linkType)
+	}
+	got, err := filter.Match(linkTypeIPv6, ethernet[14:])
+	assert.NoError(t, err)
+	assert.False(t, got)
+	_, err = filter.Match(105, ethernet)
+	assert.EqualError(t, err, "Invalid capture filter `udp port 53 and host 8.8.8.8`: link type 105 isn't supported")
+}
+
+// TestCompileBPFErrors tests that bad filters fail before any packet is read
+func TestCompileBPFErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"tcp port", "Invalid capture filter `tcp port`: expected an address, port or protocol at the end"},
+		{"port 5060 an udp", "Invalid capture filter `port 5060 an udp`: expected and or or at `an`"},
+		{"tcp[13] & 2 !=", "Invalid capture filter `tcp[13] & 2 !=`: expected a number at the end"},
+		{"(udp", "Invalid capture filter `(udp`: expected ) at the end"},
+		{"tcp[13:3] = 0", "Invalid capture filter `tcp[13:3] = 0`: expected a size of 1, 2 or 4 at `3`"},
+		{"host example.com", "Invalid capture filter `host example.com`: `example.com` isn't an IP address (hostnames aren't looked up)"},
+		{"ip6 host 10.0.0.1", "Invalid capture filter `ip6 host 10.0.0.1`: `10.0.0.1` isn't an IPv6 address"},
+		{"port 70000", "Invalid capture filter `port 70000`: `70000` isn't a port"},
+		{"port 1 # 2", "Invalid capture filter `port 1 # 2`: unexpected '#'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := CompileBPF(tt.expr)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+// TestBPFVM tests that compiled programs run on the VM, which rejects loads out of bounds and division by zero
+func TestBPFVM(t *testing.T) {
+	packet := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name string
+		prog []bpfInsn
+		want int
+	}{
+		{"Word", []bpfInsn{{Op: bpfLD | bpfW | bpfABS}, {Op: bpfRET | bpfA}}, 0x01020304},
+		{"Out of bounds", []bpfInsn{{Op: bpfLD | bpfH | bpfABS, K: 3}, {Op: bpfRET | bpfK, K: 1}}, 0},
+		{"Division by zero", []bpfInsn{{Op: bpfLD | bpfIMM, K: 4}, {Op: bpfALU | bpfDIV | bpfX}, {Op: bpfRET | bpfK, K: 1}}, 0},
+		{"Captured length", []bpfInsn{{Op: bpfLD | bpfW | bpfLEN}, {Op: bpfRET | bpfA}}, 4},
+		{"Scratch", []bpfInsn{{Op: bpfLD | bpfIMM, K: 7}, {Op: bpfST, K: 3}, {Op: bpfLDX | bpfMEM, K: 3},
+			{Op: bpfMISC | bpfTXA}, {Op: bpfRET | bpfA}}, 7},
+		{"Jump", []bpfInsn{{Op: bpfLD | bpfB | bpfABS, K: 1}, {Op: bpfJMP | bpfJGT | bpfK, K: 1, Jt: 1}, {Op: bpfRET | bpfK},
+			{Op: bpfRET | bpfK, K: 9}}, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, err := newBPFVM(tt.prog)
+			assert.NoError(t, err)
+			got, err := vm.Run(packet)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestGrepBPF tests that packets of pcap and pcapng files are filtered without tshark
+func TestGrepBPF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap-bpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	pcapFile, pcapngFile := header, pcapngHead(binary.LittleEndian, 6)
+	for _, port := range []uint16{80, 5060, 443, 5060} {
+		// 54 byte packets, padded to 56 in pcapng
+		packet := ipv4Packet(6, "10.0.0.1", "10.0.0.2", 40000, port, 0x02)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+		pcapFile = concat(pcapFile, record, packet)
+		epb := make([]byte, 28, 88)
+		binary.LittleEndian.PutUint32(epb, blockEPB)
+		binary.LittleEndian.PutUint32(epb[4:], 88)
+		binary.LittleEndian.PutUint32(epb[20:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(epb[24:], uint32(len(packet)))
+		epb = append(append(epb, packet...), 0, 0, 88, 0, 0, 0)
+		pcapngFile = concat(pcapngFile, epb)
+	}
+	filter, err := CompileBPF("tcp[13] & 2 != 0 and port 5060")
+	assert.NoError(t, err)
+	for name, content := range map[string][]byte{"capture.pcap": pcapFile, "capture.pcapng": pcapngFile} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+		got, err := GrepBPF(context.Background(), path, filter)
+		assert.NoError(t, err)
+		assert.Equal(t, GrepResult{Matches: 2, FirstFrames: []int{2, 4}}, got, name)
+	}
+}
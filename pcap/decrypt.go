@@ -0,0 +1,121 @@
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Decryption has the secrets that tshark should decrypt a capture with
+type Decryption struct {
+	Keylogs []string // TLS keylog (SSLKEYLOGFILE) or premaster secret files
+	RSAKeys []string // PEM private keys without passwords
+	ESPSAs  []string // Wireshark esp_sa files
+}
+
+// IsEmpty returns whether there is nothing to decrypt with
+func (d Decryption) IsEmpty() bool {
+	return len(d.Keylogs)+len(d.RSAKeys)+len(d.ESPSAs) == 0
+}
+
+// tsharkArgs returns the -o preferences for d. tshark only takes one keylog file, so several are
+// combined into a temporary file that cleanup deletes.
+func (d Decryption) tsharkArgs() (args []string, cleanup func(), err error) {
+	cleanup = func() {}
+	if len(d.Keylogs) == 1 {
+		args = append(args, "-o", "tls.keylog_file:"+d.Keylogs[0])
+	} else if len(d.Keylogs) > 1 {
+		combined, combineErr := combineFiles(d.Keylogs)
+		if combineErr != nil {
+			return nil, cleanup, combineErr
+		}
+		cleanup = func() { os.Remove(combined) }
+		args = append(args, "-o", "tls.keylog_file:"+combined)
+	}
+	for _, key := range d.RSAKeys {
+		// rsa_keys records are "<key file>","<password>"
+		args = append(args, "-o", fmt.Sprintf(`uat:rsa_keys:"%s",""`, key))
+	}
+	if len(d.ESPSAs) > 0 {
+		args = append(args, "-o", "esp.enable_encryption_decode:TRUE")
+	}
+	for _, espSA := range d.ESPSAs {
+		records, readErr := uatRecords(espSA)
+		if readErr != nil {
+			cleanup()
+			return nil, func() {}, readErr
+		}
+		for _, record := range records {
+			args = append(args, "-o", "uat:esp_sa:"+record)
+		}
+	}
+	return args, cleanup, nil
+}
+
+// uatRecords returns the lines of a Wireshark UAT file that aren't blank or comments
+func uatRecords(fPath string) ([]string, error) {
+	f, err := os.Open(fPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			records = append(records, line)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func combineFiles(paths []string) (string, error) {
+	combined, err := ioutil.TempFile("", "hubcap_keylog")
+	if err != nil {
+		return "", err
+	}
+	defer combined.Close()
+	for _, fPath := range paths {
+		contents, readErr := ioutil.ReadFile(fPath)
+		if readErr != nil {
+			os.Remove(combined.Name())
+			return "", readErr
+		}
+		combined.Write(contents)
+		combined.Write([]byte("\n"))
+	}
+	return combined.Name(), nil
+}
+
+// GetDecryptedTsharkJSON is GetTsharkJSON for a capture decrypted with dec. Only the first
+// maxPackets are read if it isn't 0, which is how sampled captures are decrypted.
+func GetDecryptedTsharkJSON(ctx context.Context, filename string, dec Decryption, maxPackets int) ([]string, map[string][]int, error) {
+	prefs, cleanup, err := dec.tsharkArgs()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+	if maxPackets > 0 {
+		prefs = append(prefs, "-c", strconv.Itoa(maxPackets))
+	}
+	return getTsharkJSON(ctx, filename, prefs)
+}
+
+// RevealsProtocols returns whether decrypted has protocols that plain doesn't
+func RevealsProtocols(plain []string, decrypted []string) bool {
+	seen := make(map[string]bool, len(plain))
+	for _, protocol := range plain {
+		seen[protocol] = true
+	}
+	for _, protocol := range decrypted {
+		if !seen[protocol] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package pcap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDecryptionArgs tests that secrets become tshark preferences
+func TestDecryptionArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	espSA := filepath.Join(dir, "esp_sa")
+	record := `"IPv4","10.0.0.1","10.0.0.2","0x00000101","AES-CBC [RFC3602]","0x00112233445566778899aabbccddeeff","HMAC-SHA-1-96 [RFC2404]","0x00112233445566778899aabbccddeeff00112233"`
+	ioutil.WriteFile(espSA, []byte("# This file is automatically generated, DO NOT MODIFY.\n"+record+"\n"), 0644)
+	keylogA, keylogB := filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")
+	ioutil.WriteFile(keylogA, []byte("CLIENT_RANDOM 01 02"), 0644)
+	ioutil.WriteFile(keylogB, []byte("CLIENT_RANDOM 03 04"), 0644)
+
+	args, cleanup, err := Decryption{Keylogs: []string{keylogA}, RSAKeys: []string{"/k/server.key"}, ESPSAs: []string{espSA}}.tsharkArgs()
+	assert.Nil(t, err)
+	cleanup()
+	assert.Equal(t, []string{
+		"-o", "tls.keylog_file:" + keylogA,
+		"-o", `uat:rsa_keys:"/k/server.key",""`,
+		"-o", "esp.enable_encryption_decode:TRUE",
+		"-o", "uat:esp_sa:" + record,
+	}, args)
+
+	// tshark takes one keylog, so several are combined until cleanup
+	args, cleanup, err = Decryption{Keylogs: []string{keylogA, keylogB}}.tsharkArgs()
+	assert.Nil(t, err)
+	combined := args[1][len("tls.keylog_file:"):]
+	contents, _ := ioutil.ReadFile(combined)
+	assert.Equal(t, "CLIENT_RANDOM 01 02\nCLIENT_RANDOM 03 04\n", string(contents))
+	cleanup()
+	_, statErr := os.Stat(combined)
+	assert.True(t, os.IsNotExist(statErr))
+
+	assert.True(t, RevealsProtocols([]string{"eth", "ip", "tcp", "tls"}, []string{"eth", "ip", "tcp", "tls", "http2"}))
+	assert.False(t, RevealsProtocols([]string{"eth", "ip", "tcp", "tls"}, []string{"eth", "ip", "tcp", "tls"}))
+}
@@ -0,0 +1,62 @@
+package pcap
+
+import (
+	"strings"
+)
+
+// Kinds of endpoints that captures are indexed by
+const (
+	EndpointIP     = "ip"
+	EndpointMAC    = "mac"
+	EndpointDomain = "domain"
+	EndpointPort   = "port" // TCP or UDP
+)
+
+// endpointFields are read after protoPortFields for the endpoints of packets
+var endpointFields = []string{"eth.src", "eth.dst", "ip.src", "ip.dst", "ipv6.src", "ipv6.dst",
+	"dns.qry.name", "http.host", "tls.handshake.extensions_server_name"}
+
+// endpointKinds are the kinds of protoPortFields and then endpointFields. Fields of no kind aren't endpoints.
+var endpointKinds = []string{"", EndpointPort, EndpointPort, EndpointPort, EndpointPort,
+	EndpointMAC, EndpointMAC, EndpointIP, EndpointIP, EndpointIP, EndpointIP, EndpointDomain, EndpointDomain, EndpointDomain}
+
+// Endpoints counts the packets of a capture that have each endpoint, by kind and then by value
+type Endpoints map[string]map[string]int
+
+// endpointCounter adds up the endpoints of packets as they are read
+type endpointCounter struct {
+	counts Endpoints
+	packet map[string]bool // Endpoints already counted for the packet being added
+}
+
+// add adds a packet's values of protoPortFields and endpointFields. A packet counts once
+// for an endpoint, even when it's both the source and destination.
+func (c *endpointCounter) add(values []string) {
+	if c.counts == nil {
+		c.counts = make(Endpoints)
+		c.packet = make(map[string]bool)
+	}
+	for key := range c.packet {
+		delete(c.packet, key)
+	}
+	for i, value := range values {
+		if i >= len(endpointKinds) || endpointKinds[i] == "" || value == "" {
+			continue
+		}
+		kind := endpointKinds[i]
+		// Tunneled packets have a value for each layer
+		for _, endpoint := range strings.Split(value, ",") {
+			if kind == EndpointDomain {
+				endpoint = strings.ToLower(strings.TrimSuffix(endpoint, "."))
+			}
+			if endpoint == "" || c.packet[kind+":"+endpoint] {
+				continue
+			}
+			c.packet[kind+":"+endpoint] = true
+			if c.counts[kind] == nil {
+				c.counts[kind] = make(map[string]int)
+			}
+			c.counts[kind][endpoint]++
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package pcap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEndpointCounter tests that each packet counts once for each of its endpoints
+func TestEndpointCounter(t *testing.T) {
+	packets := [][]string{
+		{"eth:ethertype:ip:udp:dns", "", "", "53000", "53", "aa:bb:cc:dd:ee:ff", "11:22:33:44:55:66",
+			"10.0.0.1", "8.8.8.8", "", "", "Example.COM.", "", ""},
+		{"eth:ethertype:ip:udp:dns", "", "", "53", "53000", "11:22:33:44:55:66", "aa:bb:cc:dd:ee:ff",
+			"8.8.8.8", "10.0.0.1", "", "", "example.com", "", ""},
+		// A tunneled packet has an address for each layer, and is counted once for 10.0.0.1
+		{"eth:ethertype:ip:gre:ip:tcp", "443", "443", "", "", "aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:ff",
+			"10.0.0.1,10.0.0.1", "10.0.0.2,10.0.0.3", "", "", "", "", "www.example.com"},
+		{"eth:ethertype:ipv6:icmpv6", "", "", "", "", "", "", "", "", "fe80::1", "ff02::1", "", "", ""},
+	}
+	var c endpointCounter
+	for _, packet := range packets {
+		c.add(packet)
+	}
+	want := Endpoints{
+		EndpointPort:   {"53": 2, "53000": 2, "443": 1},
+		EndpointMAC:    {"aa:bb:cc:dd:ee:ff": 3, "11:22:33:44:55:66": 2},
+		EndpointIP:     {"10.0.0.1": 3, "8.8.8.8": 2, "10.0.0.2": 1, "10.0.0.3": 1, "fe80::1": 1, "ff02::1": 1},
+		EndpointDomain: {"example.com": 2, "www.example.com": 1},
+	}
+	assert.Equal(t, want, c.counts)
+}
@@ -2,29 +2,44 @@
 package pcap
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"strings"
 )
 
-// IsPcap returns whether Wireshark recognizes the file as a capture
+// IsPcap returns whether Wireshark recognizes the file as a capture.
+// The magic numbers of pcap and pcapng are trusted, and capinfos is asked about every other file
+// because the other formats DetectFormat finds are guessed from a few bytes or markers.
+func IsPcap(ctx context.Context, filepath string) error {
+	format, ok := DetectFileFormat(filepath)
+	if !ok {
+		return capinfosIsPcap(ctx, filepath)
+	}
+	switch format.Name {
+	case FormatPcap, FormatPcapNsec, FormatPcapMod, FormatPcapng:
+		if !hasPackets(filepath, format) {
+			return fmt.Errorf("%s is a %s file without packets", filepath, format.Name)
+		}
+		return nil
+	}
+	return capinfosIsPcap(ctx, filepath)
+}
+
+// capinfosIsPcap is the fallback for formats without a known header
 // Capinfos' StrictTimeOrder (-o) being detected is most predictive of being pcap
-func IsPcap(filepath string) error {
-	cmd := exec.Command("capinfos", "-c", "-o", filepath)
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	err := cmd.Run()
-	if err != nil && !strings.Contains(string(stderr.Bytes()), "cut short in the middle of a packet") {
-		return fmt.Errorf("\033[91mERROR\033[0m captype failed: %s when parsing filepath %s.\n%s", err, filepath, string(stderr.Bytes()))
+func capinfosIsPcap(ctx context.Context, filepath string) error {
+	stdout, stderr, err := runTool(ctx, tools.Capinfos, "-c", "-o", filepath)
+	if FailureCategory(err) != "" {
+		return err
 	}
-	outputStr := string(stdout.Bytes())
+	if err != nil && !strings.Contains(string(stderr), "cut short in the middle of a packet") {
+		return fmt.Errorf("\033[91mERROR\033[0m captype failed: %s when parsing filepath %s.\n%s", err, filepath, string(stderr))
+	}
+	outputStr := string(stdout)
 	isPcap := strings.Contains(outputStr, "Strict time order:   False") || strings.Contains(outputStr, "Strict time order:   True")
 	hasZeroPackets := strings.Contains(outputStr, "Number of packets:   0") // K12 files can be packet captures but also have no packets
 	if !isPcap || hasZeroPackets {
@@ -33,20 +48,6 @@ func IsPcap(filepath string) error {
 	return nil
 }
 
-// fixPcap will remove a common error "appears to have been cut short in the middle of a packet."
-// Editcap will report the same error so skip stdout/stderr
-func fixPcap(filepath string) {
-	cmd := exec.Command("editcap", filepath, filepath)
-	stderr := new(bytes.Buffer)
-	cmd.Stderr = stderr
-	cmd.Run()
-	errStr := string(stderr.Bytes())
-	// if not expected editcap error, treat as actual
-	if !strings.Contains(errStr, "cut short in the middle") && !strings.Contains(errStr, "appears to be damaged") {
-		fmt.Printf("\033[93mWARN\033[0m Problem fixing %s with editcap: %s\n", filepath, errStr)
-	}
-}
-
 // GetSHA256 will get the SHA256 of a file
 func GetSHA256(filename string) string {
 	f, err := os.Open(filename)
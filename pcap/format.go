@@ -0,0 +1,328 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DetectLen is how much of the start of a file DetectFormat needs
+const DetectLen = 4096
+
+// Capture formats that DetectFormat finds. Names match capinfos' file types where there is one.
+const (
+	FormatPcap       = "pcap"
+	FormatPcapNsec   = "nsecpcap"
+	FormatPcapMod    = "modpcap" // Alexey Kuznetzov's modified pcap
+	FormatPcapng     = "pcapng"
+	FormatERF        = "erf"
+	FormatSnoop      = "snoop"
+	FormatBtsnoop    = "btsnoop"
+	FormatNetmon1    = "netmon1"
+	FormatNetmon2    = "netmon2"
+	FormatK12        = "rf5" // Tektronix K12xx binary
+	FormatK12Text    = "k12text"
+	Format5Views     = "5views"
+	FormatObserver   = "niobserver" // Network Instruments Observer
+	FormatIptrace1   = "iptrace_1"
+	FormatIptrace2   = "iptrace_2"
+	FormatNetXray    = "netxray" // Also Windows Sniffer
+	FormatSniffer    = "ngsniffer"
+	FormatRadcom     = "radcom"
+	FormatVisual     = "visual"
+	FormatPeekTagged = "peektagged"
+	FormatEyeSDN     = "eyesdn"
+	FormatDCT2000    = "dct2000"
+	FormatAethra     = "aethra"
+	FormatMplog      = "mplog"
+	FormatJournal    = "systemd_journal"
+	FormatNettl      = "nettl"
+	FormatLanalyzer  = "lanalyzer"
+	FormatISeries    = "iseries"
+	FormatVMS        = "vms"
+	FormatDBS        = "dbs-etherwatch"
+)
+
+// Byte orders and timestamp precisions that DetectFormat reports
+const (
+	BigEndian    = "big"
+	LittleEndian = "little"
+	PrecisionSec = "s"
+	PrecisionMs  = "ms"
+	PrecisionUs  = "us"
+	PrecisionNs  = "ns"
+)
+
+// FileFormat is what a capture's header says about it
+type FileFormat struct {
+	Name       string // One of the Format* constants
+	Endianness string // BigEndian or LittleEndian. Empty for text formats.
+	Precision  string // Timestamp precision like us or ns, or 10^-N or 2^-N for unusual ones
+}
+
+type captureMagic struct {
+	offset int
+	prefix string
+	format FileFormat
+}
+
+// captureMagics are checked in order. pcap and pcapng are parsed separately.
+var captureMagics = []captureMagic{
+	{0, "snoop\x00\x00\x00", FileFormat{FormatSnoop, BigEndian, PrecisionUs}},
+	{0, "btsnoop\x00", FileFormat{FormatBtsnoop, BigEndian, PrecisionUs}},
+	{0, "RTSS", FileFormat{FormatNetmon1, LittleEndian, PrecisionMs}},
+	{0, "GMBU", FileFormat{FormatNetmon2, LittleEndian, PrecisionUs}},
+	{0, "\x00\x00\x02\x00\x12\x05\x00\x10", FileFormat{FormatK12, BigEndian, PrecisionNs}},
+	{0, "+---------+---------------+----------+", FileFormat{FormatK12Text, "", PrecisionUs}},
+	{0, "\xaa\xaa\xaa\xaa", FileFormat{Format5Views, LittleEndian, PrecisionNs}},
+	{0, "ObserverPktBufferVersion=", FileFormat{FormatObserver, LittleEndian, PrecisionNs}},
+	{0, "iptrace 1.0", FileFormat{FormatIptrace1, BigEndian, PrecisionSec}},
+	{0, "iptrace 2.0", FileFormat{FormatIptrace2, BigEndian, PrecisionNs}},
+	{0, "XCP\x00", FileFormat{FormatNetXray, LittleEndian, PrecisionUs}},
+	{0, "TRSNIFF data    \x1a", FileFormat{FormatSniffer, LittleEndian, PrecisionUs}},
+	{0, "\x42\xd2\x00\x34\x12\x66\x22\x88", FileFormat{FormatRadcom, LittleEndian, PrecisionNs}},
+	{0, "\x05VNF", FileFormat{FormatVisual, LittleEndian, PrecisionMs}},
+	{0, "\x7fver", FileFormat{FormatPeekTagged, LittleEndian, PrecisionNs}},
+	{0, "EyeSDN", FileFormat{FormatEyeSDN, BigEndian, PrecisionUs}},
+	{0, "Session Transcript", FileFormat{FormatDCT2000, "", PrecisionUs}},
+	{0, "V0208", FileFormat{FormatAethra, LittleEndian, PrecisionMs}},
+	{0, "MPCSII", FileFormat{FormatMplog, LittleEndian, PrecisionUs}},
+	{0, "LPKSHHRH", FileFormat{FormatJournal, LittleEndian, PrecisionUs}},
+	{0, "\x54\x52\x00\x64\x00", FileFormat{FormatNettl, BigEndian, PrecisionUs}},
+	{0, "\x01\x10\x4c\x00", FileFormat{FormatLanalyzer, LittleEndian, PrecisionNs}},
+}
+
+// textTraceMarkers are in the first lines of text traces that wireshark reads
+var textTraceMarkers = []struct {
+	marker string
+	format string
+}{
+	{"COMMUNICATIONS TRACE", FormatISeries},
+	{"TCPIPtrace", FormatVMS},
+	{"ETHERWATCH", FormatDBS},
+}
+
+// DetectFormat identifies a capture from the first DetectLen bytes of its file
+func DetectFormat(head []byte) (FileFormat, bool) {
+	if format, ok := detectPcap(head); ok {
+		return format, true
+	}
+	if format, ok := detectPcapng(head); ok {
+		return format, true
+	}
+	for _, m := range captureMagics {
+		if bytes.HasPrefix(head[minInt(m.offset, len(head)):], []byte(m.prefix)) {
+			return m.format, true
+		}
+	}
+	// Binary files can contain the markers by chance, so text traces can't have NULs
+	if bytes.IndexByte(head, 0) < 0 {
+		for _, trace := range textTraceMarkers {
+			if bytes.Contains(head, []byte(trace.marker)) {
+				return FileFormat{trace.format, "", PrecisionUs}, true
+			}
+		}
+	}
+	// ERF has no magic bytes, so it's last
+	if isERF(head) {
+		// Timestamps are 32.32 fixed point seconds
+		return FileFormat{FormatERF, BigEndian, "2^-32"}, true
+	}
+	return FileFormat{}, false
+}
+
+// DetectFileFormat identifies a capture file from its header
+func DetectFileFormat(filename string) (FileFormat, bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return FileFormat{}, false
+	}
+	defer f.Close()
+	head := make([]byte, DetectLen)
+	n, _ := io.ReadFull(f, head)
+	return DetectFormat(head[:n])
+}
+
+// IsCaptureFormat returns whether name is one of the formats DetectFormat finds
+func IsCaptureFormat(name string) bool {
+	switch name {
+	case FormatPcap, FormatPcapNsec, FormatPcapMod, FormatPcapng, FormatERF:
+		return true
+	}
+	for _, m := range captureMagics {
+		if m.format.Name == name {
+			return true
+		}
+	}
+	for _, trace := range textTraceMarkers {
+		if trace.format == name {
+			return true
+		}
+	}
+	return false
+}
+
+const pcapHeaderLen = 24
+
+// detectPcap reads a libpcap file header, whose magic number gives the byte order and precision
+func detectPcap(head []byte) (FileFormat, bool) {
+	if len(head) < 6 {
+		return FileFormat{}, false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		endianness := LittleEndian
+		if order == binary.BigEndian {
+			endianness = BigEndian
+		}
+		// Only major version 2 has ever existed
+		if order.Uint16(head[4:6]) != 2 {
+			continue
+		}
+		switch order.Uint32(head) {
+		case 0xa1b2c3d4:
+			return FileFormat{FormatPcap, endianness, PrecisionUs}, true
+		case 0xa1b23c4d:
+			return FileFormat{FormatPcapNsec, endianness, PrecisionNs}, true
+		case 0xa1b2cd34:
+			return FileFormat{FormatPcapMod, endianness, PrecisionUs}, true
+		}
+	}
+	return FileFormat{}, false
+}
+
+const (
+	pcapngSHB        = 0x0a0d0d0a
+	pcapngIDB        = 0x00000001
+	pcapngByteMagic  = 0x1a2b3c4d
+	pcapngOptTsresol = 9
+)
+
+// detectPcapng reads the section header block for the byte order and the first interface for its precision
+func detectPcapng(head []byte) (FileFormat, bool) {
+	if len(head) < 12 || binary.BigEndian.Uint32(head) != pcapngSHB {
+		return FileFormat{}, false
+	}
+	var order binary.ByteOrder
+	var endianness string
+	switch {
+	case binary.LittleEndian.Uint32(head[8:]) == pcapngByteMagic:
+		order, endianness = binary.LittleEndian, LittleEndian
+	case binary.BigEndian.Uint32(head[8:]) == pcapngByteMagic:
+		order, endianness = binary.BigEndian, BigEndian
+	default:
+		return FileFormat{}, false
+	}
+	return FileFormat{FormatPcapng, endianness, pcapngPrecision(head, order)}, true
+}
+
+// pcapngPrecision returns the if_tsresol of the first interface, which is microseconds if it's not set
+func pcapngPrecision(head []byte, order binary.ByteOrder) string {
+	offset := 0
+	for offset+12 <= len(head) {
+		blockType := order.Uint32(head[offset:])
+		blockLen := int(order.Uint32(head[offset+4:]))
+		if blockLen < 12 || offset+blockLen > len(head) {
+			break
+		}
+		if blockType == pcapngIDB {
+			// Options start after link type, reserved and snaplen, and end before the trailing length
+			options := head[offset+16 : offset+blockLen-4]
+			for len(options) >= 4 {
+				code, optLen := order.Uint16(options), int(order.Uint16(options[2:]))
+				if code == 0 || 4+optLen > len(options) {
+					break
+				}
+				if code == pcapngOptTsresol && optLen == 1 {
+					return tsresolPrecision(options[4])
+				}
+				options = options[4+(optLen+3)/4*4:]
+			}
+			break
+		}
+		offset += blockLen
+	}
+	return PrecisionUs
+}
+
+// tsresolPrecision converts if_tsresol, which is a negative power of 10, or of 2 if the high bit is set
+func tsresolPrecision(tsresol byte) string {
+	if tsresol&0x80 != 0 {
+		return fmt.Sprintf("2^-%d", tsresol&0x7f)
+	}
+	switch tsresol {
+	case 0:
+		return PrecisionSec
+	case 3:
+		return PrecisionMs
+	case 6:
+		return PrecisionUs
+	case 9:
+		return PrecisionNs
+	}
+	return fmt.Sprintf("10^-%d", tsresol)
+}
+
+// isERF checks that head starts with plausible ERF record headers
+func isERF(head []byte) bool {
+	const erfHeaderLen = 16
+	const maxERFType = 48
+	checked := 0
+	for offset := 0; offset+erfHeaderLen <= len(head) && checked < 2; checked++ {
+		record := head[offset:]
+		erfType := record[8] & 0x7f
+		recordLen := int(binary.BigEndian.Uint16(record[10:12]))
+		if erfType == 0 || erfType > maxERFType || recordLen < erfHeaderLen || binary.LittleEndian.Uint64(record) == 0 {
+			return false
+		}
+		offset += recordLen
+	}
+	return checked > 0
+}
+
+// hasPackets returns whether a pcap or pcapng file has at least one packet record.
+// Other formats are assumed to have packets because their records aren't parsed.
+func hasPackets(filename string, format FileFormat) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	switch format.Name {
+	case FormatPcap, FormatPcapNsec, FormatPcapMod:
+		info, statErr := f.Stat()
+		return statErr == nil && info.Size() > pcapHeaderLen
+	case FormatPcapng:
+		order := binary.ByteOrder(binary.LittleEndian)
+		if format.Endianness == BigEndian {
+			order = binary.BigEndian
+		}
+		header := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(f, header); err != nil {
+				return false
+			}
+			// Enhanced, simple and obsolete packet blocks
+			switch order.Uint32(header) {
+			case 6, 3, 2:
+				return true
+			}
+			blockLen := int64(order.Uint32(header[4:]))
+			if blockLen < 12 {
+				return false
+			}
+			if _, err := f.Seek(blockLen-8, io.SeekCurrent); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,123 @@
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pcapngHead builds a section header and an interface with an optional if_tsresol
+func pcapngHead(order binary.ByteOrder, tsresol int) []byte {
+	block := func(blockType uint32, body []byte) []byte {
+		b := make([]byte, 8, 12+len(body))
+		order.PutUint32(b, blockType)
+		order.PutUint32(b[4:], uint32(12+len(body)))
+		b = append(b, body...)
+		return append(b, b[4:8]...)
+	}
+	shb := make([]byte, 16)
+	order.PutUint32(shb, pcapngByteMagic)
+	order.PutUint16(shb[4:], 1)
+	binary.BigEndian.PutUint64(shb[8:], ^uint64(0))
+	head := block(pcapngSHB, shb)
+	idb := make([]byte, 8)
+	order.PutUint16(idb, 1)
+	if tsresol >= 0 {
+		opt := make([]byte, 8)
+		order.PutUint16(opt, pcapngOptTsresol)
+		order.PutUint16(opt[2:], 1)
+		opt[4] = byte(tsresol)
+		idb = append(idb, opt...)
+		idb = append(idb, 0, 0, 0, 0) // opt_endofopt
+	}
+	return append(head, block(pcapngIDB, idb)...)
+}
+
+// TestDetectFormat tests DetectFormat
+func TestDetectFormat(t *testing.T) {
+	pcapHeader := func(magic uint32, order binary.ByteOrder) []byte {
+		h := make([]byte, pcapHeaderLen)
+		order.PutUint32(h, magic)
+		order.PutUint16(h[4:], 2)
+		order.PutUint16(h[6:], 4)
+		return h
+	}
+	erfRecord := "\x01\x02\x03\x04\x05\x06\x07\x08\x02\x04\x00\x14\x00\x00\x00\x04abcd"
+	tests := []struct {
+		name   string
+		head   []byte
+		want   FileFormat
+		wantOk bool
+	}{
+		{"pcap little endian", pcapHeader(0xa1b2c3d4, binary.LittleEndian), FileFormat{FormatPcap, LittleEndian, PrecisionUs}, true},
+		{"pcap big endian", pcapHeader(0xa1b2c3d4, binary.BigEndian), FileFormat{FormatPcap, BigEndian, PrecisionUs}, true},
+		{"nanosecond pcap", pcapHeader(0xa1b23c4d, binary.LittleEndian), FileFormat{FormatPcapNsec, LittleEndian, PrecisionNs}, true},
+		{"modified pcap", pcapHeader(0xa1b2cd34, binary.BigEndian), FileFormat{FormatPcapMod, BigEndian, PrecisionUs}, true},
+		{"pcap magic with bad version", []byte("\xd4\xc3\xb2\xa1\x09\x00\x04\x00"), FileFormat{}, false},
+		{"pcapng default precision", pcapngHead(binary.LittleEndian, -1), FileFormat{FormatPcapng, LittleEndian, PrecisionUs}, true},
+		{"pcapng nanoseconds", pcapngHead(binary.BigEndian, 9), FileFormat{FormatPcapng, BigEndian, PrecisionNs}, true},
+		{"pcapng power of 2", pcapngHead(binary.LittleEndian, 0x80|20), FileFormat{FormatPcapng, LittleEndian, "2^-20"}, true},
+		{"pcapng odd power of 10", pcapngHead(binary.LittleEndian, 5), FileFormat{FormatPcapng, LittleEndian, "10^-5"}, true},
+		{"ERF", []byte(erfRecord + erfRecord), FileFormat{FormatERF, BigEndian, "2^-32"}, true},
+		{"snoop", []byte("snoop\x00\x00\x00\x00\x00\x00\x02"), FileFormat{FormatSnoop, BigEndian, PrecisionUs}, true},
+		{"NetMon 1", []byte("RTSS\x01\x01"), FileFormat{FormatNetmon1, LittleEndian, PrecisionMs}, true},
+		{"NetMon 2", []byte("GMBU\x00\x02"), FileFormat{FormatNetmon2, LittleEndian, PrecisionUs}, true},
+		{"K12", []byte("\x00\x00\x02\x00\x12\x05\x00\x10"), FileFormat{FormatK12, BigEndian, PrecisionNs}, true},
+		{"5Views", []byte("\xaa\xaa\xaa\xaa\x18\x00\x00\x00"), FileFormat{Format5Views, LittleEndian, PrecisionNs}, true},
+		{"Observer", []byte("ObserverPktBufferVersion=15.00"), FileFormat{FormatObserver, LittleEndian, PrecisionNs}, true},
+		{"iptrace 2.0", []byte("iptrace 2.0\x00"), FileFormat{FormatIptrace2, BigEndian, PrecisionNs}, true},
+		{"iSeries text trace", []byte("   COMMUNICATIONS TRACE       Title: LAB\n"), FileFormat{FormatISeries, "", PrecisionUs}, true},
+		{"Marker in a binary", []byte("\x00\x00TCPIPtrace"), FileFormat{}, false},
+		{"Plain text", []byte("Not a capture, just notes.\n"), FileFormat{}, false},
+		{"Empty", []byte{}, FileFormat{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := DetectFormat(tt.head)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestIsPcapHeaders tests that IsPcap trusts pcap and pcapng headers and checks them for packets without capinfos
+func TestIsPcapHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pcapHeader := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(pcapHeader, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(pcapHeader[4:], 2)
+	modHeader := append([]byte{}, pcapHeader...)
+	binary.LittleEndian.PutUint32(modHeader, 0xa1b2cd34)
+	epb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(epb, 6)
+	binary.LittleEndian.PutUint32(epb[4:], 32)
+	binary.LittleEndian.PutUint32(epb[28:], 32)
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"pcap with a packet", append(append([]byte{}, pcapHeader...), make([]byte, 20)...), false},
+		{"pcap header only", pcapHeader, true},
+		{"pcapng with a packet", append(pcapngHead(binary.LittleEndian, 6), epb...), false},
+		{"pcapng without packets", pcapngHead(binary.LittleEndian, 6), true},
+		{"modified pcap with a packet", append(modHeader, make([]byte, 24)...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "capture")
+			ioutil.WriteFile(path, tt.content, 0644)
+			err := IsPcap(context.Background(), path)
+			assert.Equal(t, tt.wantErr, err != nil, "IsPcap() error = %v", err)
+		})
+	}
+}
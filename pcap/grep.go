@@ -0,0 +1,113 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxGrepFrames is how many frame numbers Grep keeps of the packets that match
+const maxGrepFrames = 10
+
+// GrepResult is how many packets of a capture matched a display or capture filter
+type GrepResult struct {
+	Matches     int
+	FirstFrames []int  `json:",omitempty"` // Frame numbers of the first packets that matched
+	Error       string `json:",omitempty"` // Why tshark may not have read every packet
+	Unfiltered  int    `json:",omitempty"` // Packets a capture filter couldn't be run on, which might match
+}
+
+// Grep counts the packets of a capture that match a display filter
+func Grep(ctx context.Context, filename string, filter string) (GrepResult, error) {
+	var result GrepResult
+	err := GetTsharkInfo(ctx, filename, filter, func(values []string) {
+		result.Matches++
+		if len(result.FirstFrames) < maxGrepFrames {
+			if frame, err := strconv.Atoi(values[0]); err == nil {
+				result.FirstFrames = append(result.FirstFrames, frame)
+			}
+		}
+	}, "frame.number")
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// GrepBPF counts the packets of a pcap or pcapng file that match a capture filter. It reads them
+// itself instead of with tshark, so it's a fast way to rule captures out before Grep. Packets of
+// link types the filter can't be compiled for are counted as Unfiltered.
+func GrepBPF(ctx context.Context, filename string, filter *BPFFilter) (GrepResult, error) {
+	var result GrepResult
+	format, ok := DetectFileFormat(filename)
+	if !ok || !canWalk(format) {
+		err := fmt.Errorf("%s isn't a pcap or pcapng file, so capture filters can't be run on it", filename)
+		result.Error = err.Error()
+		return result, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	defer f.Close()
+	frame := 0
+	var linkErr error
+	err = walkRecords(f, format, func(rec walkedRecord) error {
+		if !rec.isPacket {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		frame++
+		match, err := filter.Match(rec.linkType, rec.packet)
+		if err != nil {
+			linkErr = err
+			result.Unfiltered++
+			return nil
+		}
+		if match {
+			result.Matches++
+			if len(result.FirstFrames) < maxGrepFrames {
+				result.FirstFrames = append(result.FirstFrames, frame)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = linkErr
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// ValidateFilter returns an error if tshark can't compile a display filter, so that a typo fails
+// once instead of once per capture
+func ValidateFilter(ctx context.Context, filter string) error {
+	empty, err := ioutil.TempFile("", "hubcap-filter-*.pcap")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(empty.Name())
+	header := make([]byte, pcapHeaderLen)
+	copy(header, []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0})
+	copy(header[16:], []byte{0xff, 0xff, 0, 0, 1, 0, 0, 0})
+	_, err = empty.Write(header)
+	if closeErr := empty.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	_, stderr, err := runTool(ctx, tools.Tshark, "-n", "-r", empty.Name(), "-Y", filter)
+	if err != nil {
+		return fmt.Errorf("Invalid display filter `%s`: %s", filter, strings.TrimSpace(string(stderr)))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pcap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTshark installs a shell script as tshark until the returned function is called
+func fakeTshark(t *testing.T, script string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake tshark is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "hubcap-tshark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tshark")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := CurrentTools()
+	SetTools(Tools{Tshark: path})
+	return func() {
+		SetTools(previous)
+		os.RemoveAll(dir)
+	}
+}
+
+// TestGrep tests that matches are counted from tshark's frame numbers
+func TestGrep(t *testing.T) {
+	frames := "for i in $(seq 3 2 31); do echo $i; done\n"
+	tests := []struct {
+		name    string
+		script  string
+		want    GrepResult
+		wantErr bool
+	}{
+		{"Matches", frames, GrepResult{Matches: 15, FirstFrames: []int{3, 5, 7, 9, 11, 13, 15, 17, 19, 21}}, false},
+		{"No matches", "exit 0\n", GrepResult{}, false},
+		{"Cut short", "echo 4; echo 'tshark: The file appears to have been cut short' >&2\n",
+			GrepResult{Matches: 1, FirstFrames: []int{4}, Error: "\033[93mWARN\033[0m tshark stderr: tshark: The file appears to have been cut short"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer fakeTshark(t, tt.script)()
+			got, err := Grep(context.Background(), "a.pcap", "tcp.analysis.zero_window")
+			assert.Equal(t, tt.wantErr, err != nil, "Grep() error = %v", err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestValidateFilter tests that filters tshark rejects are errors
+func TestValidateFilter(t *testing.T) {
+	defer fakeTshark(t, "[ \"$5\" = sip ] || { echo \"tshark: \\\"$5\\\" isn't a valid display filter\" >&2; exit 4; }\n")()
+	assert.NoError(t, ValidateFilter(context.Background(), "sip"))
+	assert.EqualError(t, ValidateFilter(context.Background(), "sipp"), "Invalid display filter `sipp`: tshark: \"sipp\" isn't a valid display filter")
+}
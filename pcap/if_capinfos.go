@@ -2,37 +2,33 @@ package pcap
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"runtime"
-	"strings"
 )
 
 // GetCapinfos creates a json out of capinfos output
-func GetCapinfos(filename string, shouldFix bool) (map[string]interface{}, error) {
-	cmd := exec.Command("capinfos", "-M", filename)
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-
-	cmd.Run()
-	stderrStr := string(stderr.Bytes())
-	willFix := shouldFix && strings.Contains(stderrStr, "cut short in the middle")
-	ciJSON := capinfos2JSON(stdout.Bytes())
+func GetCapinfos(ctx context.Context, filename string) (map[string]interface{}, error) {
+	stdout, stderr, err := runTool(ctx, tools.Capinfos, "-M", filename)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if FailureCategory(err) != "" {
+		return nil, err
+	}
+	stderrStr := string(stderr)
+	ciJSON := capinfos2JSON(stdout)
 	result := JSON2Struct(ciJSON)
 	switch {
-	case willFix:
-		fixPcap(filename)
 	case !bytes.Equal([]byte(stderrStr), []byte("")):
 		// This is not a fatal error because it's ok if some files are not read
 		capinfosErr := fmt.Errorf("\033[93mWARN\033[0m " + stderrStr)
 		errorResult := make(map[string]interface{})
 		errorResult[filename] = "File not found"
 		return result, capinfosErr
-	case bytes.Equal(stdout.Bytes(), []byte("")):
+	case bytes.Equal(stdout, []byte("")):
 		fmt.Println("\033[91mERROR\033[0m FATAL: No output received from capinfos for file", filename,
 			"\nThis usually means that there are too many goroutines.",
 			"\nCurrent number of goroutines:", runtime.NumGoroutine())
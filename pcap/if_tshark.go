@@ -1,16 +1,10 @@
 package pcap
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"os"
-	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
-	"testing"
-
-	"github.com/stretchr/testify/assert"
 )
 
 type tsharkInfo struct {
@@ -21,127 +15,94 @@ type tsharkInfo struct {
 	udpDstPorts []int
 }
 
-// GetTsharkInfo filters with the given filter and then applies fields
-func GetTsharkInfo(filename string, filter string, fields ...string) ([]byte, error) {
-	fmt.Printf("\033[92mINFO\033[0m tshark is reading file `%s` with filter `%s` and fields %s\n", filename, filter, fields)
-	cmdList := []string{"-T", "fields", "-Y", filter, "-E", "separator=|"}
-	for _, field := range fields {
-		cmdList = append(cmdList, "-e", field)
-	}
-	cmdList = append(cmdList, "-r", filename)
-	cmd := exec.Command("tshark", cmdList...)
+// GetTsharkInfo filters with the given filter and calls onRecord with the fields of each packet as tshark reads it.
+// A field with several values has them comma separated.
+func GetTsharkInfo(ctx context.Context, filename string, filter string, onRecord func(values []string), fields ...string) error {
+	return getTsharkInfo(ctx, filename, nil, filter, onRecord, fields...)
+}
 
-	stdout := new(bytes.Buffer)
-	stderr := new(bytes.Buffer)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	err := cmd.Run()
+// getTsharkInfo is GetTsharkInfo with extra arguments like -o preferences
+func getTsharkInfo(ctx context.Context, filename string, prefs []string, filter string, onRecord func(values []string), fields ...string) error {
+	pass := Pass{Prefs: prefs, Filter: filter, Fields: fields, OnPacket: onRecord}
+	result, err := pass.Run(ctx, filename)
 	if err != nil {
-		tsharkErr := fmt.Errorf("\033[93mWARN\033[0m tshark error: %s", err.Error())
-		return stdout.Bytes(), tsharkErr
-	}
-	if len(stderr.Bytes()) > 0 {
-		// This is not a fatal error because it's ok if some files are not read
-		errorText := string(stderr.Bytes())
-		if errorText[0] == '\n' {
-			errorText = errorText[1:]
-		}
-		tsharkErr := fmt.Errorf("\033[93mWARN\033[0m tshark stderr: %s", errorText)
-		return stdout.Bytes(), tsharkErr
+		return err
 	}
-	if len(stdout.Bytes()) == 0 {
-		tsharkErr := fmt.Errorf("\033[93mWARN\033[0m tshark: No output captured! Command: tshark %s", cmdList)
-		return stdout.Bytes(), tsharkErr
+	// A filter can rightly match nothing, but every capture has packets
+	if result.Packets == 0 && filter == "" {
+		return fmt.Errorf("\033[93mWARN\033[0m tshark: No output captured! Command: tshark %s", pass.args(filename))
 	}
-	return stdout.Bytes(), nil
+	return nil
 }
 
-// GetTsharkJSON gets just frame.protocols, udp.port, tcp.port and returns a JSON
-func GetTsharkJSON(filename string) ([]string, map[string][]int, error) {
-	text, err := GetTsharkInfo(filename, "", "frame.protocols", "udp.port", "tcp.port")
-	protocols, ports := parseProtoAndPorts(text)
-	return protocols, ports, err
+// protoPortFields are the fields that protoPorts adds up
+var protoPortFields = []string{"frame.protocols", "tcp.srcport", "tcp.dstport", "udp.srcport", "udp.dstport"}
+
+// protoPortKeys are the keys of ports in the order of protoPortFields
+var protoPortKeys = []string{"tcpSrcPorts", "tcpDstPorts", "udpSrcPorts", "udpDstPorts"}
+
+// uniqueValues collects values in the order they were first seen
+type uniqueValues struct {
+	seen   map[string]bool
+	values []string
 }
 
-// parseProtoAndPorts parses just frame.protocols, udp.port, tcp.port
-func parseProtoAndPorts(text []byte) ([]string, map[string][]int) {
-	ports := make(map[string][]int)
-	protoRe := regexp.MustCompile(`(?:^|\n)(\S*?)\|(\d*),?(\d*).*?\|(\d*),?(\d*).*?`)
-	protoData := protoRe.FindAllStringSubmatch(string(text), -1)
-	if protoData == nil {
-		fmt.Println("\033[91mERROR\033[0m For given text,", string(text), ", unable to parse protocols and ports with regex")
-		os.Exit(1)
-	}
-	rotatedData := make([][]string, 5)
-	for i := 0; i < 5; i++ {
-		rotatedData[i] = make([]string, len(protoData))
+func (u *uniqueValues) add(value string) {
+	if value == "" || u.seen[value] {
+		return
 	}
-	for j, line := range protoData {
-		for i := 0; i < len(line)-1; i++ {
-			elem := line[i+1]
-			if elem != "" {
-				rotatedData[i][j] = elem
-			}
-		}
+	if u.seen == nil {
+		u.seen = make(map[string]bool)
 	}
-	protocols := uniqueProtocols(rotatedData[0])
-	ports["tcpSrcPorts"] = uniquePorts(rotatedData[1])
-	ports["tcpDstPorts"] = uniquePorts(rotatedData[2])
-	ports["udpSrcPorts"] = uniquePorts(rotatedData[3])
-	ports["udpDstPorts"] = uniquePorts(rotatedData[4])
-	return protocols, ports
+	u.seen[value] = true
+	u.values = append(u.values, value)
 }
 
-func uniqueProtocols(protocols []string) []string {
-	var result []string
-	mapUniques := make(map[string]bool)
-	for _, protocolLine := range protocols {
-		protocols := strings.Split(protocolLine, ":")
-		for _, protocol := range protocols {
-			if !mapUniques[protocol] {
-				result = append(result, protocol)
-			}
-			mapUniques[protocol] = true
+// protoPorts adds up the unique protocols and ports of packets as they are read
+type protoPorts struct {
+	protocols uniqueValues
+	ports     [4]uniqueValues
+}
+
+// add adds a packet's values of protoPortFields
+func (pp *protoPorts) add(values []string) {
+	for _, protocol := range strings.Split(values[0], ":") {
+		pp.protocols.add(protocol)
+	}
+	for i := range pp.ports {
+		// Tunneled packets have a port for each layer
+		for _, port := range strings.Split(values[1+i], ",") {
+			pp.ports[i].add(port)
 		}
 	}
-	return result
 }
 
-func uniquePorts(ports []string) []int {
-	uniques := make([]int, 0)
-	mapUniques := make(map[string]bool)
-	for _, port := range ports {
-		if !mapUniques[port] && port != "" {
-			uniqueInt, err := strconv.Atoi(port)
-			if err != nil {
-				fmt.Println("ERROR:", err, "\nProblem converting port to int `"+port+"`")
-				os.Exit(1)
+// result returns the protocols in the order they were first seen and the ports by protoPortKeys
+func (pp *protoPorts) result() ([]string, map[string][]int) {
+	ports := make(map[string][]int, len(protoPortKeys))
+	for i, key := range protoPortKeys {
+		ports[key] = make([]int, 0, len(pp.ports[i].values))
+		for _, port := range pp.ports[i].values {
+			if number, err := strconv.Atoi(port); err == nil {
+				ports[key] = append(ports[key], number)
 			}
-			uniques = append(uniques, uniqueInt)
 		}
-		mapUniques[port] = true
 	}
+	return pp.protocols.values, ports
+}
 
-	return uniques
+// GetTsharkJSON gets the protocols and tcp and udp ports of a capture
+func GetTsharkJSON(ctx context.Context, filename string) ([]string, map[string][]int, error) {
+	return getTsharkJSON(ctx, filename, nil)
 }
 
-// TestGetTsharkInfo tests GetTsharkInfo
-func TestGetTsharkInfo(t *testing.T) {
-	/*testInput := []byte(
-			`eth:ethertype:ip:udp:data|42559,26895|
-	eth:ethertype:ip:tcp:ssl||443,56561
-	eth:ethertype:ip:tcp||56562,443
-	eth:ethertype:ip:tcp:data||443,56562
-	eth:ethertype:ip:tcp||56561,443
-	eth:ethertype:ip:tcp:ssl||443,56563
-	eth:ethertype:ip:udp:data|26895,42559|
-	eth:ethertype:ip:tcp||56562,443
-	eth:ethertype:ip:tcp:ssl||443,56562
-	eth:ethertype:ip:tcp||56563,443`)*/
-	expected := []byte(
-		`{"protocols":["eth","ethertype","ip","tcp","ssl","udp","data"],` +
-			`"tcp":{"srcport":[443,56561,56562,56563],"dstport":[443,56561,56562,56563]}` +
-			`"udp":{"srcport":[26895,42559],"dstport":[26895,42559]}`)
-	actual := []byte("") //getCapinfos(testInput)
-	assert.Equal(t, expected, actual, "These should be the same.")
+// getTsharkJSON is GetTsharkJSON with extra arguments like -o preferences
+func getTsharkJSON(ctx context.Context, filename string, prefs []string) ([]string, map[string][]int, error) {
+	var pp protoPorts
+	err := getTsharkInfo(ctx, filename, prefs, "", pp.add, protoPortFields...)
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	protocols, ports := pp.result()
+	return protocols, ports, err
 }
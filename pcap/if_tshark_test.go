@@ -0,0 +1,47 @@
+package pcap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProtoPorts tests that protocols and ports are added up one packet at a time
+func TestProtoPorts(t *testing.T) {
+	tests := []struct {
+		name          string
+		records       [][]string
+		wantProtocols []string
+		wantPorts     map[string][]int
+	}{
+		{"tcp and udp", [][]string{
+			{"eth:ethertype:ip:udp:data", "", "", "42559", "26895"},
+			{"eth:ethertype:ip:tcp:tls", "443", "56561", "", ""},
+			{"eth:ethertype:ip:tcp", "56561", "443", "", ""},
+			{"eth:ethertype:ip:udp:data", "", "", "26895", "42559"},
+		}, []string{"eth", "ethertype", "ip", "udp", "data", "tcp", "tls"}, map[string][]int{
+			"tcpSrcPorts": {443, 56561}, "tcpDstPorts": {56561, 443},
+			"udpSrcPorts": {42559, 26895}, "udpDstPorts": {26895, 42559},
+		}},
+		{"Tunneled", [][]string{
+			{"eth:ip:udp:vxlan:eth:ip:udp:dns", "", "", "4789,53", "4789,33000"},
+		}, []string{"eth", "ip", "udp", "vxlan", "dns"}, map[string][]int{
+			"tcpSrcPorts": {}, "tcpDstPorts": {},
+			"udpSrcPorts": {4789, 53}, "udpDstPorts": {4789, 33000},
+		}},
+		{"No packets", nil, nil, map[string][]int{
+			"tcpSrcPorts": {}, "tcpDstPorts": {}, "udpSrcPorts": {}, "udpDstPorts": {},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pp protoPorts
+			for _, record := range tt.records {
+				pp.add(record)
+			}
+			protocols, ports := pp.result()
+			assert.Equal(t, tt.wantProtocols, protocols)
+			assert.Equal(t, tt.wantPorts, ports)
+		})
+	}
+}
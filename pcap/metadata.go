@@ -0,0 +1,227 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// pcapng options that PcapngMetadata has
+const (
+	optComment    = 1  // opt_comment, which every block can have
+	ifOptName     = 2  // if_name
+	ifOptDesc     = 3  // if_description
+	ifOptSpeed    = 8  // if_speed in bits per second
+	ifOptFilter   = 11 // if_filter, whose first byte says what kind of filter it is
+	ifOptTSOffset = 14 // if_tsoffset in seconds
+)
+
+// Name resolution record types
+const (
+	nrbRecordIPv4  = 1
+	nrbRecordIPv6  = 2
+	nrbRecordEUI48 = 3
+	nrbRecordEUI64 = 4
+)
+
+// secretsTypes names the kinds of secrets in decryption secrets blocks
+var secretsTypes = map[uint32]string{
+	0x544c534b: "TLS key log",
+	0x5353484b: "SSH key log",
+	0x57474b4c: "WireGuard key log",
+	0x5a4e574b: "ZigBee NWK key",
+	0x5a415053: "ZigBee APS key",
+	0x55414b4c: "OPC UA key log",
+}
+
+// Most packet comments and names that are kept, so that a file full of them doesn't bloat captures.json
+const (
+	maxPacketComments = 1000
+	maxNameRecords    = 1000
+)
+
+// PcapngMetadata is what a pcapng file says about itself in comments and options, which capinfos leaves out
+type PcapngMetadata struct {
+	SectionComments []string           `json:",omitempty"`
+	PacketComments  []PacketComment    `json:",omitempty"` // The first 1000
+	Interfaces      []InterfaceOptions `json:",omitempty"` // In the order of their interface IDs
+	NameResolution  []NameRecord       `json:",omitempty"` // Names from name resolution blocks, the first 1000
+	// DecryptionSecrets counts the decryption secrets blocks of each kind, like TLS key log
+	DecryptionSecrets map[string]int `json:",omitempty"`
+}
+
+// PacketComment is a comment on a packet, like those added in Wireshark
+type PacketComment struct {
+	Frame   int // Number of the packet in the file, starting at 1 like tshark's frame.number
+	Comment string
+}
+
+// InterfaceOptions are the options of an interface that capinfos doesn't show
+type InterfaceOptions struct {
+	Name        string   `json:",omitempty"`
+	Description string   `json:",omitempty"`
+	Filter      string   `json:",omitempty"` // Capture filter, like tcp port 80
+	Speed       uint64   `json:",omitempty"` // Bits per second
+	TSOffset    int64    `json:",omitempty"` // Seconds added to every timestamp of the interface
+	Comments    []string `json:",omitempty"`
+}
+
+// NameRecord is an address and the names a name resolution block gives it
+type NameRecord struct {
+	Address string
+	Names   []string
+}
+
+// isEmpty returns whether there's nothing in the metadata that capinfos doesn't already have
+func (m *PcapngMetadata) isEmpty() bool {
+	if len(m.SectionComments)+len(m.PacketComments)+len(m.NameResolution)+len(m.DecryptionSecrets) > 0 {
+		return false
+	}
+	for _, iface := range m.Interfaces {
+		if iface.Filter != "" || iface.Speed != 0 || iface.TSOffset != 0 || len(iface.Comments) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// optionString returns the value of a string option without the padding some writers include
+func optionString(value []byte) string {
+	return strings.TrimRight(string(value), "\x00")
+}
+
+// ReadPcapngMetadata reads the comments, interface options, name resolution and decryption
+// secrets of a pcapng file. It returns nil if the file has none of them.
+func ReadPcapngMetadata(filename string) (*PcapngMetadata, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta := &PcapngMetadata{}
+	frame := 0
+	err = walkRecords(f, FileFormat{Name: FormatPcapng}, func(rec walkedRecord) error {
+		order, data := rec.order, rec.data
+		if rec.isPacket {
+			frame++
+		}
+		switch order.Uint32(data) {
+		case pcapngSHB:
+			if len(data) >= 28 {
+				forOptions(data[24:len(data)-4], order, func(code uint16, value []byte) {
+					if code == optComment {
+						meta.SectionComments = append(meta.SectionComments, optionString(value))
+					}
+				})
+			}
+		case blockIDB:
+			if len(data) >= 20 {
+				meta.Interfaces = append(meta.Interfaces, readInterfaceOptions(data[16:len(data)-4], order))
+			}
+		case blockEPB, blockPB:
+			if len(data) < 32 {
+				break
+			}
+			// Options follow the packet, which is padded to 32 bits
+			start := 28 + (int(order.Uint32(data[20:]))+3)/4*4
+			if start > len(data)-4 {
+				break
+			}
+			forOptions(data[start:len(data)-4], order, func(code uint16, value []byte) {
+				if code == optComment && len(meta.PacketComments) < maxPacketComments {
+					meta.PacketComments = append(meta.PacketComments, PacketComment{frame, optionString(value)})
+				}
+			})
+		case blockNRB:
+			meta.NameResolution = readNameRecords(data[8:len(data)-4], order, meta.NameResolution)
+		case blockDSB:
+			if len(data) < 20 {
+				break
+			}
+			secretsType := order.Uint32(data[8:])
+			name, ok := secretsTypes[secretsType]
+			if !ok {
+				name = fmt.Sprintf("Type 0x%08x", secretsType)
+			}
+			if meta.DecryptionSecrets == nil {
+				meta.DecryptionSecrets = make(map[string]int)
+			}
+			meta.DecryptionSecrets[name]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if meta.isEmpty() {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// readInterfaceOptions reads the options of an interface description block
+func readInterfaceOptions(options []byte, order binary.ByteOrder) InterfaceOptions {
+	var iface InterfaceOptions
+	forOptions(options, order, func(code uint16, value []byte) {
+		switch code {
+		case optComment:
+			iface.Comments = append(iface.Comments, optionString(value))
+		case ifOptName:
+			iface.Name = optionString(value)
+		case ifOptDesc:
+			iface.Description = optionString(value)
+		case ifOptSpeed:
+			if len(value) == 8 {
+				iface.Speed = order.Uint64(value)
+			}
+		case ifOptTSOffset:
+			if len(value) == 8 {
+				iface.TSOffset = int64(order.Uint64(value))
+			}
+		case ifOptFilter:
+			// 0 is a libpcap filter string. Other kinds, like BPF programs, aren't readable text.
+			if len(value) > 1 && value[0] == 0 {
+				iface.Filter = optionString(value[1:])
+			}
+		}
+	})
+	return iface
+}
+
+// readNameRecords adds the records of a name resolution block to records, up to maxNameRecords
+func readNameRecords(body []byte, order binary.ByteOrder, records []NameRecord) []NameRecord {
+	for len(body) >= 4 && len(records) < maxNameRecords {
+		recordType, recordLen := order.Uint16(body), int(order.Uint16(body[2:]))
+		if recordType == 0 || 4+recordLen > len(body) {
+			break
+		}
+		value := body[4 : 4+recordLen]
+		addrLen := map[uint16]int{nrbRecordIPv4: 4, nrbRecordIPv6: 16, nrbRecordEUI48: 6, nrbRecordEUI64: 8}[recordType]
+		if addrLen > 0 && len(value) > addrLen {
+			var address string
+			switch recordType {
+			case nrbRecordIPv4, nrbRecordIPv6:
+				address = net.IP(value[:addrLen]).String()
+			default:
+				address = net.HardwareAddr(value[:addrLen]).String()
+			}
+			names := make([]string, 0)
+			for _, name := range strings.Split(string(value[addrLen:]), "\x00") {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+			if len(names) > 0 {
+				records = append(records, NameRecord{address, names})
+			}
+		}
+		padded := 4 + (recordLen+3)/4*4
+		if padded > len(body) {
+			break
+		}
+		body = body[padded:]
+	}
+	return records
+}
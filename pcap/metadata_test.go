@@ -0,0 +1,89 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReadPcapngMetadata tests that comments, interface options, names and secrets are read
+func TestReadPcapngMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap-metadata")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	order := binary.LittleEndian
+	block := func(blockType uint32, body []byte) []byte {
+		b := make([]byte, 8, 12+len(body))
+		order.PutUint32(b, blockType)
+		order.PutUint32(b[4:], uint32(12+len(body)))
+		b = append(b, body...)
+		return append(b, b[4:8]...)
+	}
+	option := func(code uint16, value []byte) []byte {
+		opt := make([]byte, 4, 4+len(value)+3)
+		order.PutUint16(opt, code)
+		order.PutUint16(opt[2:], uint16(len(value)))
+		opt = append(opt, value...)
+		for len(opt)%4 != 0 {
+			opt = append(opt, 0)
+		}
+		return opt
+	}
+	uint64Value := func(n uint64) []byte {
+		value := make([]byte, 8)
+		order.PutUint64(value, n)
+		return value
+	}
+	shb := make([]byte, 16)
+	order.PutUint32(shb, pcapngByteMagic)
+	order.PutUint16(shb[4:], 1)
+	binary.BigEndian.PutUint64(shb[8:], ^uint64(0))
+	shb = concat(shb, option(optComment, []byte("Client hangs after the second SYN")), option(0, nil))
+	idb := make([]byte, 8)
+	order.PutUint16(idb, linkTypeEthernet)
+	idb = concat(idb, option(ifOptName, []byte("eth0")), option(ifOptFilter, []byte("\x00tcp port 80")),
+		option(ifOptSpeed, uint64Value(1e9)), option(ifOptTSOffset, uint64Value(3600)), option(0, nil))
+	// A second interface with nothing worth keeping
+	plainIDB := make([]byte, 8)
+	order.PutUint16(plainIDB, linkTypeEthernet)
+	epb := func(comment string) []byte {
+		body := make([]byte, 20, 28)
+		order.PutUint32(body[12:], 5)
+		order.PutUint32(body[16:], 5)
+		body = append(body, "hello"...)
+		body = append(body, 0, 0, 0)
+		if comment != "" {
+			body = concat(body, option(optComment, []byte(comment)), option(0, nil))
+		}
+		return block(blockEPB, body)
+	}
+	nrb := concat(option(nrbRecordIPv4, []byte("\x0a\x00\x00\x01router.lan\x00gw\x00")),
+		option(nrbRecordIPv6, append(make([]byte, 15), append([]byte{1}, "localhost\x00"...)...)), option(0, nil))
+	dsb := make([]byte, 12)
+	order.PutUint32(dsb, 0x544c534b)
+	order.PutUint32(dsb[4:], 4)
+	file := concat(block(pcapngSHB, shb), block(blockIDB, idb), block(blockIDB, plainIDB), epb(""),
+		block(blockNRB, nrb), epb("The retransmission starts here"), block(blockDSB, dsb), epb(""), epb("Server RST"))
+	path := filepath.Join(dir, "commented.pcapng")
+	assert.NoError(t, ioutil.WriteFile(path, file, 0644))
+	got, err := ReadPcapngMetadata(path)
+	assert.NoError(t, err)
+	want := &PcapngMetadata{
+		SectionComments:   []string{"Client hangs after the second SYN"},
+		PacketComments:    []PacketComment{{2, "The retransmission starts here"}, {4, "Server RST"}},
+		Interfaces:        []InterfaceOptions{{Name: "eth0", Filter: "tcp port 80", Speed: 1e9, TSOffset: 3600}, {}},
+		NameResolution:    []NameRecord{{"10.0.0.1", []string{"router.lan", "gw"}}, {"::1", []string{"localhost"}}},
+		DecryptionSecrets: map[string]int{"TLS key log": 1},
+	}
+	assert.Equal(t, want, got)
+
+	plain := concat(block(pcapngSHB, shb[:16]), block(blockIDB, plainIDB), epb(""))
+	assert.NoError(t, ioutil.WriteFile(path, plain, 0644))
+	got, err = ReadPcapngMetadata(path)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
@@ -0,0 +1,142 @@
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// fieldSeparator can't be in tshark's field values because it escapes control characters
+const fieldSeparator = "\x1f"
+
+// maxLineLen is the longest line of fields that a pass reads, which is plenty for a jumbo frame as hex
+const maxLineLen = 16 << 20
+
+// Pass is one tshark read of a capture. It gets the fields of every packet and any number
+// of -z statistics, so that analyses share a read instead of each adding one.
+type Pass struct {
+	Prefs  []string // Arguments before the others, like -o preferences
+	Filter string   // Display filter of the packets whose fields are read
+	Fields []string
+	// Stats are -z arguments whose output is framed by lines of =, like io,phs or conv,tcp
+	Stats []string
+	// OnPacket is called with the values of Fields for each packet as tshark reads it.
+	// A field with several values has them comma separated.
+	OnPacket func(values []string)
+	// MaxPackets stops the read after this many packets, 0 for all of them
+	MaxPackets int
+}
+
+// PassResult is what a Pass found besides the fields of packets
+type PassResult struct {
+	Packets int               // Packets that OnPacket was called with
+	Stats   map[string]string // Output of each statistic by its -z argument, without the lines of =
+}
+
+// args returns tshark's arguments for a pass over filename
+func (p Pass) args(filename string) []string {
+	args := append([]string{}, p.Prefs...)
+	args = append(args, "-n", "-r", filename)
+	if p.MaxPackets > 0 {
+		args = append(args, "-c", strconv.Itoa(p.MaxPackets))
+	}
+	if p.Filter != "" {
+		args = append(args, "-Y", p.Filter)
+	}
+	if len(p.Fields) == 0 {
+		args = append(args, "-q")
+	} else {
+		args = append(args, "-T", "fields", "-E", "separator="+fieldSeparator)
+		for _, field := range p.Fields {
+			args = append(args, "-e", field)
+		}
+	}
+	for _, stat := range p.Stats {
+		args = append(args, "-z", stat)
+	}
+	return args
+}
+
+// Run reads filename with tshark once, streaming its output through OnPacket
+func (p Pass) Run(ctx context.Context, filename string) (*PassResult, error) {
+	fmt.Printf("\033[92mINFO\033[0m tshark is reading file `%s` with fields %s and statistics %s\n", filename, p.Fields, p.Stats)
+	reader, writer := io.Pipe()
+	parsed := make(chan *PassResult, 1)
+	go func() {
+		parsed <- p.parse(reader)
+		// tshark can't exit until all of its output is read
+		io.Copy(ioutil.Discard, reader)
+	}()
+	stderr, err := runToolTo(ctx, writer, tools.Tshark, p.args(filename)...)
+	writer.Close()
+	result := <-parsed
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if FailureCategory(err) != "" {
+		return result, err
+	}
+	if err != nil {
+		return result, fmt.Errorf("\033[93mWARN\033[0m tshark error: %s %s", err, strings.TrimSpace(string(stderr)))
+	}
+	if len(stderr) > 0 {
+		// This is not a fatal error because it's ok if some files are not read
+		return result, fmt.Errorf("\033[93mWARN\033[0m tshark stderr: %s", strings.TrimSpace(string(stderr)))
+	}
+	return result, nil
+}
+
+// parse reads packet fields until the first statistic, and then each statistic in the order they were asked for
+func (p Pass) parse(r io.Reader) *PassResult {
+	result := &PassResult{Stats: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLen)
+	inStats, inBlock := false, false
+	var block strings.Builder
+	blocks := make([]string, 0, len(p.Stats))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isBanner(line) {
+			inStats = true
+			if inBlock {
+				blocks = append(blocks, block.String())
+				block.Reset()
+			}
+			inBlock = !inBlock
+			continue
+		}
+		switch {
+		case inBlock:
+			block.WriteString(line)
+			block.WriteByte('\n')
+		case !inStats && len(p.Fields) > 0:
+			values := strings.Split(line, fieldSeparator)
+			// Missing trailing fields are empty
+			for len(values) < len(p.Fields) {
+				values = append(values, "")
+			}
+			result.Packets++
+			if p.OnPacket != nil {
+				p.OnPacket(values[:len(p.Fields)])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("\033[93mWARN\033[0m Stopped reading tshark output:", err)
+	}
+	for i, text := range blocks {
+		if i < len(p.Stats) {
+			result.Stats[p.Stats[i]] = text
+		}
+	}
+	return result
+}
+
+// isBanner returns whether a line frames a statistic, which tshark does with a line of =
+func isBanner(line string) bool {
+	return len(line) >= 10 && strings.Trim(line, "=") == ""
+}
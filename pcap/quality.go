@@ -0,0 +1,213 @@
+package pcap
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// qualityFields are read after endpointFields for the quality of packets
+var qualityFields = []string{"frame.cap_len", "tcp.analysis.retransmission", "tcp.analysis.lost_segment", "tcp.analysis.out_of_order"}
+
+// pcapng interface statistics options
+const (
+	isbOptIfDrop = 5 // Packets the interface dropped
+	isbOptOSDrop = 7 // Packets the OS dropped
+)
+
+// duplicateWindow is how many packets before a packet are checked for a copy of it, like editcap -d
+const duplicateWindow = 5
+
+// futureSlack is how far past the time of analysis a timestamp can be before it's in the future
+const futureSlack = 24 * time.Hour
+
+// Quality says how clean a capture is. Drops and Duplicates are of every packet of the file,
+// while the rest are of the packets that were dissected, which is a sample if one was taken.
+type Quality struct {
+	Packets            int   // Packets that were dissected
+	Drops              int64 // Packets that interfaces or the OS dropped, from pcapng interface statistics
+	Duplicates         int   // Packets identical to one of the 5 before them, like editcap -d finds
+	Truncated          int   // Packets cut short by the snaplen
+	TCPSegments        int
+	Retransmissions    int
+	LostSegments       int // Segments tshark saw a gap before
+	OutOfOrder         int
+	BackwardTimestamps int // Packets timestamped before the packet before them
+	ZeroTimestamps     int
+	FutureTimestamps   int // Packets timestamped over a day after the capture was analyzed
+	// Score is from 0 to 100, where 100 is a capture with none of these problems
+	Score float64
+}
+
+// qualityPenalty is the most that a problem takes off a score, which it takes at a rate of full or more
+type qualityPenalty struct {
+	weight float64
+	full   float64
+}
+
+// Penalties of each problem, adding up to 100
+var (
+	dropPenalty       = qualityPenalty{25, 0.1}
+	duplicatePenalty  = qualityPenalty{10, 0.2}
+	truncatedPenalty  = qualityPenalty{10, 1}
+	retransPenalty    = qualityPenalty{20, 0.2}
+	lostPenalty       = qualityPenalty{15, 0.1}
+	outOfOrderPenalty = qualityPenalty{5, 0.1}
+	backwardPenalty   = qualityPenalty{5, 0.1}
+	badTimePenalty    = qualityPenalty{10, 0.1}
+)
+
+// of returns the penalty for count problems in total packets
+func (p qualityPenalty) of(count int64, total int64) float64 {
+	if total <= 0 || count <= 0 {
+		return 0
+	}
+	return p.weight * math.Min(1, float64(count)/float64(total)/p.full)
+}
+
+// qualityCounter adds up the quality of packets as they are read
+type qualityCounter struct {
+	quality Quality
+	now     float64 // When the analysis started, as a Unix epoch
+	prev    float64
+}
+
+func newQualityCounter() *qualityCounter {
+	return &qualityCounter{now: float64(time.Now().Unix())}
+}
+
+// add adds a packet's timestamp and length, whether it's TCP, and its values of qualityFields
+func (c *qualityCounter) add(epoch float64, length int64, isTCP bool, values []string) {
+	q := &c.quality
+	if q.Packets > 0 && epoch < c.prev {
+		q.BackwardTimestamps++
+	}
+	c.prev = epoch
+	q.Packets++
+	if epoch <= 0 {
+		q.ZeroTimestamps++
+	} else if epoch > c.now+futureSlack.Seconds() {
+		q.FutureTimestamps++
+	}
+	if len(values) < len(qualityFields) {
+		return
+	}
+	if capLen, err := strconv.ParseInt(values[0], 10, 64); err == nil && capLen < length {
+		q.Truncated++
+	}
+	if !isTCP {
+		return
+	}
+	q.TCPSegments++
+	// These fields only say that tshark flagged the segment
+	if values[1] != "" {
+		q.Retransmissions++
+	}
+	if values[2] != "" {
+		q.LostSegments++
+	}
+	if values[3] != "" {
+		q.OutOfOrder++
+	}
+}
+
+// fileQuality is what walking a pcap or pcapng file finds about its quality
+type fileQuality struct {
+	packets    int
+	drops      int64
+	duplicates int
+}
+
+// walkQuality counts the duplicate packets of a pcap or pcapng file and the drops its interfaces recorded
+func walkQuality(filename string, format FileFormat) (fileQuality, error) {
+	var fq fileQuality
+	f, err := os.Open(filename)
+	if err != nil {
+		return fq, err
+	}
+	defer f.Close()
+	sectionDrops := make(map[uint32]int64) // The latest counters of each interface, which are totals
+	recent := make([][md5.Size]byte, 0, duplicateWindow)
+	err = walkRecords(f, format, func(rec walkedRecord) error {
+		if rec.isPacket {
+			fq.packets++
+			sum := md5.Sum(rec.packet)
+			for _, prev := range recent {
+				if prev == sum {
+					fq.duplicates++
+					break
+				}
+			}
+			if len(recent) == duplicateWindow {
+				recent = append(recent[:0], recent[1:]...)
+			}
+			recent = append(recent, sum)
+			return nil
+		}
+		if format.Name != FormatPcapng {
+			return nil
+		}
+		order := rec.order
+		if order.Uint32(rec.data) == pcapngSHB {
+			for _, drops := range sectionDrops {
+				fq.drops += drops
+			}
+			sectionDrops = make(map[uint32]int64)
+		}
+		if order.Uint32(rec.data) != blockISB || len(rec.data) < 24 {
+			return nil
+		}
+		var drops int64
+		found := false
+		forOptions(rec.data[20:len(rec.data)-4], order, func(code uint16, value []byte) {
+			if (code == isbOptIfDrop || code == isbOptOSDrop) && len(value) == 8 {
+				drops += int64(order.Uint64(value))
+				found = true
+			}
+		})
+		if found {
+			sectionDrops[order.Uint32(rec.data[8:])] = drops
+		}
+		return nil
+	})
+	for _, drops := range sectionDrops {
+		fq.drops += drops
+	}
+	return fq, err
+}
+
+// forOptions calls fn with the code and value of each pcapng option until opt_endofopt
+func forOptions(options []byte, order binary.ByteOrder, fn func(code uint16, value []byte)) {
+	for len(options) >= 4 {
+		code, optLen := order.Uint16(options), int(order.Uint16(options[2:]))
+		if code == 0 || 4+optLen > len(options) {
+			return
+		}
+		fn(code, options[4:4+optLen])
+		padded := 4 + (optLen+3)/4*4
+		if padded > len(options) {
+			return
+		}
+		options = options[padded:]
+	}
+}
+
+// result returns the quality of the packets that were added and of the file, with its score
+func (c *qualityCounter) result(fq fileQuality) *Quality {
+	q := c.quality
+	q.Drops, q.Duplicates = fq.drops, fq.duplicates
+	packets := int64(q.Packets)
+	penalty := dropPenalty.of(q.Drops, q.Drops+int64(fq.packets)) +
+		duplicatePenalty.of(int64(q.Duplicates), int64(fq.packets)) +
+		truncatedPenalty.of(int64(q.Truncated), packets) +
+		retransPenalty.of(int64(q.Retransmissions), int64(q.TCPSegments)) +
+		lostPenalty.of(int64(q.LostSegments), int64(q.TCPSegments)) +
+		outOfOrderPenalty.of(int64(q.OutOfOrder), int64(q.TCPSegments)) +
+		backwardPenalty.of(int64(q.BackwardTimestamps), packets) +
+		badTimePenalty.of(int64(q.ZeroTimestamps+q.FutureTimestamps), packets)
+	q.Score = math.Round(math.Max(0, 100-penalty)*10) / 10
+	return &q
+}
@@ -0,0 +1,115 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestQualityCounter tests the quality of packets from a pass and the score
+func TestQualityCounter(t *testing.T) {
+	type packet struct {
+		epoch  float64
+		length int64
+		isTCP  bool
+		values []string
+	}
+	clean := []string{"60", "", "", ""}
+	tests := []struct {
+		name    string
+		packets []packet
+		fq      fileQuality
+		want    Quality
+	}{
+		{"Clean", []packet{{10, 60, true, clean}, {11, 60, false, clean}}, fileQuality{packets: 2},
+			Quality{Packets: 2, TCPSegments: 1, Score: 100}},
+		{"TCP problems", []packet{{10, 60, true, clean}, {11, 60, true, []string{"60", "1", "", ""}},
+			{12, 60, true, []string{"60", "", "1", "1"}}, {13, 60, true, clean}, {14, 60, false, clean}}, fileQuality{},
+			Quality{Packets: 5, TCPSegments: 4, Retransmissions: 1, LostSegments: 1, OutOfOrder: 1, Score: 60}},
+		{"Timestamps", []packet{{10, 60, false, clean}, {9, 60, false, clean}, {0, 60, false, clean}, {4e9, 60, false, clean}},
+			fileQuality{}, Quality{Packets: 4, BackwardTimestamps: 2, ZeroTimestamps: 1, FutureTimestamps: 1, Score: 85}},
+		{"Truncated", []packet{{10, 1500, false, []string{"96", "", "", ""}}, {11, 60, false, clean}}, fileQuality{},
+			Quality{Packets: 2, Truncated: 1, Score: 95}},
+		{"Drops and duplicates", []packet{{10, 60, false, clean}}, fileQuality{packets: 100, drops: 5, duplicates: 10},
+			Quality{Packets: 1, Drops: 5, Duplicates: 10, Score: 83.1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := &qualityCounter{now: 2e9}
+			for _, p := range tt.packets {
+				counter.add(p.epoch, p.length, p.isTCP, p.values)
+			}
+			assert.Equal(t, &tt.want, counter.result(tt.fq))
+		})
+	}
+}
+
+// TestWalkQuality tests that duplicates and interface drops are found in pcap and pcapng files
+func TestWalkQuality(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap-quality")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	// Packets 3 and 4 are copies of 1 and 2, and the copy of 1 at the end is too far from it
+	ports := []uint16{80, 443, 80, 443, 53, 22, 25, 110, 143, 80}
+	pcapFile, pcapngFile := header, pcapngHead(binary.LittleEndian, 6)
+	for _, port := range ports {
+		packet := ipv4Packet(6, "10.0.0.1", "10.0.0.2", 40000, port, 0x10)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+		pcapFile = concat(pcapFile, record, packet)
+		epb := make([]byte, 28, 88)
+		binary.LittleEndian.PutUint32(epb, blockEPB)
+		binary.LittleEndian.PutUint32(epb[4:], 88)
+		binary.LittleEndian.PutUint32(epb[20:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(epb[24:], uint32(len(packet)))
+		epb = append(append(epb, packet...), 0, 0, 88, 0, 0, 0)
+		pcapngFile = concat(pcapngFile, epb)
+	}
+	// Interface statistics are totals, so only the last of an interface counts. The option codes are
+	// the spec's isb_ifrecv (4), isb_ifdrop (5) and isb_osdrop (7), and received packets aren't drops.
+	isb := func(ifDrop uint64, osDrop uint64) []byte {
+		block := make([]byte, 68)
+		binary.LittleEndian.PutUint32(block, blockISB)
+		binary.LittleEndian.PutUint32(block[4:], 68)
+		binary.LittleEndian.PutUint16(block[20:], 4)
+		binary.LittleEndian.PutUint16(block[22:], 8)
+		binary.LittleEndian.PutUint64(block[24:], 1000)
+		binary.LittleEndian.PutUint16(block[32:], 5)
+		binary.LittleEndian.PutUint16(block[34:], 8)
+		binary.LittleEndian.PutUint64(block[36:], ifDrop)
+		binary.LittleEndian.PutUint16(block[44:], 7)
+		binary.LittleEndian.PutUint16(block[46:], 8)
+		binary.LittleEndian.PutUint64(block[48:], osDrop)
+		binary.LittleEndian.PutUint32(block[64:], 68)
+		return block
+	}
+	pcapngFile = concat(pcapngFile, isb(2, 1), isb(4, 3))
+	tests := []struct {
+		name    string
+		content []byte
+		format  FileFormat
+		want    fileQuality
+	}{
+		{"pcap", pcapFile, FileFormat{Name: FormatPcap, Endianness: LittleEndian}, fileQuality{packets: 10, duplicates: 2}},
+		{"pcapng", pcapngFile, FileFormat{Name: FormatPcapng}, fileQuality{packets: 10, drops: 7, duplicates: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			assert.NoError(t, ioutil.WriteFile(path, tt.content, 0644))
+			got, err := walkQuality(path, tt.format)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Fixes that Repair makes
+const (
+	FixTruncated  = "TruncatedPacket" // The last record was cut short
+	FixBadLength  = "BadBlockLength"  // A record's length was impossible, so the records after it were searched for
+	FixOutOfOrder = "OutOfOrder"      // Packets were sorted by timestamp
+)
+
+// maxRecordLen is the largest packet wireshark will read
+const maxRecordLen = 262144
+
+// RepairReport says what Repair changed
+type RepairReport struct {
+	Fixes   []string
+	Packets int   // Packets written to the repaired copy
+	Skipped int64 // Bytes of damaged records that were left out
+}
+
+// record is where a packet or block is in the file, along with the timestamp that it is sorted by
+type record struct {
+	offset   int64
+	length   int64
+	ts       timestamp
+	isPacket bool
+	isStats  bool // Interface statistics, which go after the packets they count
+}
+
+type timestamp struct {
+	sec  uint64
+	nsec uint64
+}
+
+func (ts timestamp) before(other timestamp) bool {
+	return ts.sec < other.sec || (ts.sec == other.sec && ts.nsec < other.nsec)
+}
+
+// RepairedName is where the repaired copy of a capture goes, like a.repaired.pcap for a.pcap
+func RepairedName(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".repaired" + ext
+}
+
+// Repair writes a repaired copy of src to dst, leaving src as is. Only pcap and pcapng files can be repaired.
+// The report is nil and dst isn't written if src has nothing to repair.
+func Repair(src string, dst string) (*RepairReport, error) {
+	format, ok := DetectFileFormat(src)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a capture that can be repaired", src)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Records are read through a window and only their offsets are kept, so big captures aren't read into memory
+	w := &fileWindow{r: f, size: info.Size()}
+	var records []record
+	var report RepairReport
+	switch format.Name {
+	case FormatPcap, FormatPcapNsec:
+		if w.size < pcapHeaderLen {
+			return nil, fmt.Errorf("%s is too short to have a pcap header", src)
+		}
+		records, report = repairPcap(w, format)
+	case FormatPcapng:
+		if w.size < 12 {
+			return nil, fmt.Errorf("%s is too short to have a pcapng section header", src)
+		}
+		records, report = repairPcapng(w)
+	default:
+		return nil, fmt.Errorf("%s is a %s file, and only pcap and pcapng files can be repaired", src, format.Name)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	if len(report.Fixes) == 0 {
+		return nil, nil
+	}
+	if err := writeRecords(f, records, dst); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// writeRecords copies records from src to a new file at dst in the order given
+func writeRecords(src io.ReaderAt, records []record, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+	for _, rec := range records {
+		if _, err := io.Copy(writer, io.NewSectionReader(src, rec.offset, rec.length)); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// windowSize is how much of a file fileWindow reads at a time
+const windowSize = 1 << 20
+
+// fileWindow reads parts of a file through a buffer, so that scanning it byte by byte doesn't read byte by byte
+type fileWindow struct {
+	r     io.ReaderAt
+	size  int64
+	start int64 // Offset of buf in the file
+	buf   []byte
+	err   error // The first error reading the file, after which bytes returns nil
+}
+
+// bytes returns the n bytes at offset, or nil if the file ends before them.
+// They are only valid until the next call.
+func (w *fileWindow) bytes(offset int64, n int) []byte {
+	if w.err != nil || offset < 0 || n < 0 || offset+int64(n) > w.size {
+		return nil
+	}
+	if offset < w.start || offset+int64(n) > w.start+int64(len(w.buf)) {
+		size := int64(windowSize)
+		if int64(n) > size {
+			size = int64(n)
+		}
+		if offset+size > w.size {
+			size = w.size - offset
+		}
+		if int64(cap(w.buf)) < size {
+			w.buf = make([]byte, size)
+		}
+		read, err := w.r.ReadAt(w.buf[:size], offset)
+		if err != nil && !(err == io.EOF && int64(read) == size) {
+			w.err = err
+			w.buf = w.buf[:0]
+			return nil
+		}
+		w.start, w.buf = offset, w.buf[:read]
+	}
+	return w.buf[offset-w.start : offset-w.start+int64(n)]
+}
+
+// uint32 returns the number at offset, or 0 if the file ends before it
+func (w *fileWindow) uint32(offset int64, order binary.ByteOrder) uint32 {
+	if b := w.bytes(offset, 4); b != nil {
+		return order.Uint32(b)
+	}
+	return 0
+}
+
+// addFix adds fix to the report once
+func (r *RepairReport) addFix(fix string) {
+	for _, existing := range r.Fixes {
+		if existing == fix {
+			return
+		}
+	}
+	r.Fixes = append(r.Fixes, fix)
+}
+
+// repairPcap finds every intact record of a libpcap file, in timestamp order after the file header
+func repairPcap(w *fileWindow, format FileFormat) ([]record, RepairReport) {
+	var report RepairReport
+	order := byteOrder(format.Endianness)
+	size := w.size
+	fracPerSec := uint64(1000000)
+	if format.Precision == PrecisionNs {
+		fracPerSec = 1000000000
+	}
+	snaplen := int64(w.uint32(16, order))
+	if snaplen <= 0 || snaplen > maxRecordLen {
+		snaplen = maxRecordLen
+	}
+	// isRecord checks that the record header at offset could be real
+	isRecord := func(offset int64) (int64, bool) {
+		header := w.bytes(offset, 16)
+		if header == nil {
+			return 0, false
+		}
+		inclLen := int64(order.Uint32(header[8:]))
+		origLen := int64(order.Uint32(header[12:]))
+		frac := uint64(order.Uint32(header[4:]))
+		return inclLen, inclLen <= snaplen && origLen <= maxRecordLen && frac < fracPerSec
+	}
+	packets := make([]record, 0)
+	offset := int64(pcapHeaderLen)
+	for offset < size && w.err == nil {
+		inclLen, ok := isRecord(offset)
+		switch {
+		case offset+16 > size || (ok && offset+16+inclLen > size):
+			report.addFix(FixTruncated)
+			report.Skipped += size - offset
+			offset = size
+			continue
+		case !ok:
+			report.addFix(FixBadLength)
+			next := resync(offset+1, size, 1, func(candidate int64) bool {
+				candidateLen, candidateOk := isRecord(candidate)
+				end := candidate + 16 + candidateLen
+				if !candidateOk || end > size {
+					return false
+				}
+				// Empty packets are allowed when walking but zeroed bytes would look like them
+				if candidateLen == 0 || int64(w.uint32(candidate+12, order)) < candidateLen {
+					return false
+				}
+				// Two plausible records in a row are unlikely to be chance
+				_, nextOk := isRecord(end)
+				return end == size || nextOk
+			})
+			report.Skipped += next - offset
+			offset = next
+			continue
+		}
+		ts := timestamp{uint64(w.uint32(offset, order)), uint64(w.uint32(offset+4, order)) * (1000000000 / fracPerSec)}
+		packets = append(packets, record{offset: offset, length: 16 + inclLen, ts: ts, isPacket: true})
+		offset += 16 + inclLen
+	}
+	sortPackets(packets, &report)
+	report.Packets = len(packets)
+	return append([]record{{offset: 0, length: pcapHeaderLen}}, packets...), report
+}
+
+// pcapng block types
+const (
+	blockIDB    = 0x00000001
+	blockPB     = 0x00000002 // Obsolete packet block
+	blockSPB    = 0x00000003
+	blockNRB    = 0x00000004
+	blockISB    = 0x00000005
+	blockEPB    = 0x00000006
+	blockDSB    = 0x0000000a
+	blockCustom = 0x00000bad
+	blockCopy   = 0x40000bad // Custom block that may be copied
+)
+
+var knownBlocks = map[uint32]bool{
+	pcapngSHB: true, blockIDB: true, blockPB: true, blockSPB: true, blockNRB: true,
+	blockISB: true, blockEPB: true, blockDSB: true, blockCustom: true, blockCopy: true,
+}
+
+// repairPcapng finds every intact block of a pcapng file. Packets are sorted if the file has one section
+// and every packet has a timestamp.
+func repairPcapng(w *fileWindow) ([]record, RepairReport) {
+	var report RepairReport
+	size := w.size
+	order := byteOrder(LittleEndian)
+	if w.uint32(8, binary.BigEndian) == pcapngByteMagic {
+		order = byteOrder(BigEndian)
+	}
+	// blockLen returns the length of a block at offset whose leading and trailing lengths agree
+	blockLen := func(offset int64) (int64, bool) {
+		if offset+12 > size {
+			return 0, false
+		}
+		length := int64(w.uint32(offset+4, order))
+		if length < 12 || length%4 != 0 || offset+length > size {
+			return length, false
+		}
+		return length, int64(w.uint32(offset+length-4, order)) == length
+	}
+	records := make([]record, 0)
+	tsUnits := make([]uint64, 0) // Timestamp units per second of each interface
+	sections := 0
+	sortable := true
+	offset := int64(0)
+	for offset < size && w.err == nil {
+		length, ok := blockLen(offset)
+		if !ok {
+			// A block that runs past the end of the file but is otherwise fine was cut short
+			if offset+12 > size || (length >= 12 && length%4 == 0 && offset+length > size && knownBlocks[w.uint32(offset, order)]) {
+				report.addFix(FixTruncated)
+				report.Skipped += size - offset
+				break
+			}
+			report.addFix(FixBadLength)
+			next := resync(offset+4, size, 4, func(candidate int64) bool {
+				_, candidateOk := blockLen(candidate)
+				return candidateOk && knownBlocks[w.uint32(candidate, order)]
+			})
+			report.Skipped += next - offset
+			offset = next
+			continue
+		}
+		rec := record{offset: offset, length: length}
+		switch w.uint32(offset, order) {
+		case pcapngSHB:
+			sections++
+			tsUnits = tsUnits[:0]
+		case blockIDB:
+			units := uint64(1000000)
+			// Interfaces are small, so one that isn't gets the default resolution rather than being read whole
+			if length <= maxRecordLen {
+				units = idbUnits(w.bytes(offset, int(length)), order)
+			}
+			tsUnits = append(tsUnits, units)
+		case blockEPB, blockPB:
+			rec.isPacket = true
+			header := w.bytes(offset, 20)
+			if length < 20 || header == nil {
+				sortable = false
+				break
+			}
+			ifaceID := int(order.Uint32(header[8:]))
+			if order.Uint32(header) == blockPB {
+				ifaceID = int(order.Uint16(header[8:]))
+			}
+			if ifaceID >= len(tsUnits) {
+				sortable = false
+				break
+			}
+			raw := uint64(order.Uint32(header[12:]))<<32 | uint64(order.Uint32(header[16:]))
+			rec.ts = toTimestamp(raw, tsUnits[ifaceID])
+		case blockSPB:
+			// Simple packets have no timestamp, so the file can't be sorted
+			rec.isPacket = true
+			sortable = false
+		case blockISB:
+			rec.isStats = true
+		}
+		records = append(records, rec)
+		offset += length
+	}
+	if sections == 1 && sortable {
+		records = sortPcapngBlocks(records, &report)
+	}
+	for _, rec := range records {
+		if rec.isPacket {
+			report.Packets++
+		}
+	}
+	return records, report
+}
+
+// sortPcapngBlocks puts packets in timestamp order if they aren't. Sorted packets go after the
+// section header, interfaces and other metadata, and before interface statistics.
+func sortPcapngBlocks(blocks []record, report *RepairReport) []record {
+	packets := make([]record, 0, len(blocks))
+	for _, block := range blocks {
+		if block.isPacket {
+			packets = append(packets, block)
+		}
+	}
+	before := len(report.Fixes)
+	sortPackets(packets, report)
+	if len(report.Fixes) == before {
+		return blocks
+	}
+	sorted := make([]record, 0, len(blocks))
+	stats := make([]record, 0)
+	for _, block := range blocks {
+		switch {
+		case block.isPacket:
+		case block.isStats:
+			stats = append(stats, block)
+		default:
+			sorted = append(sorted, block)
+		}
+	}
+	sorted = append(sorted, packets...)
+	return append(sorted, stats...)
+}
+
+// sortPackets stably sorts packets by timestamp if any are out of order
+func sortPackets(packets []record, report *RepairReport) {
+	for i := 1; i < len(packets); i++ {
+		if packets[i].ts.before(packets[i-1].ts) {
+			report.addFix(FixOutOfOrder)
+			sort.SliceStable(packets, func(a, b int) bool { return packets[a].ts.before(packets[b].ts) })
+			return
+		}
+	}
+}
+
+// idbUnits returns how many timestamp units make a second for an interface, which is 10^6 without if_tsresol
+func idbUnits(block []byte, order binary.ByteOrder) uint64 {
+	if len(block) < 20 {
+		return 1000000
+	}
+	options := block[16 : len(block)-4]
+	for len(options) >= 4 {
+		code, optLen := order.Uint16(options), int(order.Uint16(options[2:]))
+		if code == 0 || 4+optLen > len(options) {
+			break
+		}
+		if code == pcapngOptTsresol && optLen == 1 {
+			tsresol := options[4]
+			if tsresol&0x80 != 0 {
+				power := tsresol & 0x7f
+				if power > 63 {
+					power = 63
+				}
+				return 1 << power
+			}
+			units := uint64(1)
+			for i := byte(0); i < tsresol && i < 19; i++ {
+				units *= 10
+			}
+			return units
+		}
+		options = options[4+(optLen+3)/4*4:]
+	}
+	return 1000000
+}
+
+// toTimestamp converts a count of units to seconds and nanoseconds
+func toTimestamp(raw uint64, unitsPerSec uint64) timestamp {
+	sec, rem := raw/unitsPerSec, raw%unitsPerSec
+	hi, lo := bits.Mul64(rem, 1000000000)
+	nsec, _ := bits.Div64(hi, lo, unitsPerSec)
+	return timestamp{sec, nsec}
+}
+
+// resync returns the first offset from start, in steps of step, where isValid is true, or end if there is none
+func resync(start int64, end int64, step int64, isValid func(int64) bool) int64 {
+	for candidate := start; candidate < end; candidate += step {
+		if isValid(candidate) {
+			return candidate
+		}
+	}
+	return end
+}
+
+func byteOrder(endianness string) binary.ByteOrder {
+	if endianness == BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
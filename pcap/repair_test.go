@@ -0,0 +1,102 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pcapRecord builds a little endian pcap record with a 4 byte packet
+func pcapRecord(sec uint32, usec uint32) []byte {
+	rec := make([]byte, 20)
+	binary.LittleEndian.PutUint32(rec, sec)
+	binary.LittleEndian.PutUint32(rec[4:], usec)
+	binary.LittleEndian.PutUint32(rec[8:], 4)
+	binary.LittleEndian.PutUint32(rec[12:], 4)
+	return rec
+}
+
+// pcapngEPB builds a little endian enhanced packet block on interface 0 with a 4 byte packet
+func pcapngEPB(ts uint64) []byte {
+	epb := make([]byte, 36)
+	binary.LittleEndian.PutUint32(epb, blockEPB)
+	binary.LittleEndian.PutUint32(epb[4:], 36)
+	binary.LittleEndian.PutUint32(epb[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[20:], 4)
+	binary.LittleEndian.PutUint32(epb[24:], 4)
+	binary.LittleEndian.PutUint32(epb[32:], 36)
+	return epb
+}
+
+func concat(parts ...[]byte) []byte {
+	joined := make([]byte, 0)
+	for _, part := range parts {
+		joined = append(joined, part...)
+	}
+	return joined
+}
+
+// TestRepair tests Repair
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	badRecord := pcapRecord(1, 0)
+	binary.LittleEndian.PutUint32(badRecord[8:], 0xffffff00)
+	ngHead := pcapngHead(binary.LittleEndian, 9)
+	badBlock := pcapngEPB(3)
+	binary.LittleEndian.PutUint32(badBlock[4:], 40)
+	tests := []struct {
+		name        string
+		content     []byte
+		want        *RepairReport
+		wantContent []byte
+	}{
+		{"Intact pcap", concat(header, pcapRecord(1, 0), pcapRecord(2, 0)), nil, nil},
+		{"Truncated last packet", concat(header, pcapRecord(1, 0), pcapRecord(2, 0)[:18]),
+			&RepairReport{[]string{FixTruncated}, 1, 18}, concat(header, pcapRecord(1, 0))},
+		{"Impossible record length", concat(header, pcapRecord(1, 0), badRecord, pcapRecord(3, 0), pcapRecord(4, 0)),
+			&RepairReport{[]string{FixBadLength}, 3, 20}, concat(header, pcapRecord(1, 0), pcapRecord(3, 0), pcapRecord(4, 0))},
+		{"Out of order pcap", concat(header, pcapRecord(2, 0), pcapRecord(1, 5), pcapRecord(1, 2)),
+			&RepairReport{[]string{FixOutOfOrder}, 3, 0}, concat(header, pcapRecord(1, 2), pcapRecord(1, 5), pcapRecord(2, 0))},
+		{"Intact pcapng", concat(ngHead, pcapngEPB(1), pcapngEPB(2)), nil, nil},
+		{"Truncated pcapng block", concat(ngHead, pcapngEPB(1), pcapngEPB(2)[:30]),
+			&RepairReport{[]string{FixTruncated}, 1, 30}, concat(ngHead, pcapngEPB(1))},
+		{"Mismatched block lengths", concat(ngHead, pcapngEPB(1), badBlock, pcapngEPB(4)),
+			&RepairReport{[]string{FixBadLength}, 2, 36}, concat(ngHead, pcapngEPB(1), pcapngEPB(4))},
+		{"Out of order pcapng", concat(ngHead, pcapngEPB(2000000000), pcapngEPB(1000000001)),
+			&RepairReport{[]string{FixOutOfOrder}, 2, 0}, concat(ngHead, pcapngEPB(1000000001), pcapngEPB(2000000000))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(dir, "capture.pcap")
+			dst := RepairedName(src)
+			os.Remove(dst)
+			ioutil.WriteFile(src, tt.content, 0644)
+			got, err := Repair(src, dst)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			original, _ := ioutil.ReadFile(src)
+			assert.Equal(t, tt.content, original, "the original should be untouched")
+			repaired, readErr := ioutil.ReadFile(dst)
+			if tt.wantContent == nil {
+				assert.True(t, os.IsNotExist(readErr), "nothing should be written without repairs")
+				return
+			}
+			assert.Equal(t, tt.wantContent, repaired)
+			assert.Equal(t, filepath.Join(dir, "capture.repaired.pcap"), dst)
+		})
+	}
+}
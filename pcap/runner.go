@@ -0,0 +1,132 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ToolLimits bound every call to tshark and capinfos
+type ToolLimits struct {
+	Timeout   time.Duration // Wall clock time of one call, 0 for no limit
+	MaxMemory int64         // Bytes of address space, 0 for no limit. Only enforced on Linux.
+	MaxCPU    time.Duration // CPU time of one call, 0 for no limit. Only enforced on Linux.
+}
+
+// DefaultToolLimits are generous enough for the largest captures that sources host
+func DefaultToolLimits() ToolLimits {
+	return ToolLimits{Timeout: 10 * time.Minute, MaxMemory: 8 << 30, MaxCPU: 20 * time.Minute}
+}
+
+var toolLimits = DefaultToolLimits()
+
+// SetToolLimits changes the limits of every tool that runs after it
+func SetToolLimits(limits ToolLimits) {
+	toolLimits = limits
+}
+
+// Failure categories of tools that were killed
+const (
+	FailureTimeout     = "Timeout"
+	FailureCPULimit    = "CPULimit"
+	FailureMemoryLimit = "MemoryLimit"
+)
+
+// TimeoutError is returned when a tool ran for longer than ToolLimits.Timeout
+type TimeoutError struct {
+	Tool    string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s was killed after running for %s: %s %s", e.Tool, e.Timeout, e.Tool, strings.Join(e.Args, " "))
+}
+
+// ResourceError is returned when a tool hit ToolLimits.MaxCPU or ToolLimits.MaxMemory
+type ResourceError struct {
+	Tool     string
+	Args     []string
+	Category string // FailureCPULimit or FailureMemoryLimit
+}
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("%s was stopped by %s: %s %s", e.Tool, e.Category, e.Tool, strings.Join(e.Args, " "))
+}
+
+// FailureCategory returns the failure category of a tool that was killed, or an empty string for other errors
+func FailureCategory(err error) string {
+	var timeout *TimeoutError
+	var resource *ResourceError
+	switch {
+	case errors.As(err, &timeout):
+		return FailureTimeout
+	case errors.As(err, &resource):
+		return resource.Category
+	}
+	return ""
+}
+
+// Allocation failures of glib, which tshark and capinfos use
+var outOfMemoryMarkers = []string{"Out Of Memory", "failed to allocate"}
+
+// runTool runs an external tool within toolLimits and returns what it wrote to stdout and stderr
+func runTool(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
+	stdout := new(bytes.Buffer)
+	stderr, err := runToolTo(ctx, stdout, name, args...)
+	return stdout.Bytes(), stderr, err
+}
+
+// runToolTo runs an external tool within toolLimits, streaming its stdout to stdout, and returns its stderr.
+// Tools are put in their own process group so that a kill also stops anything they started.
+func runToolTo(ctx context.Context, stdout io.Writer, name string, args ...string) ([]byte, error) {
+	limits := toolLimits
+	runCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	cmd := exec.Command(name, args...)
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Limits only apply from here, a moment after the tool started
+	if err := limitResources(cmd.Process.Pid, limits); err != nil {
+		fmt.Printf("\033[93mWARN\033[0m Could not limit resources of %s: %s\n", name, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-runCtx.Done():
+		killProcessGroup(cmd)
+		err = <-done
+	}
+	switch {
+	case ctx.Err() != nil:
+		return stderr.Bytes(), ctx.Err()
+	case runCtx.Err() != nil:
+		return stderr.Bytes(), &TimeoutError{name, args, limits.Timeout}
+	case exceededCPU(cmd, limits):
+		return stderr.Bytes(), &ResourceError{name, args, FailureCPULimit}
+	}
+	if err != nil && limits.MaxMemory > 0 {
+		for _, marker := range outOfMemoryMarkers {
+			if strings.Contains(stderr.String(), marker) {
+				return stderr.Bytes(), &ResourceError{name, args, FailureMemoryLimit}
+			}
+		}
+	}
+	return stderr.Bytes(), err
+}
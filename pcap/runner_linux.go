@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package pcap
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the tool and everything it started
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// limitResources sets rlimits on a running tool. Go can't set another process' rlimits between fork
+// and exec, so the tool runs without them from its exec until this returns. The window is usually
+// over while the tool is still loading its libraries, before it could use much of either.
+func limitResources(pid int, limits ToolLimits) error {
+	if limits.MaxMemory > 0 {
+		max := uint64(limits.MaxMemory)
+		if err := prlimit(pid, syscall.RLIMIT_AS, syscall.Rlimit{Cur: max, Max: max}); err != nil {
+			return err
+		}
+	}
+	if limits.MaxCPU > 0 {
+		seconds := uint64((limits.MaxCPU + time.Second - 1) / time.Second)
+		// The soft limit sends SIGXCPU, and the hard limit a second later SIGKILL in case that's ignored
+		if err := prlimit(pid, syscall.RLIMIT_CPU, syscall.Rlimit{Cur: seconds, Max: seconds + 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets a limit of another process because syscall can only set this process' limits
+func prlimit(pid int, resource int, limit syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// exceededCPU returns whether a finished tool was killed for using too much CPU time
+func exceededCPU(cmd *exec.Cmd, limits ToolLimits) bool {
+	if cmd.ProcessState == nil {
+		return false
+	}
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	if status.Signal() == syscall.SIGXCPU {
+		return true
+	}
+	// The hard limit's SIGKILL
+	return status.Signal() == syscall.SIGKILL && limits.MaxCPU > 0 && cmd.ProcessState.UserTime()+cmd.ProcessState.SystemTime() >= limits.MaxCPU
+}
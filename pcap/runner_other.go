@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package pcap
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the tool because process groups aren't portable
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// limitResources does nothing because rlimits of other processes can only be set on Linux
+func limitResources(pid int, limits ToolLimits) error {
+	return nil
+}
+
+func exceededCPU(cmd *exec.Cmd, limits ToolLimits) bool {
+	return false
+}
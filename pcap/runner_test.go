@@ -0,0 +1,51 @@
+package pcap
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRunTool tests that runTool kills tools that break their limits
+func TestRunTool(t *testing.T) {
+	defer SetToolLimits(DefaultToolLimits())
+	tests := []struct {
+		name         string
+		limits       ToolLimits
+		args         []string
+		linuxOnly    bool
+		wantCategory string
+		wantStdout   string
+	}{
+		{"Finishes in time", ToolLimits{Timeout: 5 * time.Second}, []string{"-c", "echo hi"}, false, "", "hi\n"},
+		{"Timeout", ToolLimits{Timeout: 200 * time.Millisecond}, []string{"-c", "sleep 10"}, false, FailureTimeout, ""},
+		// The shell's children share its pipes, so this only returns quickly if they are killed too
+		{"Timeout kills children", ToolLimits{Timeout: 200 * time.Millisecond}, []string{"-c", "sleep 10 & sleep 10; wait"}, true, FailureTimeout, ""},
+		{"CPU limit", ToolLimits{Timeout: 10 * time.Second, MaxCPU: time.Second}, []string{"-c", "while :; do :; done"}, true, FailureCPULimit, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.linuxOnly && runtime.GOOS != "linux" {
+				t.Skip("Process groups and rlimits are only used on Linux")
+			}
+			SetToolLimits(tt.limits)
+			start := time.Now()
+			stdout, _, err := runTool(context.Background(), "sh", tt.args...)
+			assert.Equal(t, tt.wantCategory, FailureCategory(err), "runTool() error = %v", err)
+			assert.Equal(t, tt.wantStdout, string(stdout))
+			assert.True(t, time.Since(start) < 5*time.Second, "runTool() took %s", time.Since(start))
+		})
+	}
+}
+
+// TestRunToolCanceled tests that canceling the crawl is not recorded as a timeout
+func TestRunToolCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, _, err := runTool(ctx, "sh", "-c", "sleep 10")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, "", FailureCategory(err))
+}
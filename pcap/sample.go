@@ -0,0 +1,339 @@
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Sampling modes
+const (
+	SampleHead    = "head"    // The first packets
+	SamplePackets = "packets" // Packets spread evenly by packet number
+	SampleTime    = "time"    // The first packet of each of evenly spaced slices of time
+)
+
+// Sampling is when and how captures that are too large to dissect fully are sampled instead
+type Sampling struct {
+	MaxSize    int64  // Captures of more bytes are sampled, 0 for no limit
+	MaxPackets int    // Captures of more packets are sampled, 0 for no limit
+	Mode       string // SampleHead, SamplePackets or SampleTime
+	Packets    int    // Packets in a sample
+}
+
+// DefaultSampling samples nothing until a limit is set
+func DefaultSampling() Sampling {
+	return Sampling{Mode: SampleHead, Packets: 100000}
+}
+
+var sampling = DefaultSampling()
+
+// SetSampling changes how every capture analyzed after it is sampled
+func SetSampling(s Sampling) {
+	sampling = s
+}
+
+// SampleReport says how a capture was sampled. Only pcap and pcapng files can be sampled by
+// packets or time, so other formats are sampled by head.
+type SampleReport struct {
+	Sampling
+	Analyzed int // Packets that tshark dissected
+	Total    int // Packets in the capture, or -1 if they couldn't be counted
+}
+
+// maxBlockLen is the largest pcapng block that is read, which is plenty for a packet with options
+const maxBlockLen = 16 << 20
+
+// walkedRecord is the file header, a record or a block of a capture
+type walkedRecord struct {
+	data     []byte // Only valid until the next record is read
+	isPacket bool
+	epoch    float64 // Timestamp of a packet, or of the packet before for pcapng simple packets
+	origLen  int64   // Length of a packet before it was cut to the snaplen
+	packet   []byte  // The captured bytes of a packet
+	linkType uint32  // Link type of a packet's interface
+	order    binary.ByteOrder
+}
+
+// canWalk returns whether walkRecords can read a format. Modified pcap isn't one of them
+// because its records have 24-byte headers.
+func canWalk(format FileFormat) bool {
+	switch format.Name {
+	case FormatPcap, FormatPcapNsec, FormatPcapng:
+		return true
+	}
+	return false
+}
+
+// walkRecords calls fn with each header, record or block of a pcap or pcapng file without reading
+// it all into memory. It stops at the first damaged record because Repair is what fixes those.
+func walkRecords(r io.Reader, format FileFormat, fn func(rec walkedRecord) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	if format.Name == FormatPcapng {
+		return walkPcapng(br, fn)
+	}
+	return walkPcap(br, format, fn)
+}
+
+func walkPcap(r io.Reader, format FileFormat, fn func(rec walkedRecord) error) error {
+	order := byteOrder(format.Endianness)
+	fracPerSec := 1e6
+	if format.Precision == PrecisionNs {
+		fracPerSec = 1e9
+	}
+	buf := make([]byte, pcapHeaderLen, 16+maxRecordLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if err := fn(walkedRecord{data: buf, order: order}); err != nil {
+		return err
+	}
+	// The upper bits of the link type can hold an FCS length
+	linkType := order.Uint32(buf[20:]) & 0x0fffffff
+	for {
+		buf = buf[:16]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil
+		}
+		inclLen := int(order.Uint32(buf[8:]))
+		if inclLen > maxRecordLen {
+			return nil
+		}
+		buf = buf[:16+inclLen]
+		if _, err := io.ReadFull(r, buf[16:]); err != nil {
+			return nil
+		}
+		epoch := float64(order.Uint32(buf)) + float64(order.Uint32(buf[4:]))/fracPerSec
+		rec := walkedRecord{data: buf, isPacket: true, epoch: epoch, origLen: int64(order.Uint32(buf[12:])),
+			packet: buf[16:], linkType: linkType, order: order}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func walkPcapng(r *bufio.Reader, fn func(rec walkedRecord) error) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	tsUnits := make([]uint64, 0) // Timestamp units per second of each interface
+	linkTypes := make([]uint32, 0)
+	var epoch float64
+	buf := make([]byte, 0, 64*1024)
+	for {
+		head, err := r.Peek(12)
+		if err != nil {
+			return nil
+		}
+		if binary.BigEndian.Uint32(head) == pcapngSHB {
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(head[8:]) == pcapngByteMagic {
+				order = binary.BigEndian
+			}
+		}
+		length := int(order.Uint32(head[4:]))
+		if length < 12 || length%4 != 0 || length > maxBlockLen {
+			return nil
+		}
+		if cap(buf) < length {
+			buf = make([]byte, length)
+		}
+		buf = buf[:length]
+		if _, err := io.ReadFull(r, buf); err != nil || int(order.Uint32(buf[length-4:])) != length {
+			return nil
+		}
+		rec := walkedRecord{data: buf, order: order}
+		switch order.Uint32(buf) {
+		case pcapngSHB:
+			tsUnits = tsUnits[:0]
+			linkTypes = linkTypes[:0]
+		case blockIDB:
+			tsUnits = append(tsUnits, idbUnits(buf, order))
+			linkTypes = append(linkTypes, uint32(order.Uint16(buf[8:])))
+		case blockEPB, blockPB:
+			if length < 28 {
+				break
+			}
+			rec.isPacket = true
+			ifaceID := int(order.Uint32(buf[8:]))
+			if order.Uint32(buf) == blockPB {
+				ifaceID = int(order.Uint16(buf[8:]))
+			}
+			if ifaceID < len(tsUnits) {
+				raw := uint64(order.Uint32(buf[12:]))<<32 | uint64(order.Uint32(buf[16:]))
+				ts := toTimestamp(raw, tsUnits[ifaceID])
+				epoch = float64(ts.sec) + float64(ts.nsec)/1e9
+			}
+			rec.origLen = int64(order.Uint32(buf[24:]))
+			if ifaceID < len(linkTypes) {
+				rec.linkType = linkTypes[ifaceID]
+			}
+			if capLen := int(order.Uint32(buf[20:])); capLen <= length-32 {
+				rec.packet = buf[28 : 28+capLen]
+			}
+		case blockSPB:
+			// A simple packet block has at least its original length and trailing length after the header
+			if length < 16 {
+				break
+			}
+			rec.isPacket = true
+			rec.origLen = int64(order.Uint32(buf[8:]))
+			// Simple packets are of the first interface, and only say how long they were on the wire
+			if len(linkTypes) > 0 {
+				rec.linkType = linkTypes[0]
+			}
+			capLen := length - 16
+			if rec.origLen < int64(capLen) {
+				capLen = int(rec.origLen)
+			}
+			rec.packet = buf[12 : 12+capLen]
+		}
+		rec.epoch = epoch
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// countPackets adds up every packet of a pcap or pcapng file without dissecting them
+func countPackets(filename string, format FileFormat) (captureSummary, error) {
+	var summary captureSummary
+	f, err := os.Open(filename)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+	err = walkRecords(f, format, func(rec walkedRecord) error {
+		if rec.isPacket {
+			summary.add(rec.epoch, rec.origLen)
+		}
+		return nil
+	})
+	return summary, err
+}
+
+// sampleSlot returns which of n slots a packet falls in, so that the first packet of each slot is sampled
+func sampleSlot(mode string, n int, index int, epoch float64, total captureSummary) int {
+	duration := total.last - total.first
+	switch {
+	case mode == SampleTime && duration > 0:
+		slot := int((epoch - total.first) / duration * float64(n))
+		if slot < 0 {
+			return 0
+		}
+		if slot >= n {
+			return n - 1
+		}
+		return slot
+	case mode == SampleHead:
+		return index
+	}
+	if total.packets == 0 {
+		return index
+	}
+	// Spread by packet number, which time sampling also falls back to if every packet has the same time
+	return int(int64(index) * int64(n) / int64(total.packets))
+}
+
+// writeSample writes a copy of a pcap or pcapng file with only sampled packets, and returns its name.
+// total is of the whole file, as returned by countPackets.
+func writeSample(filename string, format FileFormat, mode string, n int, total captureSummary) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "hubcap-sample-*"+filepath.Ext(filename))
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(dst, 1<<20)
+	taken := make([]bool, n)
+	index := 0
+	err = walkRecords(src, format, func(rec walkedRecord) error {
+		if rec.isPacket {
+			slot := sampleSlot(mode, n, index, rec.epoch, total)
+			index++
+			if slot >= n || taken[slot] {
+				return nil
+			}
+			taken[slot] = true
+		}
+		_, writeErr := w.Write(rec.data)
+		return writeErr
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("Problem writing a sample of %s: %s", filename, err)
+	}
+	return dst.Name(), nil
+}
+
+// samplePlan is whether and how a capture is sampled
+type samplePlan struct {
+	report   *SampleReport          // nil if the capture isn't sampled
+	format   FileFormat             // Format of the capture
+	exact    *captureSummary        // Every packet, when walkRecords could read them
+	capinfos map[string]interface{} // capinfos of every packet, for formats walkRecords can't read
+}
+
+// planSample decides whether a capture is sampled. Exact counters of a sampled capture come from
+// reading every record without dissecting it, which capinfos does for formats that hubcap can't read.
+func planSample(ctx context.Context, filename string) (*samplePlan, error) {
+	s := sampling
+	plan := &samplePlan{}
+	if s.Packets <= 0 || (s.MaxSize <= 0 && s.MaxPackets <= 0) {
+		return plan, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	oversized := s.MaxSize > 0 && info.Size() > s.MaxSize
+	if !oversized && s.MaxPackets <= 0 {
+		return plan, nil
+	}
+	format, ok := DetectFileFormat(filename)
+	readable := ok && canWalk(format)
+	plan.format = format
+	total := -1
+	if readable {
+		summary, err := countPackets(filename, format)
+		if err != nil {
+			return nil, err
+		}
+		plan.exact = &summary
+		total = summary.packets
+	} else {
+		capinfos, err := GetCapinfos(ctx, filename)
+		if ctx.Err() != nil || FailureCategory(err) != "" {
+			return nil, err
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		plan.capinfos = capinfos
+		if packets, ok := capinfos["NumberOfPackets"].(float64); ok {
+			total = int(packets)
+		}
+	}
+	tooMany := s.MaxPackets > 0 && total > s.MaxPackets
+	// A sample has to be smaller than the capture to be worth it
+	if !(oversized || tooMany) || (total >= 0 && total <= s.Packets) {
+		return plan, nil
+	}
+	plan.report = &SampleReport{Sampling: s, Total: total}
+	if !readable {
+		plan.report.Mode = SampleHead
+	}
+	return plan, nil
+}
@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWriteSample tests that samples keep headers and the chosen packets
+func TestWriteSample(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hubcap-sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header, 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	// Most packets are in the first second, so sampling by time and by packets differ
+	pcapFile := concat(header, pcapRecord(0, 0), pcapRecord(0, 1), pcapRecord(0, 2), pcapRecord(0, 3),
+		pcapRecord(0, 4), pcapRecord(0, 5), pcapRecord(5, 0), pcapRecord(9, 0))
+	ngHead := pcapngHead(binary.LittleEndian, 9)
+	pcapngFile := concat(ngHead, pcapngEPB(1e9), pcapngEPB(2e9), pcapngEPB(3e9), pcapngEPB(4e9))
+	tests := []struct {
+		name        string
+		content     []byte
+		mode        string
+		n           int
+		wantSummary captureSummary
+		want        []byte
+	}{
+		{"pcap head", pcapFile, SampleHead, 2, captureSummary{packets: 8, dataSize: 32, first: 0, last: 9, prev: 9, inOrder: true},
+			concat(header, pcapRecord(0, 0), pcapRecord(0, 1))},
+		{"pcap packets", pcapFile, SamplePackets, 4, captureSummary{packets: 8, dataSize: 32, first: 0, last: 9, prev: 9, inOrder: true},
+			concat(header, pcapRecord(0, 0), pcapRecord(0, 2), pcapRecord(0, 4), pcapRecord(5, 0))},
+		{"pcap time", pcapFile, SampleTime, 3, captureSummary{packets: 8, dataSize: 32, first: 0, last: 9, prev: 9, inOrder: true},
+			concat(header, pcapRecord(0, 0), pcapRecord(5, 0), pcapRecord(9, 0))},
+		{"pcapng packets", pcapngFile, SamplePackets, 2, captureSummary{packets: 4, dataSize: 16, first: 1, last: 4, prev: 4, inOrder: true},
+			concat(ngHead, pcapngEPB(1e9), pcapngEPB(3e9))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "capture")
+			assert.NoError(t, ioutil.WriteFile(path, tt.content, 0644))
+			format, ok := DetectFileFormat(path)
+			assert.True(t, ok)
+			summary, err := countPackets(path, format)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSummary, summary)
+			sample, err := writeSample(path, format, tt.mode, tt.n, summary)
+			assert.NoError(t, err)
+			defer os.Remove(sample)
+			got, _ := ioutil.ReadFile(sample)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// TestPlanSample tests which captures are sampled
+func TestPlanSample(t *testing.T) {
+	defer SetSampling(DefaultSampling())
+	dir, err := ioutil.TempDir("", "hubcap-sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.pcapng")
+	// 36 bytes for each of 4 packets after the headers
+	content := concat(pcapngHead(binary.LittleEndian, 9), pcapngEPB(1), pcapngEPB(2), pcapngEPB(3), pcapngEPB(4))
+	assert.NoError(t, ioutil.WriteFile(path, content, 0644))
+	tests := []struct {
+		name     string
+		sampling Sampling
+		want     *SampleReport
+	}{
+		{"No limits", Sampling{Mode: SampleTime, Packets: 2}, nil},
+		{"Over size", Sampling{MaxSize: 100, Mode: SampleTime, Packets: 2},
+			&SampleReport{Sampling: Sampling{MaxSize: 100, Mode: SampleTime, Packets: 2}, Total: 4}},
+		{"Under size", Sampling{MaxSize: 1 << 20, Mode: SampleTime, Packets: 2}, nil},
+		{"Over packets", Sampling{MaxPackets: 3, Mode: SampleHead, Packets: 2},
+			&SampleReport{Sampling: Sampling{MaxPackets: 3, Mode: SampleHead, Packets: 2}, Total: 4}},
+		{"Sample as large as capture", Sampling{MaxPackets: 3, Mode: SampleHead, Packets: 4}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetSampling(tt.sampling)
+			plan, err := planSample(context.Background(), path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, plan.report)
+		})
+	}
+}
+
+// TestCanWalk tests that only formats with 16-byte record headers or pcapng blocks are walked
+func TestCanWalk(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{FormatPcap, true},
+		{FormatPcapNsec, true},
+		{FormatPcapng, true},
+		{FormatPcapMod, false},
+		{FormatERF, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			assert.Equal(t, tt.want, canWalk(FileFormat{Name: tt.format}))
+		})
+	}
+}
+
+// TestWalkSimplePackets tests that simple packet blocks too short to have a packet aren't packets
+func TestWalkSimplePackets(t *testing.T) {
+	spb := func(origLen uint32, packet []byte) []byte {
+		block := make([]byte, 12, 16+len(packet))
+		binary.LittleEndian.PutUint32(block, blockSPB)
+		binary.LittleEndian.PutUint32(block[4:], uint32(16+len(packet)))
+		binary.LittleEndian.PutUint32(block[8:], origLen)
+		block = append(block, packet...)
+		return append(block, block[4:8]...)
+	}
+	// Only the length fields, without the original length
+	short := make([]byte, 12)
+	binary.LittleEndian.PutUint32(short, blockSPB)
+	binary.LittleEndian.PutUint32(short[4:], 12)
+	binary.LittleEndian.PutUint32(short[8:], 12)
+	file := concat(pcapngHead(binary.LittleEndian, 6), short, spb(4, []byte("abcd")), spb(2, []byte("efgh")), spb(0, nil))
+	packets := make([][]byte, 0)
+	err := walkRecords(bytes.NewReader(file), FileFormat{Name: FormatPcapng}, func(rec walkedRecord) error {
+		if rec.isPacket {
+			packets = append(packets, append([]byte{}, rec.packet...))
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("abcd"), []byte("ef"), {}}, packets)
+}
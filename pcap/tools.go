@@ -0,0 +1,80 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Tools are the paths of the Wireshark programs that hubcap runs
+type Tools struct {
+	Tshark   string
+	Capinfos string
+}
+
+// ToolVersions are the Wireshark versions of Tools, like 3.6.2
+type ToolVersions struct {
+	Tshark   string
+	Capinfos string
+}
+
+var tools = Tools{Tshark: "tshark", Capinfos: "capinfos"}
+
+// SetTools changes which tshark and capinfos are run. Empty paths keep the current ones.
+func SetTools(paths Tools) {
+	if paths.Tshark != "" {
+		tools.Tshark = paths.Tshark
+	}
+	if paths.Capinfos != "" {
+		tools.Capinfos = paths.Capinfos
+	}
+}
+
+// CurrentTools returns the paths of the tshark and capinfos that are run
+func CurrentTools() Tools {
+	return tools
+}
+
+// Like "TShark (Wireshark) 3.6.2 (Git v3.6.2 packaged as 3.6.2-2)"
+var versionRe = regexp.MustCompile(`\(Wireshark\) (\d+\.\d+\.\d+)`)
+
+// DetectVersions asks tshark and capinfos for their versions
+func DetectVersions(ctx context.Context) (ToolVersions, error) {
+	var versions ToolVersions
+	var err error
+	if versions.Tshark, err = DetectTsharkVersion(ctx); err != nil {
+		return versions, err
+	}
+	versions.Capinfos, err = toolVersion(ctx, tools.Capinfos)
+	return versions, err
+}
+
+// DetectTsharkVersion asks tshark for its version, for commands that don't run capinfos
+func DetectTsharkVersion(ctx context.Context) (string, error) {
+	return toolVersion(ctx, tools.Tshark)
+}
+
+// toolVersion runs a tool with --version and returns the Wireshark version it prints
+func toolVersion(ctx context.Context, path string) (string, error) {
+	stdout, stderr, err := runTool(ctx, path, "--version")
+	if err != nil {
+		return "", fmt.Errorf("Problem running %s --version: %s %s", path, err, strings.TrimSpace(string(stderr)))
+	}
+	return parseVersion(stdout)
+}
+
+func parseVersion(output []byte) (string, error) {
+	match := versionRe.FindSubmatch(output)
+	if match == nil {
+		firstLine := strings.SplitN(string(output), "\n", 2)[0]
+		return "", fmt.Errorf("No Wireshark version in `%s`", firstLine)
+	}
+	return string(match[1]), nil
+}
+
+// MajorVersion returns the major version of a Wireshark version, like 3 for 3.6.2.
+// Dissectors change enough between major versions that their results shouldn't be mixed.
+func MajorVersion(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
@@ -0,0 +1,30 @@
+package pcap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseVersion tests parseVersion and MajorVersion
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		want      string
+		wantMajor string
+		wantErr   bool
+	}{
+		{"tshark", "TShark (Wireshark) 3.6.2 (Git v3.6.2 packaged as 3.6.2-2)\n\nCopyright 1998-2022", "3.6.2", "3", false},
+		{"capinfos", "Capinfos (Wireshark) 4.2.0 (v4.2.0-0-g0ab4ad3a1a6b).\n", "4.2.0", "4", false},
+		{"Not wireshark", "tshark: command not found\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVersion([]byte(tt.output))
+			assert.Equal(t, tt.wantErr, err != nil, "parseVersion() error = %v", err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantMajor, MajorVersion(got))
+		})
+	}
+}
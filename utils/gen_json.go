@@ -24,6 +24,22 @@ type PcapInfo struct {
 	Protocols   []string
 	Ports       map[string][]int
 	ErrorStr    string
+	Descriptions []SourceDescription
+	Tags        []string
+	Quality     *Quality
+}
+
+// Quality is how clean a pcap is. Only the score is abridged.
+type Quality struct {
+	Score float64
+}
+
+// SourceDescription is what one source page says about a pcap
+type SourceDescription struct {
+	Source string
+	Link string
+	Title string
+	Description string
 }
 
 // Data item as part of an abrdiged captures json
@@ -36,6 +52,9 @@ type AbridgedPcapInfo struct {
 	CaptureDuration float64
 	NumberOfPackets int
 	NumberOfInterfacesInFile int
+	Descriptions []SourceDescription // Every source's description, primary first
+	Tags []string // Topics like voip or ics-scada, for browsing by category
+	QualityScore *float64 `json:",omitempty"` // From 0 to 100 to sort by, if the pcap was scored
 }
 
 // given a filesize, return the same value in KB/MB/GB, etc
@@ -129,6 +148,12 @@ func main() {
 				captureDuration,
 				numberOfPackets,
 				numberOfInterfaces,
+				pi.Descriptions,
+				pi.Tags,
+				nil,
+			}
+			if pi.Quality != nil {
+				new_pcapinfo.QualityScore = &pi.Quality.Score
 			}
 			Pcaps = append(Pcaps, new_pcapinfo)
 		}